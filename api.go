@@ -0,0 +1,168 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/google/uuid"
+)
+
+const (
+    catalogFetchTimeout = 10 * time.Second
+    maxExecWait         = 5 * time.Minute
+)
+
+// FetchFunctions returns the receiver's function catalog, asking the
+// receiver for it when nothing has been cached yet.
+func (hub *Hub) FetchFunctions(name string, timeout time.Duration) ([]MacronFunction, error) {
+    if name == "" {
+	return nil, errors.New("Receiver Name Empty.")
+    }
+    hub.mu.Lock()
+    receiver := hub.receivers[name]
+    hub.mu.Unlock()
+    if receiver == nil {
+	return nil, fmt.Errorf("Receiver not found with name: %s", name)
+    }
+    return hub.fetchCatalog(receiver, timeout)
+}
+
+// fetchCatalog is FetchFunctions for a receiver already looked up.
+func (hub *Hub) fetchCatalog(receiver *Receiver, timeout time.Duration) ([]MacronFunction, error) {
+    hub.mu.Lock()
+    cached := receiver.functions
+    hub.mu.Unlock()
+    if cached != nil {
+	return *cached, nil
+    }
+
+    waiterId := uuid.New().String()
+    waiter := make(chan *[]MacronFunction, 1)
+    hub.mu.Lock()
+    hub.functionWaiters[waiterId] = waiter
+    hub.mu.Unlock()
+    defer func() {
+	hub.mu.Lock()
+	delete(hub.functionWaiters, waiterId)
+	hub.mu.Unlock()
+    }()
+
+    // The timeout covers handing the request to the receiver too, so one
+    // whose writePump has stopped cannot hang the caller.
+    deadline := time.NewTimer(timeout)
+    defer deadline.Stop()
+    err := enqueueBefore(receiver.egress, functionRequest("functions", waiterId), deadline.C)
+    if err != nil {
+	return nil, fmt.Errorf("Receiver %s did not send its functions in time", receiver.name)
+    }
+    select {
+    case functions := <-waiter:
+	if functions == nil {
+	    return []MacronFunction{}, nil
+	}
+	return *functions, nil
+    case <-deadline.C:
+	return nil, fmt.Errorf("Receiver %s did not send its functions in time", receiver.name)
+    }
+}
+
+func parseWait(r *http.Request) (time.Duration, error) {
+    wait := r.URL.Query().Get("wait")
+    if wait == "" {
+	return 0, nil
+    }
+    timeout, err := time.ParseDuration(wait)
+    if err != nil || timeout < 0 || timeout > maxExecWait {
+	return 0, fmt.Errorf("Invalid wait duration: %s", wait)
+    }
+    return timeout, nil
+}
+
+func (hub *Hub) HandlerListReceivers(w http.ResponseWriter, r *http.Request) {
+    receivers := hub.GetReceivers()
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "receivers", Receivers: &receivers})
+}
+
+func (hub *Hub) HandlerListSessions(w http.ResponseWriter, r *http.Request) {
+    sessions := hub.ListSessions()
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "sessions", Sessions: &sessions})
+}
+
+func (hub *Hub) HandlerListFunctions(w http.ResponseWriter, r *http.Request) {
+    name := chi.URLParam(r, "name")
+    functions, err := hub.FetchFunctions(name, catalogFetchTimeout)
+    if err != nil {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "functions", ReceiverName: name, Functions: &functions})
+}
+
+// HandlerExecFunction execs a function addressed by its key, or by its
+// positional id for receivers that do not advertise keys. With ?wait=30s the
+// request blocks until the receiver reports a result.
+func (hub *Hub) HandlerExecFunction(w http.ResponseWriter, r *http.Request) {
+    name := chi.URLParam(r, "name")
+    id := chi.URLParam(r, "id")
+    timeout, err := parseWait(r)
+    if err != nil {
+	writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    var body ClientInbound
+    if r.ContentLength != 0 {
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+	    writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: "Invalid JSON format."})
+	    return
+	}
+    }
+
+    receiver, fn, err := hub.resolveFunction(name, id, body.FunctionVersion)
+    var stale *StaleFunctionError
+    var unavailable *CatalogUnavailableError
+    if errors.As(err, &stale) || errors.As(err, &unavailable) {
+	if n, convErr := strconv.Atoi(id); convErr == nil && body.FunctionVersion == "" {
+	    fn = MacronFunction{Id: &n}
+	    err = nil
+	}
+    }
+    if errors.As(err, &stale) {
+	writeJSON(w, http.StatusConflict, ClientResponse{Type: "error", Code: "stale_function", Error: err.Error()})
+	return
+    }
+    if errors.As(err, &unavailable) {
+	writeJSON(w, http.StatusGatewayTimeout, ClientResponse{Type: "error", Code: "catalog_unavailable", Error: err.Error()})
+	return
+    }
+    if errors.Is(err, errShuttingDown) {
+	writeJSON(w, http.StatusServiceUnavailable, ClientResponse{Type: "error", Code: "server_shutdown", Error: err.Error()})
+	return
+    }
+    if err != nil {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    if receiver == nil {
+	hub.mu.Lock()
+	receiver = hub.receivers[name]
+	hub.mu.Unlock()
+	if receiver == nil {
+	    writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: "Receiver not found with name: " + name})
+	    return
+	}
+    }
+
+    exec := hub.startExec(receiver, fn, body.Args, "")
+    if timeout == 0 {
+	writeJSON(w, http.StatusAccepted, ClientResponse{Type: "exec", ExecId: exec.id, ReceiverName: name})
+	return
+    }
+    result := hub.awaitExec(exec, timeout)
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "exec_result", ExecId: exec.id, ReceiverName: name, Result: &result})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "runtime"
+    "runtime/debug"
+    "sort"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    dotenv "github.com/joho/godotenv"
+    "github.com/pelletier/go-toml/v2"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+const remoteTimeout = 10 * time.Second
+
+const usage = `Usage: macron-server <command> [flags]
+
+Commands:
+  serve           Run the server (the default)
+  version         Print the version
+  check-config    Validate a config file
+  users           List the users a config file allows to log in
+  receivers       List receivers connected to a running server
+  sessions        List sessions on a running server
+  ctl             Administer a running server over its control socket
+  print-config    Print the effective config with secrets redacted
+
+Run "macron-server <command> -h" for a command's flags. Flags override
+MACRON_* environment variables, which override the config file. A .env
+file in the working directory is loaded into the environment if present.
+`
+
+// run dispatches a command line and returns the process exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+    err := loadDotenv(".env")
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return 1
+    }
+    if len(args) == 0 {
+	return runServe(nil, stderr)
+    }
+    switch args[0] {
+    case "serve":
+	return runServe(args[1:], stderr)
+    case "version":
+	return runVersion(stdout)
+    case "check-config":
+	return checkConfig(args[1:], stdout, stderr)
+    case "users":
+	return runUsers(args[1:], stdout, stderr)
+    case "receivers":
+	return runReceivers(args[1:], stdout, stderr)
+    case "sessions":
+	return runSessions(args[1:], stdout, stderr)
+    case "ctl":
+	return runCtl(args[1:], stdout, stderr)
+    case "print-config":
+	return printConfig(args[1:], stdout, stderr)
+    case "help", "-h", "--help":
+	fmt.Fprint(stdout, usage)
+	return 0
+    }
+    fmt.Fprintf(stderr, "Unknown command: %s\n\n%s", args[0], usage)
+    return 2
+}
+
+// firstSet returns the first non-empty value.
+func firstSet(values ...string) string {
+    for _, v := range values {
+	if v != "" {
+	    return v
+	}
+    }
+    return ""
+}
+
+// configPath resolves the config file from a --config flag, MACRON_CONFIG
+// or the default location.
+func configPath(flagValue string) string {
+    return firstSet(flagValue, os.Getenv("MACRON_CONFIG"), defaultConfigPath())
+}
+
+// loadDotenv adds the variables in path to the environment, without
+// replacing ones already set. The file is optional.
+func loadDotenv(path string) error {
+    err := dotenv.Load(path)
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+	return fmt.Errorf("Could not load %s: %w", path, err)
+    }
+    return nil
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, stderr io.Writer) bool {
+    fs.SetOutput(stderr)
+    return fs.Parse(args) == nil
+}
+
+// configFlags registers --config and a flag for every setting, returning
+// the source they describe once fs is parsed.
+func configFlags(fs *flag.FlagSet) func() ConfigSource {
+    flagConfig := fs.String("config", "", "config file (env MACRON_CONFIG)")
+    flags := make(map[string]string)
+    registerSettings(fs, flags)
+    return func() ConfigSource {
+	return ConfigSource{Path: configPath(*flagConfig), Flags: flags}
+    }
+}
+
+func loadServeConfig(source ConfigSource) (*Config, error) {
+    config, err := source.Load()
+    if err != nil {
+	return nil, err
+    }
+    if config.Server.Listen == "" {
+	return nil, errors.New("No listen address: set --listen, MACRON_LISTEN, PORT or server.listen.")
+    }
+    return config, nil
+}
+
+func runServe(args []string, stderr io.Writer) int {
+    fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+    source := configFlags(fs)
+    if !parseFlags(fs, args, stderr) {
+	return 2
+    }
+
+    config, err := loadServeConfig(source())
+    if err != nil {
+	printConfigError(stderr, source().Path, err)
+	return 1
+    }
+    logs, err := setupLogging(config.Server, stderr)
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return 1
+    }
+    defer logs.Close()
+
+    err = startServer(config, source())
+    if err != nil {
+	slog.Error("Server failed", "error", err)
+	return 1
+    }
+    return 0
+}
+
+// printConfig prints the config serve would run with, as TOML.
+func printConfig(args []string, stdout io.Writer, stderr io.Writer) int {
+    fs := flag.NewFlagSet("print-config", flag.ContinueOnError)
+    source := configFlags(fs)
+    if !parseFlags(fs, args, stderr) {
+	return 2
+    }
+    config, err := source().Load()
+    if err != nil {
+	printConfigError(stderr, source().Path, err)
+	return 1
+    }
+    out, err := toml.Marshal(config.redactSecrets())
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return 1
+    }
+    stdout.Write(out)
+    return 0
+}
+
+func runVersion(stdout io.Writer) int {
+    revision := ""
+    if info, ok := debug.ReadBuildInfo(); ok {
+	for _, setting := range info.Settings {
+	    if setting.Key == "vcs.revision" {
+		revision = " " + setting.Value
+	    }
+	}
+    }
+    fmt.Fprintf(stdout, "macron-server %s%s (%s)\n", version, revision, runtime.Version())
+    return 0
+}
+
+// runUsers lists who can log in with the config. The server has a single
+// account, so this is mostly a check of which email, if any, is required.
+func runUsers(args []string, stdout io.Writer, stderr io.Writer) int {
+    fs := flag.NewFlagSet("users", flag.ContinueOnError)
+    flagConfig := fs.String("config", "", "config file (env MACRON_CONFIG)")
+    if !parseFlags(fs, args, stderr) {
+	return 2
+    }
+    path := configPath(*flagConfig)
+    config, err := loadConfig(path)
+    if err != nil {
+	printConfigError(stderr, path, err)
+	return 1
+    }
+
+    user := "(any email)"
+    switch config.Server.AuthType {
+    case AuthFull:
+	user = config.Server.Email
+    case AuthPassword:
+	user = "(shared password)"
+    }
+    tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+    fmt.Fprintln(tw, "USER\tAUTH TYPE")
+    fmt.Fprintf(tw, "%s\t%s\n", user, config.Server.AuthType)
+    tw.Flush()
+    return 0
+}
+
+// remoteOptions locate a running server. Without a token the command logs
+// in with the credentials from the config file.
+type remoteOptions struct {
+    config  string
+    server  string
+    token   string
+}
+
+func (o *remoteOptions) register(fs *flag.FlagSet) {
+    fs.StringVar(&o.config, "config", "", "config file (env MACRON_CONFIG)")
+    fs.StringVar(&o.server, "server", "", "server URL, e.g. http://localhost:8080 (env MACRON_SERVER)")
+    fs.StringVar(&o.token, "token", "", "session token (env MACRON_TOKEN)")
+}
+
+type apiClient struct {
+    base    string
+    token   string
+    http    *http.Client
+}
+
+// serverURL turns a listen address into a URL for the local machine.
+func serverURL(listen string, tls bool) (string, error) {
+    host, port, err := net.SplitHostPort(listen)
+    if err != nil {
+	return "", err
+    }
+    if host == "" || host == "0.0.0.0" || host == "::" {
+	host = "localhost"
+    }
+    scheme := "http://"
+    if tls {
+	scheme = "https://"
+    }
+    return scheme + net.JoinHostPort(host, port), nil
+}
+
+func (o remoteOptions) connect() (*apiClient, error) {
+    client := &apiClient{
+	base: firstSet(o.server, os.Getenv("MACRON_SERVER")),
+	token: firstSet(o.token, os.Getenv("MACRON_TOKEN")),
+	http: &http.Client{Timeout: remoteTimeout},
+    }
+    var config *Config
+    if client.base == "" || client.token == "" {
+	var err error
+	config, err = loadConfig(configPath(o.config))
+	if err != nil {
+	    return nil, err
+	}
+    }
+    if client.base == "" {
+	if config.Server.Listen == "" {
+	    return nil, errors.New("No server address: set --server, MACRON_SERVER or server.listen.")
+	}
+	base, err := serverURL(config.Server.Listen, config.Server.TLSCert != "")
+	if err != nil {
+	    return nil, err
+	}
+	client.base = base
+    }
+    client.base = strings.TrimSuffix(client.base, "/")
+    if client.token == "" {
+	err := client.login(config)
+	if err != nil {
+	    return nil, err
+	}
+    }
+    return client, nil
+}
+
+func (c *apiClient) login(config *Config) error {
+    body, _ := json.Marshal(Credential{
+	Email: firstSet(config.Server.Email, "macron-server"),
+	Password: config.Server.Password,
+    })
+    resp, err := c.http.Post(c.base + "/v2/login", "application/json", bytes.NewReader(body))
+    if err != nil {
+	return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+	return fmt.Errorf("Login failed: %s", resp.Status)
+    }
+    var auth AuthenticationMessage
+    err = json.NewDecoder(resp.Body).Decode(&auth)
+    if err != nil {
+	return err
+    }
+    c.token = auth.SessionToken
+    return nil
+}
+
+func (c *apiClient) get(path string) (ClientResponse, error) {
+    var response ClientResponse
+    req, err := http.NewRequest(http.MethodGet, c.base + path, nil)
+    if err != nil {
+	return response, err
+    }
+    req.Header.Set("Authorization", "Bearer " + c.token)
+    resp, err := c.http.Do(req)
+    if err != nil {
+	return response, err
+    }
+    defer resp.Body.Close()
+    err = json.NewDecoder(resp.Body).Decode(&response)
+    if err != nil {
+	return response, fmt.Errorf("%s: %s", path, resp.Status)
+    }
+    if resp.StatusCode != http.StatusOK {
+	return response, fmt.Errorf("%s: %s: %s", path, resp.Status, response.Error)
+    }
+    return response, nil
+}
+
+// remoteGet parses a remote command's flags and fetches path.
+func remoteGet(name string, path string, args []string, stderr io.Writer) (ClientResponse, int) {
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    var opts remoteOptions
+    opts.register(fs)
+    if !parseFlags(fs, args, stderr) {
+	return ClientResponse{}, 2
+    }
+    client, err := opts.connect()
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return ClientResponse{}, 1
+    }
+    response, err := client.get(path)
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return ClientResponse{}, 1
+    }
+    return response, 0
+}
+
+func runReceivers(args []string, stdout io.Writer, stderr io.Writer) int {
+    response, code := remoteGet("receivers", "/v2/receivers", args, stderr)
+    if code != 0 {
+	return code
+    }
+    receivers := make([]string, 0)
+    if response.Receivers != nil {
+	receivers = *response.Receivers
+    }
+    sort.Strings(receivers)
+    for _, name := range receivers {
+	fmt.Fprintln(stdout, name)
+    }
+    return 0
+}
+
+func runSessions(args []string, stdout io.Writer, stderr io.Writer) int {
+    response, code := remoteGet("sessions", "/v2/sessions", args, stderr)
+    if code != 0 {
+	return code
+    }
+    tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+    fmt.Fprintln(tw, "ID\tEXPIRES")
+    if response.Sessions != nil {
+	for _, session := range *response.Sessions {
+	    fmt.Fprintf(tw, "%s\t%s\n", session.Id, session.ExpiresAt.Local().Format(time.RFC3339))
+	}
+    }
+    tw.Flush()
+    return 0
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -10,82 +14,301 @@ type Client struct {
     hub         *Hub
     id		string
     conn        *websocket.Conn
+    log         *slog.Logger
     egress      chan[]byte
+    writeMu	sync.Mutex
+    // version is the negotiated protocol version; 0 means the legacy v1/v2
+    // message format.
+    version	int
+    features	[]string
+    // functionReplies maps a receiver name to the v3 request waiting on
+    // its catalog.
+    functionReplies map[string]string
+    repliesMu	sync.Mutex
 }
 
-func (c *Client) sendErrorResponse(error string) {
+// writeJSON serializes writes to the connection, which may come from the
+// pumps and from goroutines reporting exec and workflow results. v3 clients
+// get the message wrapped in an envelope replying to replyTo.
+func (c *Client) writeJSON(v interface{}, replyTo string) error {
+    return c.writeJSONBefore(v, replyTo, time.Time{})
+}
+
+// writeJSONBefore is writeJSON that gives up at deadline, unless it is
+// zero, so a client that has stopped reading cannot hold the caller.
+func (c *Client) writeJSONBefore(v interface{}, replyTo string, deadline time.Time) error {
+    var err error
+    var bytes []byte
+    if c.version >= ProtocolV3 {
+	bytes, _, _, err = toEnvelope(v, replyTo)
+	if err != nil {
+	    return err
+	}
+    }
+    c.writeMu.Lock()
+    if !deadline.IsZero() {
+	c.conn.SetWriteDeadline(deadline)
+    }
+    if c.version >= ProtocolV3 {
+	err = writeWireMessage(c.conn, bytes)
+    } else {
+	err = writeWire(c.conn, v)
+    }
+    if !deadline.IsZero() {
+	c.conn.SetWriteDeadline(time.Time{})
+    }
+    c.writeMu.Unlock()
+    c.hub.metrics.messageOut("client", responseType(v), err)
+    return err
+}
+
+// readMessage reads the next request and the id a reply should refer to.
+func (c *Client) readMessage() (ClientInbound, string, error) {
+    var message ClientInbound
+    if c.version < ProtocolV3 {
+	err := readWire(c.conn, c.hub.config().WebSocket.clientLimit(), &message)
+	return message, "", err
+    }
+    var env Envelope
+    err := readWire(c.conn, c.hub.config().WebSocket.clientLimit(), &env)
+    if err != nil {
+	return message, "", err
+    }
+    err = fromEnvelope(env, &message)
+    return message, env.Id, err
+}
+
+func (c *Client) expectFunctions(receiverName string, replyTo string) {
+    if replyTo == "" {
+	return
+    }
+    c.repliesMu.Lock()
+    defer c.repliesMu.Unlock()
+    if c.functionReplies == nil {
+	c.functionReplies = make(map[string]string)
+    }
+    c.functionReplies[receiverName] = replyTo
+}
+
+func (c *Client) takeFunctionsReply(receiverName string) string {
+    c.repliesMu.Lock()
+    defer c.repliesMu.Unlock()
+    replyTo := c.functionReplies[receiverName]
+    delete(c.functionReplies, receiverName)
+    return replyTo
+}
+
+func (c *Client) sendErrorResponse(error string, replyTo string) {
     response := ClientResponse {
 	Type: "error",
 	Error: error,
     }
 
-    c.conn.WriteJSON(response)
+    c.writeJSON(response, replyTo)
+}
+func (c *Client) sendCodedErrorResponse(code string, error string, replyTo string) {
+    response := ClientResponse {
+	Type: "error",
+	Code: code,
+	Error: error,
+    }
+
+    c.writeJSON(response, replyTo)
 }
 func (c *Client) close() {
+    c.writeMu.Lock()
     c.conn.WriteMessage(websocket.CloseAbnormalClosure, []byte(""))
+    c.writeMu.Unlock()
     c.conn.Close()
     
     //c.hub.clients[c.] = nil
 }
 
-func (c *Client) sendMessage(msgType string) {
+func (c *Client) sendMessage(msgType string, replyTo string) {
     response := ClientResponse {
 	Type: msgType,
     }
 
-    c.conn.WriteJSON(response)
+    c.writeJSON(response, replyTo)
 }
 
-func (c *Client) sendReceiverResponse(receivers *[]string) {
+func (c *Client) sendReceiverResponse(receivers *[]string, replyTo string) {
     response := ClientResponse {
 	Type: "receivers",
 	Receivers: receivers,
     }
 
     // May want to switch back to sending serialized message to client egress
-    c.conn.WriteJSON(response)
+    c.writeJSON(response, replyTo)
 }
 
-func (c *Client) sendFunctionResponse(name string, functions *[]MacronFunction) {
+func (c *Client) sendFunctionResponse(name string, functions *[]MacronFunction, replyTo string) {
     response := ClientResponse {
 	Type: "functions",
 	ReceiverName: name,
 	Functions: functions,
     }
-    c.conn.WriteJSON(response)
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendExecResult(result *ExecResult, replyTo string) {
+    response := ClientResponse {
+	Type: "exec_result",
+	ReceiverName: result.ReceiverName,
+	Result: result,
+    }
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendBroadcastResponse(selector string, results *[]ExecResult, replyTo string) {
+    response := ClientResponse {
+	Type: "broadcast_result",
+	Selector: selector,
+	Results: results,
+    }
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendSchedules(schedules *[]Schedule, replyTo string) {
+    response := ClientResponse {
+	Type: "schedules",
+	Schedules: schedules,
+    }
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendSchedule(schedule *Schedule, replyTo string) {
+    response := ClientResponse {
+	Type: "schedule",
+	Schedule: schedule,
+    }
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendHistory(records *[]ExecRecord, replyTo string) {
+    response := ClientResponse {
+	Type: "history",
+	History: records,
+    }
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendWorkflows(workflows *[]Workflow, replyTo string) {
+    response := ClientResponse {
+	Type: "workflows",
+	Workflows: workflows,
+    }
+    c.writeJSON(response, replyTo)
+}
+
+func (c *Client) sendWorkflowRun(run *WorkflowRun, replyTo string) {
+    response := ClientResponse {
+	Type: "workflow_run",
+	WorkflowRun: run,
+    }
+    c.writeJSON(response, replyTo)
 }
 
 func (c *Client) readPump() {
     defer func() {
+	c.hub.RemoveClient(c.id)
 	c.close()
     }()
 
     for {
-	var message ClientInbound
-	err := c.conn.ReadJSON(&message)
+	message, replyTo, err := c.readMessage()
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+	    c.log.Warn("Message too large", "error", err)
+	    c.sendCodedErrorResponse("message_too_large", err.Error(), "")
+	    closeTooLarge(c.conn)
+	    break
+	}
 	if err != nil {
-	    log.Printf("error: %v", err)
+	    c.log.Info("Client disconnected", "error", err)
+	    c.writeMu.Lock()
 	    c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+	    c.writeMu.Unlock()
 	    c.conn.Close()
 	    break
 	}
-	log.Printf("Client message: %v", message)
+	c.log.Debug("Client message", "type", message.Type, "receiver", message.ReceiverName)
+	c.hub.metrics.messageIn("client", message.Type)
 	switch message.Type {
 	case "receivers":
-	    log.Printf("Client requesting receivers...")
 	    receivers := c.hub.GetReceivers()
-	    c.sendReceiverResponse(&receivers)
-	    log.Println("Sending list of receivers")
+	    c.sendReceiverResponse(&receivers, replyTo)
 	case "functions":
-	    log.Printf("Client requesting functions from: %s", message.ReceiverName)
+	    c.expectFunctions(message.ReceiverName, replyTo)
 	    err := c.hub.GetFunctions(message.ReceiverName, c.id)
 	    if err != nil {
-		log.Printf("Error Getting Functions: %v", err.Error())
-		c.sendErrorResponse(err.Error())
+		c.log.Warn("Getting functions failed", "receiver", message.ReceiverName, "error", err)
+		c.sendErrorResponse(err.Error(), replyTo)
 	    }
 	case "exec":
-	    c.hub.ExecFunction(message.ReceiverName, *message.FunctionId)
-
+	    var err error
+	    if message.FunctionKey != "" {
+		_, err = c.hub.ExecFunctionByKey(message.ReceiverName, message.FunctionKey, message.FunctionVersion, message.Args, c.id, replyTo)
+	    } else if message.FunctionId != nil {
+		_, err = c.hub.ExecFunction(message.ReceiverName, *message.FunctionId, message.Args, c.id, replyTo)
+	    } else {
+		err = errors.New("Function Key Empty.")
+	    }
+	    var stale *StaleFunctionError
+	    if errors.As(err, &stale) {
+		c.log.Info("Rejected stale exec", "error", err)
+		c.sendCodedErrorResponse("stale_function", err.Error(), replyTo)
+	    } else if err != nil {
+		c.log.Warn("Exec failed", "receiver", message.ReceiverName, "error", err)
+		c.sendErrorResponse(err.Error(), replyTo)
+	    }
+	case "schedules":
+	    schedules := c.hub.scheduler.List()
+	    c.sendSchedules(&schedules, replyTo)
+	case "schedule_toggle":
+	    if message.Enabled == nil {
+		c.sendErrorResponse("Enabled Empty.", replyTo)
+		break
+	    }
+	    schedule, err := c.hub.scheduler.SetEnabled(message.ScheduleId, *message.Enabled)
+	    if err != nil {
+		c.log.Warn("Toggling schedule failed", "schedule", message.ScheduleId, "error", err)
+		c.sendErrorResponse(err.Error(), replyTo)
+		break
+	    }
+	    c.sendSchedule(&schedule, replyTo)
+	case "history":
+	    records := c.hub.QueryHistory(HistoryQuery{
+		ReceiverName: message.ReceiverName,
+		FunctionKey: message.FunctionKey,
+		Limit: message.Limit,
+	    })
+	    c.sendHistory(&records, replyTo)
+	case "workflows":
+	    workflows := c.hub.workflows.Workflows()
+	    c.sendWorkflows(&workflows, replyTo)
+	case "run_workflow":
+	    c.log.Info("Running workflow", "workflow", message.WorkflowName)
+	    run, err := c.hub.workflows.Start(message.WorkflowName, func(run WorkflowRun) {
+		c.sendWorkflowRun(&run, replyTo)
+	    })
+	    if err != nil {
+		c.log.Warn("Starting workflow failed", "workflow", message.WorkflowName, "error", err)
+		c.sendErrorResponse(err.Error(), replyTo)
+		break
+	    }
+	    c.sendWorkflowRun(&run, replyTo)
+	case "broadcast_exec":
+	    c.log.Info("Broadcasting exec", "function", message.FunctionName, "selector", message.Selector)
+	    go func(selector string, name string, replyTo string) {
+		results, err := c.hub.BroadcastExec(selector, name)
+		if err != nil {
+		    c.log.Warn("Broadcast failed", "function", name, "selector", selector, "error", err)
+		    c.sendErrorResponse(err.Error(), replyTo)
+		    return
+		}
+		c.sendBroadcastResponse(selector, &results, replyTo)
+	    }(message.Selector, message.FunctionName, replyTo)
 	}
     }
 }
@@ -97,17 +320,47 @@ func (c *Client) writePump() {
     for {
 	select {
 	case message, ok := <- c.egress:
-	    log.Println("Sending client message")
+	    c.log.Debug("Sending client message")
 	    if !ok {
+		c.writeMu.Lock()
 		c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		c.writeMu.Unlock()
 		c.conn.Close()
-		log.Println("error sending client message")
+		c.log.Warn("Client egress closed")
 		return
 	    }
-	    err := c.conn.WriteMessage(1, message)
+	    msgType := messageType(message)
+	    message, err := c.egressMessage(message)
+	    if err != nil {
+		c.log.Error("Framing client message failed", "error", err)
+		continue
+	    }
+	    c.writeMu.Lock()
+	    err = writeWireMessage(c.conn, message)
+	    c.writeMu.Unlock()
+	    c.hub.metrics.messageOut("client", msgType, err)
 	    if err != nil {
 		return
 	    }
 	}
     }
 }
+
+// egressMessage frames a legacy message queued by the hub for the client's
+// protocol version. Catalogs reply to the request that asked for them.
+func (c *Client) egressMessage(message []byte) ([]byte, error) {
+    if c.version < ProtocolV3 {
+	return message, nil
+    }
+    var response ClientResponse
+    err := json.Unmarshal(message, &response)
+    if err != nil {
+	return nil, err
+    }
+    replyTo := ""
+    if response.Type == "functions" {
+	replyTo = c.takeFunctionsReply(response.ReceiverName)
+    }
+    bytes, _, _, err := toEnvelope(message, replyTo)
+    return bytes, err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "reflect"
+
+    "github.com/gorilla/websocket"
+    "github.com/ugorji/go/codec"
+)
+
+// WebSocket subprotocols. Peers that do not ask for one get JSON. The hub
+// and its message structs only deal in JSON; binary encodings are translated
+// at the connection edge, so a JSON client can talk to a MessagePack
+// receiver and the other way around.
+const (
+    subprotocolJSON     = "macron.json"
+    subprotocolMsgpack  = "macron.msgpack"
+    subprotocolCBOR     = "macron.cbor"
+)
+
+// Subprotocols in order of preference.
+var subprotocols = []string{subprotocolMsgpack, subprotocolCBOR, subprotocolJSON}
+
+var (
+    msgpackHandle   = &codec.MsgpackHandle{}
+    cborHandle      = &codec.CborHandle{}
+)
+
+func init() {
+    mapType := reflect.TypeOf(map[string]interface{}(nil))
+    msgpackHandle.MapType = mapType
+    msgpackHandle.RawToString = true
+    msgpackHandle.WriteExt = true
+    cborHandle.MapType = mapType
+}
+
+func wireHandle(ws *websocket.Conn) codec.Handle {
+    switch ws.Subprotocol() {
+    case subprotocolMsgpack:
+	return msgpackHandle
+    case subprotocolCBOR:
+	return cborHandle
+    }
+    return nil
+}
+
+// readWireMessage reads the next message, of at most limit bytes, and
+// returns it as JSON.
+func readWireMessage(ws *websocket.Conn, limit int64) ([]byte, error) {
+    message, err := readLimited(ws, limit)
+    if err != nil {
+	return nil, err
+    }
+    handle := wireHandle(ws)
+    if handle == nil {
+	return message, nil
+    }
+    var value interface{}
+    err = codec.NewDecoderBytes(message, handle).Decode(&value)
+    if err != nil {
+	return nil, fmt.Errorf("invalid %s message: %w", ws.Subprotocol(), err)
+    }
+    return json.Marshal(value)
+}
+
+// readWire is ws.ReadJSON for any negotiated encoding.
+func readWire(ws *websocket.Conn, limit int64, v interface{}) error {
+    message, err := readWireMessage(ws, limit)
+    if err != nil {
+	return err
+    }
+    return json.Unmarshal(message, v)
+}
+
+// encodeWire converts a JSON message to the connection's encoding.
+func encodeWire(ws *websocket.Conn, message []byte) (int, []byte, error) {
+    handle := wireHandle(ws)
+    if handle == nil {
+	return websocket.TextMessage, message, nil
+    }
+    decoder := json.NewDecoder(bytes.NewReader(message))
+    decoder.UseNumber()
+    var value interface{}
+    err := decoder.Decode(&value)
+    if err != nil {
+	return 0, nil, err
+    }
+    var out []byte
+    err = codec.NewEncoderBytes(&out, handle).Encode(fromJSONNumbers(value))
+    if err != nil {
+	return 0, nil, err
+    }
+    return websocket.BinaryMessage, out, nil
+}
+
+// writeWireMessage writes a JSON message in the connection's encoding.
+func writeWireMessage(ws *websocket.Conn, message []byte) error {
+    messageType, out, err := encodeWire(ws, message)
+    if err != nil {
+	return err
+    }
+    return ws.WriteMessage(messageType, out)
+}
+
+// writeWire is ws.WriteJSON for any negotiated encoding.
+func writeWire(ws *websocket.Conn, v interface{}) error {
+    message, err := json.Marshal(v)
+    if err != nil {
+	return err
+    }
+    return writeWireMessage(ws, message)
+}
+
+// fromJSONNumbers turns json.Number into integers where possible, so binary
+// peers see ids as integers rather than floats.
+func fromJSONNumbers(value interface{}) interface{} {
+    switch v := value.(type) {
+    case json.Number:
+	if n, err := v.Int64(); err == nil {
+	    return n
+	}
+	f, _ := v.Float64()
+	return f
+    case map[string]interface{}:
+	for key, item := range v {
+	    v[key] = fromJSONNumbers(item)
+	}
+    case []interface{}:
+	for i, item := range v {
+	    v[i] = fromJSONNumbers(item)
+	}
+    }
+    return value
+}
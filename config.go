@@ -0,0 +1,482 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/pelletier/go-toml/v2"
+)
+
+// Auth types. "password" authenticates WebSocket peers with the shared
+// password; "session" and "full" hand out session tokens from /v2/login,
+// with "full" also checking the configured email.
+const (
+    AuthPassword    = "password"
+    AuthSession     = "session"
+    AuthFull        = "full"
+)
+
+// ConfigError lists every problem found in a config file.
+type ConfigError struct {
+    Path        string
+    Problems    []string
+}
+
+func (e *ConfigError) Error() string {
+    return fmt.Sprintf("%s: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+func defaultConfigPath() string {
+    return filepath.Join(os.Getenv("HOME"), "/.config/macron-server/config.toml")
+}
+
+// decodeConfig decodes TOML, rejecting keys the Config does not know so a
+// misspelt setting is not silently ignored.
+func decodeConfig(path string, data []byte) (*Config, error) {
+    decoder := toml.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    var cfg Config
+    err := decoder.Decode(&cfg)
+    var strict *toml.StrictMissingError
+    if errors.As(err, &strict) {
+	problems := make([]string, 0, len(strict.Errors))
+	for _, e := range strict.Errors {
+	    row, _ := e.Position()
+	    problems = append(problems, fmt.Sprintf("line %d: unknown key %s", row, strings.Join(e.Key(), ".")))
+	}
+	return nil, &ConfigError{Path: path, Problems: problems}
+    }
+    var decodeErr *toml.DecodeError
+    if errors.As(err, &decodeErr) {
+	row, _ := decodeErr.Position()
+	return nil, &ConfigError{Path: path, Problems: []string{fmt.Sprintf("line %d: %v", row, strings.TrimPrefix(decodeErr.Error(), "toml: "))}}
+    }
+    if err != nil {
+	return nil, &ConfigError{Path: path, Problems: []string{err.Error()}}
+    }
+    return &cfg, nil
+}
+
+// ConfigSource is where the effective config comes from: the TOML file,
+// overridden by MACRON_* environment variables, overridden in turn by flags.
+// Hooks and webhooks can only be set in the file.
+type ConfigSource struct {
+    Path    string
+    // Flags holds flag values by setting key, e.g. "server.listen".
+    Flags   map[string]string
+}
+
+// Load parses the file, applies overrides and defaults and validates the
+// result. The default config file may be missing, so a server can be
+// configured entirely from the environment; a path that was asked for
+// must exist.
+func (s ConfigSource) Load() (*Config, error) {
+    config, err := parseConfig(s.Path)
+    if errors.Is(err, os.ErrNotExist) && s.Path == defaultConfigPath() {
+	config, err = &Config{}, nil
+    }
+    if err != nil {
+	return nil, err
+    }
+    err = config.applyOverrides(s.Path, s.Flags)
+    if err != nil {
+	return nil, err
+    }
+    config.applyDefaults()
+    err = config.validate(s.Path)
+    if err != nil {
+	return nil, err
+    }
+    return config, nil
+}
+
+// loadConfig loads the config at path with environment overrides.
+func loadConfig(path string) (*Config, error) {
+    return ConfigSource{Path: path}.Load()
+}
+
+// setting is a [Server] or [websocket] value that the environment and
+// flags can override. Server settings are MACRON_<KEY> and --<key>;
+// websocket ones are MACRON_WEBSOCKET_<KEY> and --websocket-<key>.
+type setting struct {
+    key     string
+    env     string
+    flag    string
+    index   []int
+    kind    reflect.Kind
+}
+
+var settings = configSettings()
+
+func configSettings() []setting {
+    sections := []struct {
+	field   string
+	table   string
+    }{{"Server", "server"}, {"WebSocket", "websocket"}}
+    list := make([]setting, 0)
+    for _, section := range sections {
+	parent, _ := reflect.TypeOf(Config{}).FieldByName(section.field)
+	for i := 0; i < parent.Type.NumField(); i++ {
+	    field := parent.Type.Field(i)
+	    tag := strings.Split(field.Tag.Get("toml"), ",")[0]
+	    name := tag
+	    if section.table != "server" {
+		name = section.table + "_" + tag
+	    }
+	    list = append(list, setting{
+		key: section.table + "." + tag,
+		env: "MACRON_" + strings.ToUpper(name),
+		flag: strings.ReplaceAll(name, "_", "-"),
+		index: append(append([]int{}, parent.Index...), field.Index...),
+		kind: field.Type.Kind(),
+	    })
+	}
+    }
+    return list
+}
+
+// lookup returns the override for s, if any, and where it came from. PORT
+// and MACRON_LOG are still read for older deployments.
+func (s setting) lookup(flags map[string]string) (string, string) {
+    if value := flags[s.key]; value != "" {
+	return "--" + s.flag, value
+    }
+    if value := os.Getenv(s.env); value != "" {
+	return s.env, value
+    }
+    switch s.key {
+    case "server.listen":
+	if port := os.Getenv("PORT"); port != "" {
+	    return "PORT", ":" + port
+	}
+    case "server.log_file":
+	if value := os.Getenv("MACRON_LOG"); value != "" {
+	    return "MACRON_LOG", value
+	}
+    }
+    return "", ""
+}
+
+// parse converts value to the setting's type. Lists are comma-separated.
+func (s setting) parse(value string) (reflect.Value, error) {
+    switch s.kind {
+    case reflect.Bool:
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+	    return reflect.Value{}, fmt.Errorf("%q is not true or false", value)
+	}
+	return reflect.ValueOf(b), nil
+    case reflect.Int, reflect.Int64:
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+	    return reflect.Value{}, fmt.Errorf("%q is not a whole number", value)
+	}
+	return reflect.ValueOf(n), nil
+    case reflect.Slice:
+	list := strings.Split(value, ",")
+	for i := range list {
+	    list[i] = strings.TrimSpace(list[i])
+	}
+	return reflect.ValueOf(list), nil
+    }
+    return reflect.ValueOf(value), nil
+}
+
+func (s setting) set(c *Config, value string) error {
+    v, err := s.parse(value)
+    if err != nil {
+	return err
+    }
+    field := reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+    field.Set(v.Convert(field.Type()))
+    return nil
+}
+
+func (c *Config) applyOverrides(path string, flags map[string]string) error {
+    problems := make([]string, 0)
+    for _, s := range settings {
+	source, value := s.lookup(flags)
+	if value == "" {
+	    continue
+	}
+	err := s.set(c, value)
+	if err != nil {
+	    problems = append(problems, fmt.Sprintf("%s: %v", source, err))
+	}
+    }
+    if len(problems) > 0 {
+	return &ConfigError{Path: path, Problems: problems}
+    }
+    return nil
+}
+
+// settingFlag sets an override from the command line.
+type settingFlag struct {
+    flags   map[string]string
+    setting setting
+}
+
+func (f settingFlag) String() string {
+    return ""
+}
+
+func (f settingFlag) Set(value string) error {
+    _, err := f.setting.parse(value)
+    if err != nil {
+	return err
+    }
+    f.flags[f.setting.key] = value
+    return nil
+}
+
+func (f settingFlag) IsBoolFlag() bool {
+    return f.setting.kind == reflect.Bool
+}
+
+// registerSettings adds a flag for every setting to fs, storing values in
+// flags.
+func registerSettings(fs *flag.FlagSet, flags map[string]string) {
+    for _, s := range settings {
+	fs.Var(settingFlag{flags: flags, setting: s}, s.flag, fmt.Sprintf("%s (env %s)", s.key, s.env))
+    }
+}
+
+const redacted = "<redacted>"
+
+// redactSecrets returns a copy of c with passwords and secrets hidden.
+func (c Config) redactSecrets() Config {
+    if c.Server.Password != "" {
+	c.Server.Password = redacted
+    }
+    if c.Server.MetricsToken != "" {
+	c.Server.MetricsToken = redacted
+    }
+    c.Hooks = append([]HookConfig(nil), c.Hooks...)
+    for i := range c.Hooks {
+	if c.Hooks[i].Secret != "" {
+	    c.Hooks[i].Secret = redacted
+	}
+    }
+    c.Webhooks = append([]WebhookConfig(nil), c.Webhooks...)
+    for i := range c.Webhooks {
+	if c.Webhooks[i].Secret != "" {
+	    c.Webhooks[i].Secret = redacted
+	}
+    }
+    return c
+}
+
+func (c *Config) applyDefaults() {
+    if c.Server.AuthType == "" {
+	c.Server.AuthType = AuthSession
+    }
+    if c.Server.DataDir == "" {
+	c.Server.DataDir = filepath.Join(os.Getenv("HOME"), "/.local/share/macron-server")
+    }
+    if c.Server.ControlSocket == "" {
+	c.Server.ControlSocket = filepath.Join(c.Server.DataDir, "control.sock")
+    }
+    if c.Server.ShutdownTimeout == "" {
+	c.Server.ShutdownTimeout = defaultShutdownTimeout.String()
+    }
+    if c.WebSocket.ReadBufferSize == 0 {
+	c.WebSocket.ReadBufferSize = defaultReadBufferSize
+    }
+    if c.WebSocket.WriteBufferSize == 0 {
+	c.WebSocket.WriteBufferSize = defaultWriteBufferSize
+    }
+    if c.WebSocket.MaxClientMessage == 0 {
+	c.WebSocket.MaxClientMessage = defaultMaxClientMessage
+    }
+    if c.WebSocket.MaxReceiverMessage == 0 {
+	c.WebSocket.MaxReceiverMessage = defaultMaxReceiverMessage
+    }
+}
+
+// validate checks every setting and reports all problems at once.
+func (c *Config) validate(path string) error {
+    problems := make([]string, 0)
+    add := func(format string, args ...interface{}) {
+	problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    switch c.Server.AuthType {
+    case AuthPassword, AuthSession, AuthFull:
+    default:
+	add("server.auth_type: unknown value %q, expected %q, %q or %q", c.Server.AuthType, AuthPassword, AuthSession, AuthFull)
+    }
+    if c.Server.Password == "" {
+	add("server.password: required")
+    }
+    if c.Server.AuthType == AuthFull && c.Server.Email == "" {
+	add("server.email: required when auth_type is %q", AuthFull)
+    }
+    for _, origin := range c.Server.AllowedOrigins {
+	if origin == "*" {
+	    continue
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+	    add("server.allowed_origins: %q is not an origin like https://example.com", origin)
+	}
+    }
+    checkDuration := func(key string, value string, max time.Duration) {
+	if value == "" {
+	    return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+	    add("%s: %q is not a positive duration like \"30s\"", key, value)
+	} else if max > 0 && d > max {
+	    add("%s: %s is longer than the %s maximum", key, value, max)
+	}
+    }
+    if c.Server.Listen != "" {
+	if _, _, err := net.SplitHostPort(c.Server.Listen); err != nil {
+	    add("server.listen: %q is not an address like :8080 or 127.0.0.1:8080", c.Server.Listen)
+	}
+    }
+    if _, err := parseLogLevel(c.Server.LogLevel); err != nil {
+	add("server.log_level: %v", err)
+    }
+    switch c.Server.LogFormat {
+    case "", "text", "json":
+    default:
+	add("server.log_format: unknown value %q, expected \"text\" or \"json\"", c.Server.LogFormat)
+    }
+    if c.Server.LogMaxSize < 0 {
+	add("server.log_max_size: must not be negative")
+    }
+    if c.Server.LogMaxBackups < 0 {
+	add("server.log_max_backups: must not be negative")
+    }
+    checkDuration("server.log_max_age", c.Server.LogMaxAge, 0)
+    for _, entry := range c.Server.TrustedProxies {
+	if _, err := parseTrustedProxy(entry); err != nil {
+	    add("server.trusted_proxies: %q is not an address or CIDR range like 10.0.0.0/8", entry)
+	}
+    }
+    if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+	add("server.tls_cert and server.tls_key: set both or neither")
+    }
+    checkDuration("server.shutdown_timeout", c.Server.ShutdownTimeout, 0)
+    checkDuration("server.restart_hint", c.Server.RestartHint, 0)
+
+    if c.WebSocket.CompressionLevel < flate.HuffmanOnly || c.WebSocket.CompressionLevel > flate.BestCompression {
+	add("websocket.compression_level: %d is outside %d to %d", c.WebSocket.CompressionLevel, flate.HuffmanOnly, flate.BestCompression)
+    }
+    if c.WebSocket.ReadBufferSize < 0 {
+	add("websocket.read_buffer_size: must not be negative")
+    }
+    if c.WebSocket.WriteBufferSize < 0 {
+	add("websocket.write_buffer_size: must not be negative")
+    }
+    if c.WebSocket.MaxClientMessage < 0 {
+	add("websocket.max_client_message: must not be negative")
+    }
+    if c.WebSocket.MaxReceiverMessage < 0 {
+	add("websocket.max_receiver_message: must not be negative")
+    }
+
+    hookIds := make(map[string]bool)
+    for i, hook := range c.Hooks {
+	key := fmt.Sprintf("hooks[%d]", i)
+	if hook.Id == "" {
+	    add("%s.id: required", key)
+	} else if hookIds[hook.Id] {
+	    add("%s.id: duplicate id %q", key, hook.Id)
+	}
+	hookIds[hook.Id] = true
+	if hook.Receiver == "" {
+	    add("%s.receiver: required", key)
+	}
+	if hook.Function == "" {
+	    add("%s.function: required", key)
+	}
+	if hook.Secret == "" {
+	    add("%s.secret: required", key)
+	}
+	switch hook.Auth {
+	case "", "secret", "hmac":
+	default:
+	    add("%s.auth: unknown value %q, expected \"secret\" or \"hmac\"", key, hook.Auth)
+	}
+	checkDuration(key + ".wait", hook.Wait, maxHookWait)
+    }
+
+    for i, wh := range c.Webhooks {
+	key := fmt.Sprintf("webhooks[%d]", i)
+	u, err := url.Parse(wh.Url)
+	if wh.Url == "" {
+	    add("%s.url: required", key)
+	} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+	    add("%s.url: %q is not an http or https URL", key, wh.Url)
+	}
+	for _, event := range wh.Events {
+	    if !knownEvent(event) {
+		add("%s.events: unknown event type %q", key, event)
+	    }
+	}
+	if wh.MaxAttempts < 0 {
+	    add("%s.max_attempts: must not be negative", key)
+	}
+	checkDuration(key + ".backoff", wh.Backoff, 0)
+    }
+
+    if len(problems) > 0 {
+	return &ConfigError{Path: path, Problems: problems}
+    }
+    return nil
+}
+
+func knownEvent(eventType string) bool {
+    switch eventType {
+    case EventReceiverOnline, EventReceiverOffline, EventExecStarted, EventExecFinished,
+	EventExecFailed, EventLoginFailed, EventCatalogChanged:
+	return true
+    }
+    return false
+}
+
+// checkConfig implements `macron-server check-config [path]`. It returns
+// the process exit code.
+func checkConfig(args []string, stdout io.Writer, stderr io.Writer) int {
+    fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+    flagConfig := fs.String("config", "", "config file (env MACRON_CONFIG)")
+    if !parseFlags(fs, args, stderr) {
+	return 2
+    }
+    path := configPath(firstSet(fs.Arg(0), *flagConfig))
+    _, err := loadConfig(path)
+    if err != nil {
+	printConfigError(stderr, path, err)
+	return 1
+    }
+    fmt.Fprintf(stdout, "%s is valid.\n", path)
+    return 0
+}
+
+// printConfigError prints each problem in a config on its own line.
+func printConfigError(w io.Writer, path string, err error) {
+    var configErr *ConfigError
+    if !errors.As(err, &configErr) {
+	fmt.Fprintln(w, err)
+	return
+    }
+    fmt.Fprintf(w, "%s is invalid:\n", path)
+    for _, problem := range configErr.Problems {
+	fmt.Fprintf(w, "  %s\n", problem)
+    }
+}
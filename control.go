@@ -0,0 +1,181 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "syscall"
+)
+
+// ControlServer serves JSON-RPC on a Unix socket for `macron-server ctl`,
+// one request per line. It offers the /v3/rpc methods plus admin methods
+// that have no HTTP equivalent. There is no other authentication: the
+// socket is only accessible to the server's user.
+type ControlServer struct {
+    hub         *Hub
+    path        string
+    source      ConfigSource
+    listener    net.Listener
+    conns       map[net.Conn]bool
+    mu          sync.Mutex
+    wg          sync.WaitGroup
+}
+
+// ListenControl creates the control socket at path, replacing a stale
+// socket left behind by a server that did not shut down cleanly.
+func ListenControl(hub *Hub, path string, source ConfigSource) (*ControlServer, error) {
+    err := os.MkdirAll(filepath.Dir(path), 0700)
+    if err != nil {
+	return nil, err
+    }
+    if conn, err := net.Dial("unix", path); err == nil {
+	conn.Close()
+	return nil, fmt.Errorf("Control socket %s is in use by another server.", path)
+    }
+    os.Remove(path)
+    // Create the socket owner-only. Narrowing it with chmod afterwards
+    // would leave a window in which any local user could connect.
+    mask := syscall.Umask(0077)
+    listener, err := net.Listen("unix", path)
+    syscall.Umask(mask)
+    if err != nil {
+	return nil, err
+    }
+    err = os.Chmod(path, 0600)
+    if err != nil {
+	listener.Close()
+	return nil, err
+    }
+    return &ControlServer{
+	hub: hub,
+	path: path,
+	source: source,
+	listener: listener,
+	conns: make(map[net.Conn]bool),
+    }, nil
+}
+
+func (s *ControlServer) Serve() {
+    for {
+	conn, err := s.listener.Accept()
+	if err != nil {
+	    if !errors.Is(err, net.ErrClosed) {
+		slog.Error("Control socket failed", "error", err)
+	    }
+	    return
+	}
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go s.serveConn(conn)
+    }
+}
+
+// Close stops accepting, drops open connections and removes the socket.
+func (s *ControlServer) Close() error {
+    err := s.listener.Close()
+    s.mu.Lock()
+    for conn := range s.conns {
+	conn.Close()
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+    os.Remove(s.path)
+    return err
+}
+
+func (s *ControlServer) serveConn(conn net.Conn) {
+    defer func() {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+	s.wg.Done()
+    }()
+    done := make(chan struct{})
+    defer close(done)
+    session := &rpcSession{hub: s.hub, done: done, control: s}
+    reader := bufio.NewReader(conn)
+    for {
+	line, err := reader.ReadBytes('\n')
+	if len(line) > 0 {
+	    response := session.handle(line)
+	    if response != nil {
+		conn.Write(append(response, '\n'))
+	    }
+	}
+	if err != nil {
+	    return
+	}
+    }
+}
+
+type controlSessionParams struct {
+    Id      string  `json:"id,omitempty"`
+    All     bool    `json:"all,omitempty"`
+}
+
+// ReloadResult reports a config reload over the control socket.
+type ReloadResult struct {
+    RestartRequired []string    `json:"restart_required"`
+}
+
+// call serves the admin methods.
+func (s *ControlServer) call(method string, raw json.RawMessage) (interface{}, *rpcError) {
+    switch method {
+    case "receivers.info":
+	return s.hub.ReceiverInfos(), nil
+    case "receivers.kick":
+	var params struct {
+	    ReceiverName    string  `json:"receiver_name"`
+	}
+	if err := decodeParams(raw, &params); err != nil {
+	    return nil, err
+	}
+	if params.ReceiverName == "" {
+	    return nil, invalidParams("receiver_name is required")
+	}
+	err := s.hub.KickReceiver(params.ReceiverName)
+	if err != nil {
+	    return nil, hubError(err)
+	}
+	return params.ReceiverName, nil
+    case "clients.list":
+	return s.hub.ClientInfos(), nil
+    case "sessions.list":
+	return s.hub.ListSessions(), nil
+    case "sessions.revoke":
+	var params controlSessionParams
+	if err := decodeParams(raw, &params); err != nil {
+	    return nil, err
+	}
+	if params.All {
+	    return s.hub.RevokeSessions(), nil
+	}
+	if params.Id == "" {
+	    return nil, invalidParams("id or all is required")
+	}
+	if !s.hub.RevokeSession(params.Id) {
+	    return nil, &rpcError{Code: rpcServerError, Message: "No session with id: " + params.Id}
+	}
+	return 1, nil
+    case "config.reload":
+	pending, err := s.hub.ReloadConfig(s.source)
+	if err != nil {
+	    return nil, &rpcError{Code: rpcServerError, Message: err.Error()}
+	}
+	slog.Info("Config reloaded", "trigger", "control socket")
+	if len(pending) > 0 {
+	    slog.Warn("Restart required to apply settings", "settings", pending)
+	}
+	return ReloadResult{RestartRequired: pending}, nil
+    }
+    return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+}
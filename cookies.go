@@ -0,0 +1,176 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "mime"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// The dashboard keeps its session in a cookie rather than in URLs, where
+// tokens end up in logs and browser history. Forms and unsafe requests
+// made with the cookie must echo the CSRF cookie's value back, which a page
+// on another site cannot read.
+const (
+    sessionCookie   = "macron_session"
+    csrfCookie      = "macron_csrf"
+    csrfHeader      = "X-CSRF-Token"
+    csrfField       = "csrf_token"
+)
+
+type peerAddrKey struct{}
+
+// keepPeerAddr records the address the connection came from before RealIP
+// replaces RemoteAddr with one taken from request headers.
+func keepPeerAddr(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)
+	next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+func peerAddr(r *http.Request) string {
+    if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+	return addr
+    }
+    return r.RemoteAddr
+}
+
+// parseTrustedProxy reads a server.trusted_proxies entry, an IP address or
+// a CIDR range.
+func parseTrustedProxy(entry string) (*net.IPNet, error) {
+    if !strings.Contains(entry, "/") {
+	ip := net.ParseIP(entry)
+	if ip == nil {
+	    return nil, &net.ParseError{Type: "IP address", Text: entry}
+	}
+	bits := 8 * len(ip.To4())
+	if bits == 0 {
+	    bits = 8 * net.IPv6len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+    }
+    _, network, err := net.ParseCIDR(entry)
+    return network, err
+}
+
+// fromTrustedProxy reports whether the connection came from one of
+// server.trusted_proxies, whose forwarding headers can be believed.
+func (hub *Hub) fromTrustedProxy(r *http.Request) bool {
+    host, _, err := net.SplitHostPort(peerAddr(r))
+    if err != nil {
+	host = peerAddr(r)
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+	return false
+    }
+    for _, entry := range hub.config().Server.TrustedProxies {
+	network, err := parseTrustedProxy(entry)
+	if err == nil && network.Contains(ip) {
+	    return true
+	}
+    }
+    return false
+}
+
+// secureCookies reports whether cookies should be marked Secure. They
+// always are unless server.insecure_cookies allows plain HTTP, in which case
+// they still are for requests that arrived over HTTPS, directly or through
+// a trusted proxy.
+func (hub *Hub) secureCookies(r *http.Request) bool {
+    if !hub.config().Server.InsecureCookies || r.TLS != nil {
+	return true
+    }
+    return hub.fromTrustedProxy(r) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func (hub *Hub) setSessionCookie(w http.ResponseWriter, r *http.Request, token string) {
+    http.SetCookie(w, &http.Cookie{
+	Name: sessionCookie,
+	Value: token,
+	Path: "/",
+	MaxAge: int(browserSessionIdle / time.Second),
+	HttpOnly: true,
+	Secure: hub.secureCookies(r),
+	SameSite: http.SameSiteLaxMode,
+    })
+}
+
+func (hub *Hub) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+    http.SetCookie(w, &http.Cookie{
+	Name: sessionCookie,
+	Path: "/",
+	MaxAge: -1,
+	HttpOnly: true,
+	Secure: hub.secureCookies(r),
+	SameSite: http.SameSiteLaxMode,
+    })
+}
+
+// csrfToken returns the request's CSRF token, issuing a new cookie when it
+// has none.
+func (hub *Hub) csrfToken(w http.ResponseWriter, r *http.Request) string {
+    if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+	return cookie.Value
+    }
+    buf := make([]byte, 32)
+    rand.Read(buf)
+    token := hex.EncodeToString(buf)
+    http.SetCookie(w, &http.Cookie{
+	Name: csrfCookie,
+	Value: token,
+	Path: "/",
+	HttpOnly: true,
+	Secure: hub.secureCookies(r),
+	SameSite: http.SameSiteStrictMode,
+    })
+    return token
+}
+
+// checkCSRF reports whether the request carries the CSRF cookie's value in
+// the X-CSRF-Token header or the csrf_token form field.
+func checkCSRF(r *http.Request) bool {
+    cookie, err := r.Cookie(csrfCookie)
+    if err != nil || cookie.Value == "" {
+	return false
+    }
+    sent := r.Header.Get(csrfHeader)
+    if sent == "" {
+	sent = r.PostFormValue(csrfField)
+    }
+    return subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) == 1
+}
+
+func safeMethod(method string) bool {
+    return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func isFormPost(r *http.Request) bool {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+// LogoutHandler ends the caller's session. Browsers are sent back to the
+// dashboard; API clients get 204.
+func (hub *Hub) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+    token, fromCookie := requestSession(r)
+    if fromCookie && !checkCSRF(r) {
+	http.Error(w, "Invalid CSRF token.", http.StatusForbidden)
+	return
+    }
+    if token != "" {
+	hub.RevokeSession(sessionId(token))
+    }
+    hub.clearSessionCookie(w, r)
+    if isFormPost(r) {
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+const (
+    corsAllowMethods    = "GET, POST, PUT, DELETE, OPTIONS"
+    corsAllowHeaders    = "Authorization, Content-Type, Last-Event-ID"
+    corsMaxAge          = "600"
+)
+
+// originAllowed reports whether a browser on origin may use the server.
+// Requests without an Origin header come from non-browser clients and are
+// always allowed, as are same-origin requests. Anything else must be listed
+// in allowed_origins, where "*" allows every origin.
+func (hub *Hub) originAllowed(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+	return true
+    }
+    u, err := url.Parse(origin)
+    if err == nil && strings.EqualFold(u.Host, r.Host) {
+	return true
+    }
+    for _, allowed := range hub.config().Server.AllowedOrigins {
+	if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+	    return true
+	}
+    }
+    return false
+}
+
+// CORS answers preflight requests and adds CORS headers for allowed
+// cross-origin requests. Responses to other origins carry no CORS headers,
+// so browsers will not let their pages read them.
+func (hub *Hub) CORS(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+	    next.ServeHTTP(w, r)
+	    return
+	}
+	w.Header().Add("Vary", "Origin")
+	allowed := hub.originAllowed(r)
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if !allowed {
+	    if preflight {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	    }
+	    next.ServeHTTP(w, r)
+	    return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if preflight {
+	    w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+	    w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	    w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	    w.WriteHeader(http.StatusNoContent)
+	    return
+	}
+	next.ServeHTTP(w, r)
+    })
+}
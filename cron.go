@@ -0,0 +1,139 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CronExpr is a parsed five field cron expression:
+// minute hour day-of-month month day-of-week.
+type CronExpr struct {
+    minute      uint64
+    hour        uint64
+    dom         uint64
+    month       uint64
+    dow         uint64
+    domStar     bool
+    dowStar     bool
+}
+
+var cronShortcuts = map[string]string{
+    "@yearly":  "0 0 1 1 *",
+    "@monthly": "0 0 1 * *",
+    "@weekly":  "0 0 * * 0",
+    "@daily":   "0 0 * * *",
+    "@hourly":  "0 * * * *",
+}
+
+func ParseCron(expr string) (*CronExpr, error) {
+    if shortcut, ok := cronShortcuts[strings.TrimSpace(expr)]; ok {
+	expr = shortcut
+    }
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+	return nil, fmt.Errorf("Cron expression must have 5 fields: %s", expr)
+    }
+
+    var c CronExpr
+    var err error
+    if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+	return nil, err
+    }
+    if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+	return nil, err
+    }
+    if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+	return nil, err
+    }
+    if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+	return nil, err
+    }
+    if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+	return nil, err
+    }
+    // Both 0 and 7 mean Sunday.
+    if c.dow&(1<<7) != 0 {
+	c.dow |= 1
+    }
+    c.domStar = fields[2] == "*"
+    c.dowStar = fields[4] == "*"
+    return &c, nil
+}
+
+// parseCronField turns a comma separated list of values, ranges and steps
+// into a bitset.
+func parseCronField(field string, min int, max int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+	step := 1
+	if rng, s, found := strings.Cut(part, "/"); found {
+	    n, err := strconv.Atoi(s)
+	    if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid cron step: %s", part)
+	    }
+	    step = n
+	    part = rng
+	}
+
+	lo, hi := min, max
+	if part != "*" {
+	    from, to, isRange := strings.Cut(part, "-")
+	    n, err := strconv.Atoi(from)
+	    if err != nil {
+		return 0, fmt.Errorf("Invalid cron value: %s", part)
+	    }
+	    lo, hi = n, n
+	    if isRange {
+		if hi, err = strconv.Atoi(to); err != nil {
+		    return 0, fmt.Errorf("Invalid cron value: %s", part)
+		}
+	    } else if step > 1 {
+		hi = max
+	    }
+	}
+	if lo < min || hi > max || lo > hi {
+	    return 0, fmt.Errorf("Cron value out of range: %s", part)
+	}
+	for i := lo; i <= hi; i += step {
+	    bits |= 1 << uint(i)
+	}
+    }
+    return bits, nil
+}
+
+func (c *CronExpr) dayMatches(t time.Time) bool {
+    dom := c.dom&(1<<uint(t.Day())) != 0
+    dow := c.dow&(1<<uint(t.Weekday())) != 0
+    if c.domStar || c.dowStar {
+	return dom && dow
+    }
+    return dom || dow
+}
+
+// Next returns the first time strictly after t that matches the expression.
+func (c *CronExpr) Next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+	if c.month&(1<<uint(t.Month())) == 0 {
+	    t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+	    continue
+	}
+	if !c.dayMatches(t) {
+	    t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	    continue
+	}
+	if c.hour&(1<<uint(t.Hour())) == 0 {
+	    t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	    continue
+	}
+	if c.minute&(1<<uint(t.Minute())) == 0 {
+	    t = t.Add(time.Minute)
+	    continue
+	}
+	return t
+    }
+    return time.Time{}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+const ctlUsage = `Usage: macron-server ctl [--socket path] [--config path] <command>
+
+Commands:
+  receivers ls                    List connected receivers
+  receivers kick <name>           Disconnect a receiver
+  clients ls                      List connected clients
+  sessions ls                     List sessions
+  sessions revoke <id> | --all    End a session, or all of them
+  exec <receiver> <function>      Run a function by key or id and wait
+                                  for it (--args json, --wait 30s)
+  reload                          Reload the config file
+`
+
+// ctlClient sends JSON-RPC requests over the control socket.
+type ctlClient struct {
+    conn    net.Conn
+    reader  *bufio.Reader
+    nextId  int
+}
+
+func dialControl(path string) (*ctlClient, error) {
+    conn, err := net.DialTimeout("unix", path, remoteTimeout)
+    if err != nil {
+	return nil, fmt.Errorf("Could not connect to %s; is the server running? %w", path, err)
+    }
+    return &ctlClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// call runs method and decodes its result into result, which may be nil.
+func (c *ctlClient) call(method string, params interface{}, result interface{}) error {
+    c.nextId++
+    raw, err := json.Marshal(params)
+    if err != nil {
+	return err
+    }
+    request, _ := json.Marshal(rpcRequest{JSONRPC: "2.0", Method: method, Params: raw, Id: json.RawMessage(strconv.Itoa(c.nextId))})
+    _, err = c.conn.Write(append(request, '\n'))
+    if err != nil {
+	return err
+    }
+    line, err := c.reader.ReadBytes('\n')
+    if err != nil {
+	return err
+    }
+    var response struct {
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+    }
+    err = json.Unmarshal(line, &response)
+    if err != nil {
+	return err
+    }
+    if response.Error != nil {
+	return response.Error
+    }
+    if result == nil {
+	return nil
+    }
+    return json.Unmarshal(response.Result, result)
+}
+
+func (e *rpcError) Error() string {
+    return e.Message
+}
+
+func runCtl(args []string, stdout io.Writer, stderr io.Writer) int {
+    fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+    flagSocket := fs.String("socket", "", "control socket (env MACRON_CONTROL_SOCKET)")
+    flagConfig := fs.String("config", "", "config file, used to find the socket (env MACRON_CONFIG)")
+    fs.Usage = func() {
+	fmt.Fprint(stderr, ctlUsage)
+    }
+    if !parseFlags(fs, args, stderr) {
+	return 2
+    }
+    args = fs.Args()
+    if len(args) == 0 {
+	fmt.Fprint(stderr, ctlUsage)
+	return 2
+    }
+
+    path := firstSet(*flagSocket, os.Getenv("MACRON_CONTROL_SOCKET"))
+    if path == "" {
+	config, err := loadConfig(configPath(*flagConfig))
+	if err != nil {
+	    fmt.Fprintln(stderr, err)
+	    return 1
+	}
+	path = config.Server.ControlSocket
+    }
+    client, err := dialControl(path)
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return 1
+    }
+    defer client.conn.Close()
+
+    err = ctlCommand(client, args, stdout, stderr)
+    var usageErr *ctlUsageError
+    if errors.As(err, &usageErr) {
+	fmt.Fprintf(stderr, "%s\n\n%s", usageErr.msg, ctlUsage)
+	return 2
+    }
+    if err != nil {
+	fmt.Fprintln(stderr, err)
+	return 1
+    }
+    return 0
+}
+
+type ctlUsageError struct {
+    msg string
+}
+
+func (e *ctlUsageError) Error() string {
+    return e.msg
+}
+
+func ctlCommand(client *ctlClient, args []string, stdout io.Writer, stderr io.Writer) error {
+    command := args[0]
+    if len(args) > 1 {
+	command += " " + args[1]
+    }
+    switch {
+    case command == "receivers ls":
+	var receivers []ReceiverInfo
+	err := client.call("receivers.info", nil, &receivers)
+	if err != nil {
+	    return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tGROUP\tTAGS\tFUNCTIONS\tPROTOCOL\tADDRESS")
+	for _, r := range receivers {
+	    fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Name, r.Group, strings.Join(r.Tags, ","), r.Functions, protocolName(r.Version), r.RemoteAddr)
+	}
+	return tw.Flush()
+    case command == "receivers kick":
+	if len(args) != 3 {
+	    return &ctlUsageError{"receivers kick takes a receiver name"}
+	}
+	err := client.call("receivers.kick", map[string]string{"receiver_name": args[2]}, nil)
+	if err != nil {
+	    return err
+	}
+	fmt.Fprintf(stdout, "Kicked %s.\n", args[2])
+	return nil
+    case command == "clients ls":
+	var clients []ClientInfo
+	err := client.call("clients.list", nil, &clients)
+	if err != nil {
+	    return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPROTOCOL\tADDRESS")
+	for _, c := range clients {
+	    fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Id, protocolName(c.Version), c.RemoteAddr)
+	}
+	return tw.Flush()
+    case command == "sessions ls":
+	var sessions []SessionInfo
+	err := client.call("sessions.list", nil, &sessions)
+	if err != nil {
+	    return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEXPIRES")
+	for _, session := range sessions {
+	    fmt.Fprintf(tw, "%s\t%s\n", session.Id, session.ExpiresAt.Local().Format(time.RFC3339))
+	}
+	return tw.Flush()
+    case command == "sessions revoke":
+	if len(args) != 3 {
+	    return &ctlUsageError{"sessions revoke takes a session id or --all"}
+	}
+	params := controlSessionParams{Id: args[2]}
+	if args[2] == "--all" {
+	    params = controlSessionParams{All: true}
+	}
+	var revoked int
+	err := client.call("sessions.revoke", params, &revoked)
+	if err != nil {
+	    return err
+	}
+	fmt.Fprintf(stdout, "Revoked %d session(s).\n", revoked)
+	return nil
+    case args[0] == "exec":
+	return ctlExec(client, args[1:], stdout, stderr)
+    case command == "reload":
+	var result ReloadResult
+	err := client.call("config.reload", nil, &result)
+	if err != nil {
+	    return err
+	}
+	fmt.Fprintln(stdout, "Config reloaded.")
+	if len(result.RestartRequired) > 0 {
+	    fmt.Fprintf(stdout, "Restart required to apply: %s\n", strings.Join(result.RestartRequired, ", "))
+	}
+	return nil
+    }
+    return &ctlUsageError{"Unknown command: " + strings.Join(args, " ")}
+}
+
+// ctlExec runs a function and waits for its result. Like the REST exec
+// endpoint, the function is looked up by key, then by numeric id.
+func ctlExec(client *ctlClient, args []string, stdout io.Writer, stderr io.Writer) error {
+    fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+    flagArgs := fs.String("args", "", "function arguments as a JSON object")
+    flagWait := fs.Duration("wait", 30 * time.Second, "how long to wait for the result")
+    if !parseFlags(fs, args, stderr) {
+	return &ctlUsageError{"Invalid exec flags."}
+    }
+    if fs.NArg() != 2 {
+	return &ctlUsageError{"exec takes a receiver and a function"}
+    }
+    receiver, function := fs.Arg(0), fs.Arg(1)
+    params := rpcExecParams{ReceiverName: receiver, FunctionKey: function, Wait: flagWait.String()}
+    if *flagArgs != "" {
+	err := json.Unmarshal([]byte(*flagArgs), &params.Args)
+	if err != nil {
+	    return fmt.Errorf("Invalid --args: %v", err)
+	}
+    }
+
+    var result ExecResult
+    err := client.call("functions.exec", params, &result)
+    var rpcErr *rpcError
+    if errors.As(err, &rpcErr) && rpcErr.Code == rpcStaleFunction {
+	if id, convErr := strconv.Atoi(function); convErr == nil {
+	    params.FunctionKey = ""
+	    params.FunctionId = &id
+	    err = client.call("functions.exec", params, &result)
+	}
+    }
+    if err != nil {
+	return err
+    }
+    fmt.Fprintf(stdout, "%s: %s\n", result.ExecId, result.Status)
+    if result.Output != "" {
+	fmt.Fprintln(stdout, result.Output)
+    }
+    if result.Status != "success" {
+	if result.Error != "" {
+	    return errors.New(result.Error)
+	}
+	return fmt.Errorf("Exec finished with status %s.", result.Status)
+    }
+    return nil
+}
+
+func protocolName(version int) string {
+    if version == 0 {
+	return "v1/v2"
+    }
+    return fmt.Sprintf("v%d", version)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "log/slog"
+    "sync"
+    "time"
+)
+
+// Event types published on the hub's event bus.
+const (
+    EventReceiverOnline     = "receiver.online"
+    EventReceiverOffline    = "receiver.offline"
+    EventExecStarted        = "exec.started"
+    EventExecFinished       = "exec.finished"
+    EventExecFailed         = "exec.failed"
+    EventLoginFailed        = "login.failed"
+    EventCatalogChanged     = "catalog.changed"
+)
+
+const (
+    subscriberBuffer    = 64
+    eventHistorySize    = 1024
+)
+
+type Event struct {
+    Id      uint64                  `json:"id"`
+    Type    string                  `json:"type"`
+    Time    time.Time               `json:"time"`
+    Data    map[string]interface{}  `json:"data,omitempty"`
+}
+
+// EventBus fans events out to subscribers and keeps a bounded history so
+// that reconnecting consumers can resume from the last id they saw.
+type EventBus struct {
+    nextId      uint64
+    history     []Event
+    subscribers map[chan Event]struct{}
+    mu          sync.Mutex
+}
+
+func NewEventBus() *EventBus {
+    return &EventBus{
+	subscribers: make(map[chan Event]struct{}),
+    }
+}
+
+// Publish delivers the event to every subscriber without blocking. A
+// subscriber that has fallen behind is closed rather than silently missing
+// events; it can subscribe again from the last id it saw and replay the rest
+// from the history.
+func (bus *EventBus) Publish(eventType string, data map[string]interface{}) Event {
+    bus.mu.Lock()
+    defer bus.mu.Unlock()
+    bus.nextId++
+    event := Event{
+	Id: bus.nextId,
+	Type: eventType,
+	Time: time.Now(),
+	Data: data,
+    }
+    bus.history = append(bus.history, event)
+    if len(bus.history) > eventHistorySize {
+	bus.history = bus.history[len(bus.history)-eventHistorySize:]
+    }
+    for ch := range bus.subscribers {
+	select {
+	case ch <- event:
+	default:
+	    slog.Warn("Event subscriber is full, closing it", "event_id", event.Id, "event_type", event.Type)
+	    delete(bus.subscribers, ch)
+	    close(ch)
+	}
+    }
+    return event
+}
+
+// Subscribe returns a channel of future events and a function that
+// unsubscribes and closes it. The channel is also closed if the subscriber
+// falls behind.
+func (bus *EventBus) Subscribe() (<-chan Event, func()) {
+    _, ch, cancel := bus.SubscribeSince(0)
+    return ch, cancel
+}
+
+// SubscribeSince is like Subscribe but also returns the retained events
+// with an id greater than lastId, with no gap between the two.
+func (bus *EventBus) SubscribeSince(lastId uint64) ([]Event, <-chan Event, func()) {
+    return bus.subscribe(lastId, subscriberBuffer)
+}
+
+// subscribe is SubscribeSince with room for size events before the
+// subscriber counts as fallen behind.
+func (bus *EventBus) subscribe(lastId uint64, size int) ([]Event, <-chan Event, func()) {
+    ch := make(chan Event, size)
+    replay := make([]Event, 0)
+    bus.mu.Lock()
+    if lastId > 0 {
+	for _, event := range bus.history {
+	    if event.Id > lastId {
+		replay = append(replay, event)
+	    }
+	}
+    }
+    bus.subscribers[ch] = struct{}{}
+    bus.mu.Unlock()
+
+    return replay, ch, func() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	// Publish may already have closed a subscriber that fell behind.
+	if _, ok := bus.subscribers[ch]; ok {
+	    delete(bus.subscribers, ch)
+	    close(ch)
+	}
+    }
+}
+
+// backlog counts the events waiting in subscriber channels.
+func (bus *EventBus) backlog() int {
+    bus.mu.Lock()
+    defer bus.mu.Unlock()
+    n := 0
+    for ch := range bus.subscribers {
+	n += len(ch)
+    }
+    return n
+}
+
+func (hub *Hub) emit(eventType string, data map[string]interface{}) {
+    hub.events.Publish(eventType, data)
+}
+
+func execEventData(result ExecResult) map[string]interface{} {
+    data := map[string]interface{}{
+	"exec_id": result.ExecId,
+	"receiver_name": result.ReceiverName,
+    }
+    if result.FunctionId != nil {
+	data["function_id"] = *result.FunctionId
+    }
+    if result.FunctionKey != "" {
+	data["function_key"] = result.FunctionKey
+    }
+    if result.Status != "" {
+	data["status"] = result.Status
+    }
+    if result.Error != "" {
+	data["error"] = result.Error
+    }
+    return data
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+const broadcastTimeout = 30 * time.Second
+
+type ExecResult struct {
+    ExecId          string  `json:"exec_id"`
+    ReceiverName    string  `json:"receiver_name"`
+    FunctionId      *int    `json:"function_id,omitempty"`
+    FunctionKey     string  `json:"function_key,omitempty"`
+    Status          string  `json:"status"`
+    Output          string  `json:"output,omitempty"`
+    Error           string  `json:"error,omitempty"`
+}
+
+type pendingExec struct {
+    id              string
+    receiverName    string
+    function        MacronFunction
+    args            map[string]interface{}
+    clientId        string
+    replyTo         string
+    startedAt       time.Time
+    done            chan ExecResult
+}
+
+// startExec registers an in-flight exec and forwards it to the receiver.
+// Results are delivered to the client with clientId, or on the returned
+// channel when clientId is empty.
+func (hub *Hub) startExec(r *Receiver, fn MacronFunction, args map[string]interface{}, clientId string) *pendingExec {
+    return hub.startClientExec(r, fn, args, clientId, "")
+}
+
+// startClientExec is startExec for a v3 client, whose result replies to the
+// request with id replyTo.
+func (hub *Hub) startClientExec(r *Receiver, fn MacronFunction, args map[string]interface{}, clientId string, replyTo string) *pendingExec {
+    execId := uuid.New().String()
+    exec := &pendingExec{
+	id: execId,
+	receiverName: r.name,
+	function: fn,
+	args: args,
+	clientId: clientId,
+	replyTo: replyTo,
+	startedAt: time.Now(),
+	done: make(chan ExecResult, 1),
+    }
+
+    hub.mu.Lock()
+    hub.execs[execId] = exec
+    hub.mu.Unlock()
+
+    hub.emit(EventExecStarted, execEventData(ExecResult{
+	ExecId: execId,
+	ReceiverName: r.name,
+	FunctionId: fn.Id,
+	FunctionKey: fn.Key,
+    }))
+    err := r.execFunction(fn, args, execId)
+    if err != nil {
+	slog.Warn("Could not send exec to receiver", "receiver", r.name, "exec_id", execId, "error", err)
+	hub.CompleteExec(ExecResult{
+	    ExecId: execId,
+	    Status: "error",
+	    Error: "Receiver " + r.name + " is not accepting messages.",
+	})
+    }
+    return exec
+}
+
+// ExecAndWait execs a function by key and blocks until the receiver reports
+// back or timeout elapses.
+func (hub *Hub) ExecAndWait(name string, key string, args map[string]interface{}, timeout time.Duration) (ExecResult, error) {
+    receiver, fn, err := hub.resolveFunction(name, key, "")
+    if err != nil {
+	return ExecResult{}, err
+    }
+    exec := hub.startExec(receiver, fn, args, "")
+    return hub.awaitExec(exec, timeout), nil
+}
+
+func (hub *Hub) awaitExec(exec *pendingExec, timeout time.Duration) ExecResult {
+    select {
+    case result := <-exec.done:
+	return result
+    case <-time.After(timeout):
+	return hub.timeoutExec(exec)
+    }
+}
+
+// CompleteExec delivers a result for a pending exec, returning false if the
+// exec already finished or never existed.
+func (hub *Hub) CompleteExec(result ExecResult) bool {
+    hub.mu.Lock()
+    exec := hub.execs[result.ExecId]
+    delete(hub.execs, result.ExecId)
+    hub.mu.Unlock()
+
+    if exec == nil {
+	slog.Warn("Exec result for unknown exec", "exec_id", result.ExecId)
+	return false
+    }
+    result.ReceiverName = exec.receiverName
+    result.FunctionId = exec.function.Id
+    result.FunctionKey = exec.function.Key
+    if result.Status == "" {
+	if result.Error != "" {
+	    result.Status = "error"
+	} else {
+	    result.Status = "success"
+	}
+    }
+    hub.recordExec(exec, result)
+    if result.Status == "success" {
+	hub.emit(EventExecFinished, execEventData(result))
+    } else {
+	hub.emit(EventExecFailed, execEventData(result))
+    }
+
+    if exec.clientId == "" {
+	exec.done <- result
+	return true
+    }
+    hub.mu.Lock()
+    client := hub.clients[exec.clientId]
+    hub.mu.Unlock()
+    if client != nil {
+	client.sendExecResult(&result, exec.replyTo)
+    }
+    return true
+}
+
+// CancelExec stops waiting on an exec and asks its receiver, if still
+// connected, to abandon it. The exec completes with status "canceled".
+func (hub *Hub) CancelExec(execId string) (ExecResult, error) {
+    hub.mu.Lock()
+    exec := hub.execs[execId]
+    var receiver *Receiver
+    if exec != nil {
+	receiver = hub.receivers[exec.receiverName]
+    }
+    hub.mu.Unlock()
+    if exec == nil {
+	return ExecResult{}, fmt.Errorf("No pending exec with id: %s", execId)
+    }
+
+    result := ExecResult{
+	ExecId: execId,
+	Status: "canceled",
+	Error: "Exec was canceled.",
+    }
+    if !hub.CompleteExec(result) {
+	return ExecResult{}, fmt.Errorf("No pending exec with id: %s", execId)
+    }
+    if receiver != nil {
+	if err := receiver.cancelExec(execId); err != nil {
+	    slog.Warn("Could not send cancel to receiver", "receiver", receiver.name, "exec_id", execId, "error", err)
+	}
+    }
+    result.ReceiverName = exec.receiverName
+    result.FunctionId = exec.function.Id
+    result.FunctionKey = exec.function.Key
+    return result, nil
+}
+
+// failExecs completes every exec still waiting on the named receiver, used
+// when a receiver disconnects mid-exec.
+func (hub *Hub) failExecs(name string) {
+    hub.mu.Lock()
+    ids := make([]string, 0)
+    for id, exec := range hub.execs {
+	if exec.receiverName == name {
+	    ids = append(ids, id)
+	}
+    }
+    hub.mu.Unlock()
+
+    for _, id := range ids {
+	hub.CompleteExec(ExecResult{
+	    ExecId: id,
+	    Status: "offline",
+	    Error: "Receiver disconnected before returning a result.",
+	})
+    }
+}
+
+// timeoutExec stops waiting on an exec whose receiver never answered.
+func (hub *Hub) timeoutExec(exec *pendingExec) ExecResult {
+    hub.mu.Lock()
+    _, pending := hub.execs[exec.id]
+    delete(hub.execs, exec.id)
+    hub.mu.Unlock()
+    if !pending {
+	return <-exec.done
+    }
+
+    result := ExecResult{
+	ExecId: exec.id,
+	ReceiverName: exec.receiverName,
+	FunctionId: exec.function.Id,
+	FunctionKey: exec.function.Key,
+	Status: "timeout",
+	Error: "Receiver did not respond in time.",
+    }
+    hub.recordExec(exec, result)
+    hub.emit(EventExecFailed, execEventData(result))
+    return result
+}
+
+// matchReceivers resolves a selector against the connected receivers.
+// Supported forms are "tag=<tag>", "group=<group>", "name=<name>" and "*".
+func (hub *Hub) matchReceivers(selector string) ([]*Receiver, error) {
+    key, value, found := strings.Cut(selector, "=")
+    if selector != "*" && (!found || value == "") {
+	return nil, fmt.Errorf("Invalid selector: %s", selector)
+    }
+
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    matched := make([]*Receiver, 0)
+    for _, r := range hub.receivers {
+	switch {
+	case selector == "*":
+	    matched = append(matched, r)
+	case key == "tag":
+	    if r.hasTag(value) {
+		matched = append(matched, r)
+	    }
+	case key == "group":
+	    if r.group == value {
+		matched = append(matched, r)
+	    }
+	case key == "name":
+	    if r.name == value {
+		matched = append(matched, r)
+	    }
+	default:
+	    return nil, fmt.Errorf("Unknown selector key: %s", key)
+	}
+    }
+    return matched, nil
+}
+
+// BroadcastExec runs the named function on every receiver matching selector
+// that exposes it and waits for all of them to report back. Receivers that
+// have not sent their catalog yet are asked for it first; those that still
+// cannot say what they offer get an error result rather than being left out.
+func (hub *Hub) BroadcastExec(selector string, functionName string) ([]ExecResult, error) {
+    if functionName == "" {
+	return nil, errors.New("Function Name Empty.")
+    }
+    if hub.isShuttingDown() {
+	return nil, errShuttingDown
+    }
+    receivers, err := hub.matchReceivers(selector)
+    if err != nil {
+	return nil, err
+    }
+    catalogs := make([][]MacronFunction, len(receivers))
+    catalogErrs := make([]error, len(receivers))
+    var wg sync.WaitGroup
+    for i, r := range receivers {
+	wg.Add(1)
+	go func(i int, r *Receiver) {
+	    defer wg.Done()
+	    catalogs[i], catalogErrs[i] = hub.fetchCatalog(r, catalogFetchTimeout)
+	}(i, r)
+    }
+    wg.Wait()
+
+    execs := make([]*pendingExec, 0)
+    unavailable := make([]ExecResult, 0)
+    for i, r := range receivers {
+	if catalogErrs[i] != nil {
+	    unavailable = append(unavailable, ExecResult{ReceiverName: r.name, Status: "error", Error: catalogErrs[i].Error()})
+	    continue
+	}
+	fn, ok := functionNamed(catalogs[i], functionName)
+	if !ok {
+	    continue
+	}
+	execs = append(execs, hub.startExec(r, fn, nil, ""))
+    }
+    slog.Info("Broadcasting exec", "function", functionName, "selector", selector, "receivers", len(execs), "catalog_unavailable", len(unavailable))
+
+    results := make([]ExecResult, len(execs))
+    deadline := time.NewTimer(broadcastTimeout)
+    defer deadline.Stop()
+    expired := false
+    for i, exec := range execs {
+	if !expired {
+	    select {
+	    case result := <-exec.done:
+		results[i] = result
+		continue
+	    case <-deadline.C:
+		expired = true
+	    }
+	}
+	select {
+	case result := <-exec.done:
+	    results[i] = result
+	default:
+	    results[i] = hub.timeoutExec(exec)
+	}
+    }
+    return append(results, unavailable...), nil
+}
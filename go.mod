@@ -1,6 +1,6 @@
 module example.com/macron-server-personal
 
-go 1.20
+go 1.21
 
 require (
 	github.com/go-chi/chi/v5 v5.0.10
@@ -11,4 +11,5 @@ require (
 require (
 	github.com/google/uuid v1.3.1
 	github.com/pelletier/go-toml/v2 v2.1.0
+	github.com/ugorji/go/codec v1.2.12
 )
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+
 	"github.com/google/uuid"
 )
 
@@ -28,53 +32,106 @@ func NewAuthMessage(token string) AuthenticationMessage {
     }
 }
 
+// sessionLifetime is how long an API login is valid for. Browser sessions,
+// from the dashboard's login form, instead last until browserSessionIdle
+// has passed without them being used.
+const (
+    sessionLifetime     = 120 * time.Second
+    browserSessionIdle  = 12 * time.Hour
+)
+
+// LoginHandler creates a session. JSON requests get the token back in the
+// body. Form posts, from the dashboard, must carry a CSRF token and get the
+// session as a cookie and a redirect back to the dashboard instead.
 func (hub *Hub) LoginHandler(w http.ResponseWriter, r *http.Request) {
+    if isFormPost(r) {
+	hub.formLogin(w, r)
+	return
+    }
     var creds Credential
     err := json.NewDecoder(r.Body).Decode(&creds)
     if err != nil {
 	w.WriteHeader(http.StatusBadRequest)
-	log.Println("Auth Failed: Couldn't marshal credentials")
+	requestLogger(r).Warn("Login failed", "reason", "invalid_request", "error", err)
 	return
     }
-    if hub.config.Server.AuthType == "full" {
-	if creds.Email != hub.config.Server.Email {
-	    w.WriteHeader(http.StatusUnauthorized)
-	    log.Println("Incorrect email")
-	    return
+    token, ok := hub.login(r, creds, 0)
+    if !ok {
+	w.WriteHeader(http.StatusUnauthorized)
+	return
+    }
+
+    msg := NewAuthMessage(token)
+    bytes, err := json.Marshal(msg)
+    if err != nil {
+	slog.Error("Marshalling authentication response failed", "error", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	return
+    }
+    w.Write(bytes)
+}
+
+func (hub *Hub) formLogin(w http.ResponseWriter, r *http.Request) {
+    if !checkCSRF(r) {
+	requestLogger(r).Warn("Login failed", "reason", "invalid_csrf_token")
+	http.Error(w, "Invalid CSRF token.", http.StatusForbidden)
+	return
+    }
+    creds := Credential{Email: r.PostFormValue("email"), Password: r.PostFormValue("password")}
+    token, ok := hub.login(r, creds, browserSessionIdle)
+    if !ok {
+	http.Redirect(w, r, "/dashboard?login=failed", http.StatusSeeOther)
+	return
+    }
+    hub.setSessionCookie(w, r, token)
+    http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// login checks creds and starts a session, returning its token. A session
+// with an idle timeout is renewed on use; otherwise it lasts
+// sessionLifetime.
+func (hub *Hub) login(r *http.Request, creds Credential, idle time.Duration) (string, bool) {
+    if hub.config().Server.AuthType == "full" {
+	if creds.Email != hub.config().Server.Email {
+	    hub.emitLoginFailed(r, "incorrect_email")
+	    return "", false
 	}
     } else {
 	if creds.Email == "" {
-	    w.WriteHeader(http.StatusUnauthorized)
-	    log.Println("Auth Failed: No email found")
-	    return
+	    hub.emitLoginFailed(r, "missing_email")
+	    return "", false
 	}
     }
-    if creds.Password != hub.config.Server.Password {
-	w.WriteHeader(http.StatusUnauthorized)
-	log.Println("Auth Failed: Invalid password")
-	return
+    if creds.Password != hub.config().Server.Password {
+	hub.emitLoginFailed(r, "invalid_password")
+	return "", false
     }
 
-
     session := &Session{
-	expiry: time.Now().Add(120 * time.Second),
+	expiry: time.Now().Add(sessionLifetime),
+	idle: idle,
+    }
+    if idle > 0 {
+	session.expiry = time.Now().Add(idle)
     }
     token := uuid.New().String()
 
+    hub.mu.Lock()
     hub.sessions[token] = session
+    hub.mu.Unlock()
+    hub.metrics.login("success")
+    requestLogger(r).Info("Session created", "session", sessionId(token))
+    return token, true
+}
 
-    _, ok := hub.sessions[token]
-    
-    log.Printf("Session with token %v exists: %v", token, ok)
-
-    msg := NewAuthMessage(token)
-    bytes, err := json.Marshal(msg)
-    if err != nil {
-	log.Println("Error marshalling authentication response.")
-	w.WriteHeader(http.StatusInternalServerError)
-	return
-    }
-    w.Write(bytes)
+func (hub *Hub) emitLoginFailed(r *http.Request, reason string) {
+    requestLogger(r).Warn("Login failed", "reason", reason, "remote_addr", r.RemoteAddr)
+    hub.metrics.login("failure")
+    hub.emit(EventLoginFailed, map[string]interface{}{
+	"reason": reason,
+	"remote_addr": r.RemoteAddr,
+	"path": r.URL.Path,
+    })
 }
 
 func (hub *Hub) TokenAuth(token string) error {
@@ -82,33 +139,77 @@ func (hub *Hub) TokenAuth(token string) error {
     //log.Printf("Split first index: %v", split[0])
     //token := split[1]
 
-    log.Printf("Received Token: %v", token)
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
     session, ok := hub.sessions[token]
     if !ok {
-	log.Printf("Existing Token: %v", hub.sessions)
+	slog.Debug("Unknown session", "session", sessionId(token))
 	return errors.New("Session does not Exist")
     }
     if session.isExpired() {
 	delete(hub.sessions, token)
-	log.Println("Token is expired")
+	slog.Info("Session expired", "session", sessionId(token))
 	return errors.New("Session has expired")
     }
+    if session.idle > 0 {
+	session.expiry = time.Now().Add(session.idle)
+    }
 
     return nil
 }
 
+// sessionToken reads the session token from an "Authorization: Bearer"
+// header, the session cookie or the session_token query parameter.
+func sessionToken(r *http.Request) string {
+    token, _ := requestSession(r)
+    return token
+}
+
+// requestSession is sessionToken, also reporting whether the token came
+// from the cookie, which a browser sends on its own and so needs CSRF
+// checks.
+func requestSession(r *http.Request) (string, bool) {
+    auth := r.Header.Get("Authorization")
+    if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+	return strings.TrimSpace(token), false
+    }
+    if token := r.URL.Query().Get("session_token"); token != "" {
+	return token, false
+    }
+    if cookie, err := r.Cookie(sessionCookie); err == nil {
+	return cookie.Value, true
+    }
+    return "", false
+}
+
+func (hub *Hub) SessionAuth(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie := requestSession(r)
+	err := hub.TokenAuth(token)
+	if err != nil {
+	    writeJSON(w, http.StatusUnauthorized, ClientResponse{Type: "error", Error: err.Error()})
+	    return
+	}
+	if fromCookie && !safeMethod(r.Method) && !checkCSRF(r) {
+	    writeJSON(w, http.StatusForbidden, ClientResponse{Type: "error", Error: "Invalid CSRF token."})
+	    return
+	}
+	if fromCookie {
+	    hub.setSessionCookie(w, r, token)
+	}
+	next.ServeHTTP(w, r)
+    })
+}
+
 func (hub *Hub) ClientHandler(w http.ResponseWriter, r *http.Request) {
-    //auth := r.Header.Get("Authorization")
-    auth := r.URL.Query().Get("session_token")
-    err := hub.TokenAuth(auth)
+    err := hub.TokenAuth(sessionToken(r))
     if err != nil {
 	w.WriteHeader(http.StatusUnauthorized)
 	return
     }
-    ws, err := upgrader.Upgrade(w, r, nil)
+    ws, err := hub.upgrade(w, r, hub.config().WebSocket.clientLimit())
     if err != nil {
-	log.Println(err)
-	ws.Close()
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
 	return
     }
     clientId := uuid.New().String()
@@ -116,61 +217,71 @@ func (hub *Hub) ClientHandler(w http.ResponseWriter, r *http.Request) {
 	hub: hub,
 	id: clientId,
 	conn: ws,
-	egress: make(chan []byte),
+	log: requestLogger(r).With("client_id", clientId),
+	egress: make(chan []byte, egressBuffer),
     }
+    client.log.Info("Client connected", "remote_addr", r.RemoteAddr)
+    hub.mu.Lock()
     hub.clients[clientId] = client
-    client.sendMessage("auth_success")
+    hub.mu.Unlock()
+    client.sendMessage("auth_success", "")
 
     go client.readPump()
     go client.writePump()
 }
 
 func (hub *Hub) ReceiverHandler(w http.ResponseWriter, r *http.Request) {
-    auth := r.URL.Query().Get("session_token")
-    err := hub.TokenAuth(auth)
+    err := hub.TokenAuth(sessionToken(r))
     if err != nil {
 	w.WriteHeader(http.StatusUnauthorized)
 	return
     }
-    ws, err := upgrader.Upgrade(w, r, nil)
+    ws, err := hub.upgrade(w, r, hub.config().WebSocket.receiverLimit())
     if err != nil {
-	log.Println(err)
-	ws.Close()
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
 	return
     }
 
-    log.Println("Receiver initiating...")
-
     var authMsg ReceiverInbound
-    err = ws.ReadJSON(&authMsg)
+    err = readWire(ws, hub.config().WebSocket.receiverLimit(), &authMsg)
     if err != nil {
-	log.Printf("Error parsing receiver auth message: %v", err)
+	requestLogger(r).Warn("Invalid receiver auth message", "error", err)
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+	    rejectTooLarge(ws, ReceiverResponse{Type: "error", Code: "message_too_large", Error: err.Error()})
+	    return
+	}
 	hub.wsWriteReceiverResponse(ws, "error", "Invalid JSON format.")
 	return
     }
-    if hub.receivers[authMsg.ReceiverName] != nil {
-	hub.wsWriteReceiverResponse(ws, "error", "Receiver name already exists.")
-	return
-    }
 
     receiver := &Receiver {
 	name: authMsg.ReceiverName,
+	tags: authMsg.Tags,
+	group: authMsg.Group,
+	functions: authMsg.Functions,
 	conn: ws,
 	hub: hub,
-	egress: make(chan []byte),
+	log: requestLogger(r).With("receiver", authMsg.ReceiverName),
+	egress: make(chan []byte, egressBuffer),
+    }
+    err = hub.tryRegisterReceiver(receiver)
+    if err != nil {
+	hub.wsWriteReceiverResponse(ws, "error", err.Error())
+	return
     }
-    hub.receivers[authMsg.ReceiverName] = receiver
+    receiver.log.Info("Receiver connected", "remote_addr", r.RemoteAddr)
     hub.wsWriteReceiverResponse(ws, "auth_success", "")
 
     go receiver.readPump()
     go receiver.writePump()
+    hub.receiverOnline(receiver)
 }
 
 func (hub *Hub) HandlerClientPassword(w http.ResponseWriter, r *http.Request) {
-    ws, err := upgrader.Upgrade(w, r, nil)
+    ws, err := hub.upgrade(w, r, hub.config().WebSocket.clientLimit())
     if err != nil {
-	log.Println(err)
-	ws.Close()
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
 	return
     }
 
@@ -179,66 +290,90 @@ func (hub *Hub) HandlerClientPassword(w http.ResponseWriter, r *http.Request) {
 	hub: hub,
 	id: id,
 	conn: ws,
-	egress: make(chan []byte),
+	log: requestLogger(r).With("client_id", id),
+	egress: make(chan []byte, egressBuffer),
     }
     var authMsg ClientInbound
-    err = ws.ReadJSON(&authMsg)
+    err = readWire(ws, hub.config().WebSocket.clientLimit(), &authMsg)
     if err != nil {
-	log.Printf("Error unmarshalling request: %v", err)
+	client.log.Warn("Invalid client auth message", "error", err)
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+	    rejectTooLarge(ws, ClientResponse{Type: "error", Code: "message_too_large", Error: err.Error()})
+	    return
+	}
 	//hub.wsWriteClientResponse(ws, "error", nil, "Invalid JSON format") 
-	client.sendErrorResponse("Invalid JSON format")
+	client.sendErrorResponse("Invalid JSON format", "")
 	client.close()
 	return
     }
-    if authMsg.Password != hub.config.Server.Password {
-	log.Printf("Client failed password authentication.")
+    if authMsg.Password != hub.config().Server.Password {
+	hub.emitLoginFailed(r, "invalid_password")
 	//hub.wsWriteClientResponse(ws, "error", nil, "Incorrect password.")
-	client.sendErrorResponse("Incorrect password.")
+	client.sendErrorResponse("Incorrect password.", "")
 	client.close()
 	return
     }
+    hub.metrics.login("success")
 
+    hub.mu.Lock()
     hub.clients[id] = client
+    hub.mu.Unlock()
+    client.log.Info("Client connected", "remote_addr", r.RemoteAddr)
     //hub.client = client
     //hub.wsWriteClientResponse(ws, "auth_success", nil, "")
-    client.sendMessage("auth_success")
+    client.sendMessage("auth_success", "")
     
     go client.readPump()
     go client.writePump()
 }
 
 func (hub *Hub) HandlerReceiverPassword(w http.ResponseWriter, r *http.Request) {
-    ws, err := upgrader.Upgrade(w, r, nil)
+    ws, err := hub.upgrade(w, r, hub.config().WebSocket.receiverLimit())
     if err != nil {
-	log.Println(err)
-	ws.Close()
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
 	return
     }
-    log.Println("Receiver authenticating...")
-    
+
     var authMsg ReceiverInbound
-    err = ws.ReadJSON(&authMsg)
+    err = readWire(ws, hub.config().WebSocket.receiverLimit(), &authMsg)
     if err != nil {
-	log.Printf("Error parsing receiver auth message: %v", err)
+	requestLogger(r).Warn("Invalid receiver auth message", "error", err)
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+	    rejectTooLarge(ws, ReceiverResponse{Type: "error", Code: "message_too_large", Error: err.Error()})
+	    return
+	}
 	hub.wsWriteReceiverResponse(ws, "error", "Invalid JSON format.")
 	return
     }
-    if authMsg.Password != hub.config.Server.Password {
-	log.Println("Receiver failed password authentication.")
+    if authMsg.Password != hub.config().Server.Password {
+	hub.emitLoginFailed(r, "invalid_password")
 	hub.wsWriteReceiverResponse(ws, "auth_failure", "Incorrect password.")
 	return
     }
+    hub.metrics.login("success")
     receiver := &Receiver {
 	name: authMsg.ReceiverName,
+	tags: authMsg.Tags,
+	group: authMsg.Group,
+	functions: authMsg.Functions,
 	conn: ws,
 	hub: hub,
-	egress: make(chan []byte),
+	log: requestLogger(r).With("receiver", authMsg.ReceiverName),
+	egress: make(chan []byte, egressBuffer),
+    }
+    err = hub.tryRegisterReceiver(receiver)
+    if err != nil {
+	hub.wsWriteReceiverResponse(ws, "error", err.Error())
+	return
     }
-    hub.receivers[authMsg.ReceiverName] = receiver
+    receiver.log.Info("Receiver connected", "remote_addr", r.RemoteAddr)
     hub.wsWriteReceiverResponse(ws, "auth_success", "")
 
     go receiver.readPump()
     go receiver.writePump()
+    hub.receiverOnline(receiver)
 
 }
 
@@ -246,8 +381,136 @@ func (hub *Hub) HandlerAuth(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (hub *Hub) HandlerListSchedules(w http.ResponseWriter, r *http.Request) {
+    schedules := hub.scheduler.List()
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "schedules", Schedules: &schedules})
+}
+
+func (hub *Hub) HandlerGetSchedule(w http.ResponseWriter, r *http.Request) {
+    schedule, ok := hub.scheduler.Get(chi.URLParam(r, "id"))
+    if !ok {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: "Schedule not found."})
+	return
+    }
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "schedule", Schedule: &schedule})
+}
+
+func (hub *Hub) HandlerCreateSchedule(w http.ResponseWriter, r *http.Request) {
+    var schedule Schedule
+    err := json.NewDecoder(r.Body).Decode(&schedule)
+    if err != nil {
+	writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: "Invalid JSON format."})
+	return
+    }
+    schedule, err = hub.scheduler.Create(schedule)
+    if err != nil {
+	writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    writeJSON(w, http.StatusCreated, ClientResponse{Type: "schedule", Schedule: &schedule})
+}
+
+func (hub *Hub) HandlerUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+    var schedule Schedule
+    err := json.NewDecoder(r.Body).Decode(&schedule)
+    if err != nil {
+	writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: "Invalid JSON format."})
+	return
+    }
+    id := chi.URLParam(r, "id")
+    if _, ok := hub.scheduler.Get(id); !ok {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: "Schedule not found."})
+	return
+    }
+    schedule, err = hub.scheduler.Update(id, schedule)
+    if err != nil {
+	writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "schedule", Schedule: &schedule})
+}
+
+func (hub *Hub) HandlerDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+    err := hub.scheduler.Delete(chi.URLParam(r, "id"))
+    if err != nil {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// pageData is what the page templates render with.
+type pageData struct {
+    Page        string
+    AuthType    string
+    LoggedIn    bool
+    LoginFailed bool
+    CSRFToken   string
+}
+
+// renderPage renders templates/<page>.tmpl.html inside the shared layout.
+// Templates are parsed per request so edits show up without a restart.
+func renderPage(w http.ResponseWriter, data pageData) {
+    tmpl, err := template.ParseFiles("templates/base.tmpl.html", "templates/" + data.Page + ".tmpl.html")
+    if err != nil {
+	slog.Error("Parsing templates failed", "page", data.Page, "error", err)
+	http.Error(w, "Internal Error", http.StatusInternalServerError)
+	return
+    }
+    var buf bytes.Buffer
+    err = tmpl.ExecuteTemplate(&buf, "base", data)
+    if err != nil {
+	slog.Error("Rendering template failed", "page", data.Page, "error", err)
+	http.Error(w, "Internal Error", http.StatusInternalServerError)
+	return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    buf.WriteTo(w)
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-    //http.ServeFile(w, r, "static/index.html")
-    tmpl := template.Must(template.ParseFiles("templates/index.tmpl.html"))
-    tmpl.Execute(w, "")
+    renderPage(w, pageData{Page: "index"})
+}
+
+// HandlerDashboard serves the dashboard page: the login form, or for a
+// valid session cookie the dashboard, which the browser fills in over the
+// v2 client socket.
+func (hub *Hub) HandlerDashboard(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    token, fromCookie := requestSession(r)
+    loggedIn := hub.TokenAuth(token) == nil
+    if loggedIn && fromCookie {
+	// The session was just renewed; renew the cookie with it.
+	hub.setSessionCookie(w, r, token)
+    }
+    renderPage(w, pageData{
+	Page: "dashboard",
+	AuthType: hub.config().Server.AuthType,
+	LoggedIn: loggedIn,
+	LoginFailed: r.URL.Query().Get("login") == "failed",
+	CSRFToken: hub.csrfToken(w, r),
+    })
+}
+
+func (hub *Hub) HandlerListWorkflows(w http.ResponseWriter, r *http.Request) {
+    workflows := hub.workflows.Workflows()
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "workflows", Workflows: &workflows})
+}
+
+func (hub *Hub) HandlerRunWorkflow(w http.ResponseWriter, r *http.Request) {
+    run, err := hub.workflows.Start(chi.URLParam(r, "name"), nil)
+    if err != nil {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    writeJSON(w, http.StatusAccepted, ClientResponse{Type: "workflow_run", WorkflowRun: &run})
+}
+
+func (hub *Hub) HandlerGetWorkflowRun(w http.ResponseWriter, r *http.Request) {
+    run, ok := hub.workflows.Run(chi.URLParam(r, "id"))
+    if !ok {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: "Workflow run not found."})
+	return
+    }
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "workflow_run", WorkflowRun: &run})
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+// hubProbeTimeout is how long readiness waits to take the hub lock before
+// calling the hub unresponsive.
+const hubProbeTimeout = time.Second
+
+type HealthCheck struct {
+    Status      string  `json:"status"`
+    Error       string  `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+    Status      string                  `json:"status"`
+    Version     string                  `json:"version,omitempty"`
+    Checks      map[string]HealthCheck  `json:"checks,omitempty"`
+}
+
+// HandlerHealthz answers as long as the process can serve HTTP.
+func (hub *Hub) HandlerHealthz(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, HealthResponse{Status: "ok", Version: version})
+}
+
+// HandlerReadyz reports whether the server should be sent traffic: the
+// config is loaded, the data directory is writable and the hub is not
+// stuck or shutting down.
+func (hub *Hub) HandlerReadyz(w http.ResponseWriter, r *http.Request) {
+    response := hub.readiness()
+    code := http.StatusOK
+    if response.Status != "ok" {
+	code = http.StatusServiceUnavailable
+    }
+    writeJSON(w, code, response)
+}
+
+func (hub *Hub) readiness() HealthResponse {
+    checks := map[string]HealthCheck{
+	"config": checkResult(hub.checkConfig()),
+	"storage": checkResult(hub.checkStorage()),
+	"hub": checkResult(hub.checkResponsive()),
+    }
+    status := "ok"
+    for _, check := range checks {
+	if check.Status != "ok" {
+	    status = "unavailable"
+	}
+    }
+    return HealthResponse{Status: status, Version: version, Checks: checks}
+}
+
+func checkResult(err error) HealthCheck {
+    if err != nil {
+	return HealthCheck{Status: "failed", Error: err.Error()}
+    }
+    return HealthCheck{Status: "ok"}
+}
+
+func (hub *Hub) checkConfig() error {
+    if hub.config() == nil {
+	return errors.New("No config loaded.")
+    }
+    return nil
+}
+
+// checkStorage creates and removes a file in the data directory, which is
+// where schedules, workflows and dead letters are written.
+func (hub *Hub) checkStorage() error {
+    dir := hub.config().Server.DataDir
+    if dir == "" {
+	return nil
+    }
+    err := os.MkdirAll(dir, 0700)
+    if err != nil {
+	return err
+    }
+    file, err := os.CreateTemp(dir, ".readyz-*")
+    if err != nil {
+	return err
+    }
+    file.Close()
+    return os.Remove(file.Name())
+}
+
+// checkResponsive takes the hub lock, which every connection and exec goes
+// through, so a deadlock shows up here rather than as silent hangs.
+func (hub *Hub) checkResponsive() error {
+    if hub.isShuttingDown() {
+	return errShuttingDown
+    }
+    locked := make(chan struct{})
+    go func() {
+	hub.mu.Lock()
+	hub.mu.Unlock()
+	close(locked)
+    }()
+    select {
+    case <-locked:
+	return nil
+    case <-time.After(hubProbeTimeout):
+	return errors.New("Hub did not respond in time.")
+    }
+}
+
+// sdNotify sends a state such as "READY=1" to the service manager over
+// NOTIFY_SOCKET. It does nothing when the variable is unset, so it is safe
+// to call outside systemd.
+func sdNotify(state string) error {
+    path := os.Getenv("NOTIFY_SOCKET")
+    if path == "" {
+	return nil
+    }
+    if path[0] == '@' {
+	// Abstract socket.
+	path = "\x00" + path[1:]
+    }
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+    if err != nil {
+	return err
+    }
+    defer conn.Close()
+    _, err = conn.Write([]byte(state))
+    return err
+}
+
+// watchdogInterval is how often to send WATCHDOG=1: half the WATCHDOG_USEC
+// timeout systemd set for this process, or zero when it wants none.
+func watchdogInterval() time.Duration {
+    usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+    if err != nil || usec <= 0 {
+	return 0
+    }
+    pid := os.Getenv("WATCHDOG_PID")
+    if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+	return 0
+    }
+    return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the service manager while the hub stays responsive, so
+// a wedged server is restarted rather than left running.
+func (hub *Hub) runWatchdog(interval time.Duration, stop <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+	select {
+	case <-ticker.C:
+	    err := hub.checkResponsive()
+	    if err != nil {
+		slog.Warn("Skipping watchdog ping", "error", err)
+		continue
+	    }
+	    err = sdNotify("WATCHDOG=1")
+	    if err != nil {
+		slog.Warn("Watchdog ping failed", "error", err)
+	    }
+	case <-stop:
+	    return
+	}
+    }
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "time"
+)
+
+const (
+    execHistorySize     = 1000
+    defaultHistoryLimit = 50
+)
+
+// ExecRecord is a finished exec kept in the hub's bounded history.
+type ExecRecord struct {
+    ExecResult
+    StartedAt   time.Time   `json:"started_at"`
+    FinishedAt  time.Time   `json:"finished_at"`
+}
+
+// HistoryQuery filters the exec history. Zero fields match everything.
+type HistoryQuery struct {
+    ExecId          string      `json:"exec_id,omitempty"`
+    ReceiverName    string      `json:"receiver_name,omitempty"`
+    FunctionKey     string      `json:"function_key,omitempty"`
+    Status          string      `json:"status,omitempty"`
+    Since           time.Time   `json:"since,omitempty"`
+    Limit           int         `json:"limit,omitempty"`
+}
+
+func (q *HistoryQuery) matches(record ExecRecord) bool {
+    return (q.ExecId == "" || record.ExecId == q.ExecId) &&
+	(q.ReceiverName == "" || record.ReceiverName == q.ReceiverName) &&
+	(q.FunctionKey == "" || record.FunctionKey == q.FunctionKey) &&
+	(q.Status == "" || record.Status == q.Status) &&
+	(q.Since.IsZero() || !record.FinishedAt.Before(q.Since))
+}
+
+func (hub *Hub) recordExec(exec *pendingExec, result ExecResult) {
+    hub.metrics.exec(exec.receiverName, functionLabel(exec.function), result.Status, time.Since(exec.startedAt))
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    hub.history = append(hub.history, ExecRecord{
+	ExecResult: result,
+	StartedAt: exec.startedAt,
+	FinishedAt: time.Now(),
+    })
+    if len(hub.history) > execHistorySize {
+	hub.history = hub.history[len(hub.history)-execHistorySize:]
+    }
+}
+
+// QueryHistory returns matching finished execs, newest first.
+func (hub *Hub) QueryHistory(query HistoryQuery) []ExecRecord {
+    limit := query.Limit
+    if limit <= 0 {
+	limit = defaultHistoryLimit
+    }
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    records := make([]ExecRecord, 0)
+    for i := len(hub.history) - 1; i >= 0 && len(records) < limit; i-- {
+	if query.matches(hub.history[i]) {
+	    records = append(records, hub.history[i])
+	}
+    }
+    return records
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net/http"
+    "strings"
+    "text/template"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+)
+
+const (
+    hookBodyLimit           = 1 << 20
+    hookSecretHeader        = "X-Macron-Secret"
+    defaultSignatureHeader  = "X-Hub-Signature-256"
+    maxHookWait             = 5 * time.Minute
+)
+
+// HookConfig maps an inbound webhook to a receiver function. String values
+// in Args are rendered as text/template against the decoded JSON body, so
+// `ref = "{{ .ref }}"` forwards the pushed ref from a GitHub payload.
+type HookConfig struct {
+    Id              string                  `toml:"id"`
+    Receiver        string                  `toml:"receiver"`
+    Function        string                  `toml:"function"`
+    Args            map[string]interface{}  `toml:"args,omitempty"`
+    Auth            string                  `toml:"auth,omitempty"`
+    Secret          string                  `toml:"secret"`
+    SignatureHeader string                  `toml:"signature_header,omitempty"`
+    Wait            string                  `toml:"wait,omitempty"`
+}
+
+func (hub *Hub) findHook(id string) *HookConfig {
+    for i := range hub.config().Hooks {
+	if hub.config().Hooks[i].Id == id {
+	    return &hub.config().Hooks[i]
+	}
+    }
+    return nil
+}
+
+// verify checks the shared secret header, or for "hmac" hooks the
+// sha256 signature of the raw body.
+func (hook *HookConfig) verify(r *http.Request, body []byte) bool {
+    if hook.Secret == "" {
+	return false
+    }
+    if hook.Auth != "hmac" {
+	given := r.Header.Get(hookSecretHeader)
+	return subtle.ConstantTimeCompare([]byte(given), []byte(hook.Secret)) == 1
+    }
+
+    header := hook.SignatureHeader
+    if header == "" {
+	header = defaultSignatureHeader
+    }
+    given := strings.TrimPrefix(r.Header.Get(header), "sha256=")
+    signature, err := hex.DecodeString(given)
+    if err != nil {
+	return false
+    }
+    mac := hmac.New(sha256.New, []byte(hook.Secret))
+    mac.Write(body)
+    return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func renderHookArgs(args map[string]interface{}, payload interface{}) (map[string]interface{}, error) {
+    if args == nil {
+	return nil, nil
+    }
+    rendered := make(map[string]interface{}, len(args))
+    for key, value := range args {
+	text, ok := value.(string)
+	if !ok || !strings.Contains(text, "{{") {
+	    rendered[key] = value
+	    continue
+	}
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(text)
+	if err != nil {
+	    return nil, err
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, payload)
+	if err != nil {
+	    return nil, err
+	}
+	rendered[key] = out.String()
+    }
+    return rendered, nil
+}
+
+func (hub *Hub) HandlerHook(w http.ResponseWriter, r *http.Request) {
+    hook := hub.findHook(chi.URLParam(r, "id"))
+    if hook == nil {
+	writeJSON(w, http.StatusNotFound, ClientResponse{Type: "error", Error: "Hook not found."})
+	return
+    }
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, hookBodyLimit))
+    if err != nil {
+	writeJSON(w, http.StatusRequestEntityTooLarge, ClientResponse{Type: "error", Error: "Request body too large."})
+	return
+    }
+    if !hook.verify(r, body) {
+	requestLogger(r).Warn("Hook authentication failed", "hook", hook.Id)
+	writeJSON(w, http.StatusUnauthorized, ClientResponse{Type: "error", Error: "Invalid hook secret or signature."})
+	return
+    }
+
+    var payload interface{}
+    if len(bytes.TrimSpace(body)) > 0 {
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+	    writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: "Invalid JSON format."})
+	    return
+	}
+    }
+    args, err := renderHookArgs(hook.Args, payload)
+    if err != nil {
+	writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+
+    wait := hook.Wait
+    if query := r.URL.Query().Get("wait"); query != "" {
+	wait = query
+    }
+    timeout := time.Duration(0)
+    if wait != "" {
+	timeout, err = time.ParseDuration(wait)
+	if err != nil || timeout < 0 || timeout > maxHookWait {
+	    writeJSON(w, http.StatusBadRequest, ClientResponse{Type: "error", Error: "Invalid wait duration."})
+	    return
+	}
+    }
+
+    receiver, fn, err := hub.resolveFunction(hook.Receiver, hook.Function, "")
+    if err != nil {
+	requestLogger(r).Warn("Hook exec failed", "hook", hook.Id, "error", err)
+	writeJSON(w, http.StatusServiceUnavailable, ClientResponse{Type: "error", Error: err.Error()})
+	return
+    }
+    exec := hub.startExec(receiver, fn, args, "")
+    requestLogger(r).Info("Hook started exec", "hook", hook.Id, "exec_id", exec.id, "receiver", hook.Receiver)
+
+    if timeout == 0 {
+	writeJSON(w, http.StatusAccepted, ClientResponse{Type: "exec", ExecId: exec.id, ReceiverName: hook.Receiver})
+	return
+    }
+    result := hub.awaitExec(exec, timeout)
+    writeJSON(w, http.StatusOK, ClientResponse{Type: "exec_result", ExecId: exec.id, ReceiverName: hook.Receiver, Result: &result})
+}
@@ -1,59 +1,165 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-    ReadBufferSize: 1024,
-    WriteBufferSize: 1024,
-    CheckOrigin: func(r *http.Request) bool { return true },
-}
-
+// egressBuffer is how many messages a connection queues for its writePump,
+// so a burst does not stall the sender on a slow peer.
+const egressBuffer = 64
 
 
 type Hub struct {
     sessions	map[string] *Session
     clients	map[string] *Client
     receivers	map[string] *Receiver
-    config	*Config
+    execs	map[string] *pendingExec
+    history	[]ExecRecord
+    functionWaiters map[string] chan *[]MacronFunction
+    scheduler	*Scheduler
+    workflows	*WorkflowRunner
+    events	*EventBus
+    webhooks	*WebhookDispatcher
+    metrics	*Metrics
+    // cfg is swapped whole when the config file is reloaded; read it with
+    // config().
+    cfg		atomic.Pointer[Config]
+    upgrader	*websocket.Upgrader
+    // draining is set once Shutdown starts; shutdown is closed at the same
+    // time for connections that select on it.
+    draining	atomic.Bool
+    shutdown	chan struct{}
+    mu		sync.Mutex
+}
+
+func NewHub(config *Config) *Hub {
+    hub := &Hub{
+	sessions: make(map[string]*Session),
+	clients: make(map[string]*Client),
+	receivers: make(map[string]*Receiver),
+	execs: make(map[string]*pendingExec),
+	functionWaiters: make(map[string]chan *[]MacronFunction),
+	events: NewEventBus(),
+	metrics: NewMetrics(),
+	shutdown: make(chan struct{}),
+    }
+    hub.cfg.Store(config)
+    hub.upgrader = newUpgrader(config.WebSocket, hub.originAllowed)
+    schedulesPath := ""
+    workflowsDir := ""
+    deadLetterPath := ""
+    if config.Server.DataDir != "" {
+	schedulesPath = filepath.Join(config.Server.DataDir, "schedules.json")
+	workflowsDir = filepath.Join(config.Server.DataDir, "workflows")
+	deadLetterPath = filepath.Join(config.Server.DataDir, "webhooks-dead-letter.jsonl")
+    }
+    hub.scheduler = NewScheduler(hub, schedulesPath)
+    hub.workflows = NewWorkflowRunner(hub, workflowsDir)
+    hub.webhooks = NewWebhookDispatcher(hub, deadLetterPath)
+    return hub
+}
+
+// config returns the current config. Callers must not modify it.
+func (hub *Hub) config() *Config {
+    return hub.cfg.Load()
+}
+
+// tryRegisterReceiver adds r unless a receiver already has its name. The
+// check and the insert share one critical section, so two receivers saying
+// hello with the same name at once cannot both get in.
+func (hub *Hub) tryRegisterReceiver(r *Receiver) error {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    if hub.receivers[r.name] != nil {
+	return errors.New("Receiver name already exists.")
+    }
+    hub.receivers[r.name] = r
+    return nil
+}
+
+// receiverOnline announces a registered receiver once its pumps are
+// running, since missed schedules fire straight away.
+func (hub *Hub) receiverOnline(r *Receiver) {
+    hub.emit(EventReceiverOnline, map[string]interface{}{"receiver_name": r.name})
+    hub.scheduler.ReceiverOnline(r.name)
 }
 
 type Session struct {
     //deviceName	string
     expiry	time.Time
+    // idle is set for browser sessions, whose expiry moves forward by
+    // this much every time they are used.
+    idle	time.Duration
 }
 func(s *Session) isExpired() bool {
     return s.expiry.Before(time.Now())
 }
 
+// SessionInfo describes a session without revealing its token.
+type SessionInfo struct {
+    Id		string	    `json:"id"`
+    ExpiresAt	time.Time   `json:"expires_at"`
+}
+
+// sessionId derives a stable, non-secret id from a session token.
+func sessionId(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:6])
+}
+
+// ListSessions returns the unexpired sessions, soonest to expire first.
+func (hub *Hub) ListSessions() []SessionInfo {
+    hub.mu.Lock()
+    sessions := make([]SessionInfo, 0, len(hub.sessions))
+    for token, session := range hub.sessions {
+	if !session.isExpired() {
+	    sessions = append(sessions, SessionInfo{Id: sessionId(token), ExpiresAt: session.expiry})
+	}
+    }
+    hub.mu.Unlock()
+    sort.Slice(sessions, func(i, j int) bool {
+	return sessions[i].ExpiresAt.Before(sessions[j].ExpiresAt)
+    })
+    return sessions
+}
+
 func (hub *Hub) GetReceivers() []string {
     r := make([]string, 0)
+    hub.mu.Lock()
     for _, value := range hub.receivers {
 	r = append(r, value.name)
     }
+    hub.mu.Unlock()
 
-    log.Printf("Number of receivers: %d", len(r))
+    slog.Debug("Listing receivers", "count", len(r))
     return r
 }
 
 func (hub *Hub) GetFunctions(name string, clientId string) error {
-    log.Printf("Receiver name requested: %s", name)
+    slog.Debug("Requesting functions", "receiver", name, "client_id", clientId)
     if name == "" {
 	return errors.New("Receiver Name Empty.")
     }
-    if hub.receivers[name] == nil {
+    hub.mu.Lock()
+    receiver := hub.receivers[name]
+    hub.mu.Unlock()
+    if receiver == nil {
 	return fmt.Errorf("Receiver not found with name: %s", name)
     }
-    hub.receivers[name].getFunctions(clientId)
-    return nil
+    return receiver.getFunctions(clientId)
 }
 
 //func (hub *Hub) SendFunctions(functions *[]MacronFunction) {
@@ -66,56 +172,242 @@ func (hub *Hub) GetFunctions(name string, clientId string) error {
 //    
 //    hub.client.egress <- bytes
 //}
-func (hub *Hub) SendFunctions(id string, functions *[]MacronFunction) {
-    log.Printf("Functions: %v", functions)
+func (hub *Hub) SendFunctions(id string, receiverName string, functions *[]MacronFunction) {
+    slog.Debug("Sending functions", "receiver", receiverName, "client_id", id)
     response := ClientResponse {
 	Type: "functions",
+	ReceiverName: receiverName,
 	Functions: functions,
     }
     bytes, _ := json.Marshal(&response)
     
-    if client := hub.clients[id]; client != nil { 
-	hub.clients[id].egress <- bytes
+    hub.mu.Lock()
+    waiter := hub.functionWaiters[id]
+    client := hub.clients[id]
+    hub.mu.Unlock()
+    if waiter != nil {
+	// The waiter holds one reply; a repeat for the same id is dropped
+	// rather than blocking the receiver's readPump.
+	select {
+	case waiter <- functions:
+	default:
+	}
+    } else if client != nil { 
+	if err := enqueue(client.egress, bytes); err != nil {
+	    slog.Warn("Dropping functions for client", "receiver", receiverName, "client_id", id, "error", err)
+	}
     } else {
-	log.Println("Receiver Response: ClientID provided does not exist...")
+	slog.Warn("Functions for unknown client", "receiver", receiverName, "client_id", id)
     }
 }
 
-func (hub *Hub) RemoveReceiver(name string) {
-    delete(hub.receivers, name)
+// RemoveReceiver unregisters r. A receiver that was never registered, or
+// whose name has since been taken, leaves the registered one alone.
+func (hub *Hub) RemoveReceiver(r *Receiver) {
+    hub.mu.Lock()
+    if hub.receivers[r.name] == r {
+	delete(hub.receivers, r.name)
+    }
+    hub.mu.Unlock()
 }
 
-func (hub *Hub) ExecFunction(name string, id int) error {
-    if name == "" {
-	return errors.New("Receiver Name Empty.")
+func (hub *Hub) RemoveClient(id string) {
+    hub.mu.Lock()
+    delete(hub.clients, id)
+    hub.mu.Unlock()
+}
+
+// ReceiverInfo describes a connected receiver for admin listings.
+type ReceiverInfo struct {
+    Name	    string	`json:"name"`
+    Group	    string	`json:"group,omitempty"`
+    Tags	    []string	`json:"tags,omitempty"`
+    Functions	    int		`json:"functions"`
+    Version	    int		`json:"version"`
+    RemoteAddr	    string	`json:"remote_addr,omitempty"`
+}
+
+// ClientInfo describes a connected client for admin listings.
+type ClientInfo struct {
+    Id		    string	`json:"id"`
+    Version	    int		`json:"version"`
+    RemoteAddr	    string	`json:"remote_addr,omitempty"`
+}
+
+// ReceiverInfos lists connected receivers by name. Version is the
+// negotiated protocol version, 0 for v1/v2 peers.
+func (hub *Hub) ReceiverInfos() []ReceiverInfo {
+    hub.mu.Lock()
+    infos := make([]ReceiverInfo, 0, len(hub.receivers))
+    for _, r := range hub.receivers {
+	info := ReceiverInfo{Name: r.name, Group: r.group, Tags: r.tags, Version: r.version}
+	if r.functions != nil {
+	    info.Functions = len(*r.functions)
+	}
+	if r.conn != nil {
+	    info.RemoteAddr = r.conn.RemoteAddr().String()
+	}
+	infos = append(infos, info)
     }
+    hub.mu.Unlock()
+    sort.Slice(infos, func(i, j int) bool {
+	return infos[i].Name < infos[j].Name
+    })
+    return infos
+}
+
+func (hub *Hub) ClientInfos() []ClientInfo {
+    hub.mu.Lock()
+    infos := make([]ClientInfo, 0, len(hub.clients))
+    for _, c := range hub.clients {
+	info := ClientInfo{Id: c.id, Version: c.version}
+	if c.conn != nil {
+	    info.RemoteAddr = c.conn.RemoteAddr().String()
+	}
+	infos = append(infos, info)
+    }
+    hub.mu.Unlock()
+    sort.Slice(infos, func(i, j int) bool {
+	return infos[i].Id < infos[j].Id
+    })
+    return infos
+}
+
+// KickReceiver closes a receiver's connection with 1008 (policy violation).
+// Its read pump then removes it and fails its pending execs as for any
+// disconnect.
+func (hub *Hub) KickReceiver(name string) error {
+    hub.mu.Lock()
     receiver := hub.receivers[name]
+    hub.mu.Unlock()
     if receiver == nil {
 	return fmt.Errorf("Receiver not found with name: %s", name)
     }
-    
-    receiver.execFunction(id)
+    slog.Info("Kicking receiver", "receiver", name)
+    receiver.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "kicked"), time.Now().Add(closeWait))
+    receiver.conn.Close()
     return nil
 }
 
+// RevokeSession ends the session with the given SessionInfo id. Connections
+// already authenticated with it stay open.
+func (hub *Hub) RevokeSession(id string) bool {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    for token := range hub.sessions {
+	if sessionId(token) == id {
+	    delete(hub.sessions, token)
+	    return true
+	}
+    }
+    return false
+}
+
+// RevokeSessions ends every session, returning how many there were.
+func (hub *Hub) RevokeSessions() int {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    n := len(hub.sessions)
+    hub.sessions = make(map[string]*Session)
+    return n
+}
+
+func (hub *Hub) ExecFunction(name string, id int, args map[string]interface{}, clientId string, replyTo string) (*pendingExec, error) {
+    if name == "" {
+	return nil, errors.New("Receiver Name Empty.")
+    }
+    if hub.isShuttingDown() {
+	return nil, errShuttingDown
+    }
+    hub.mu.Lock()
+    receiver := hub.receivers[name]
+    hub.mu.Unlock()
+    if receiver == nil {
+	return nil, fmt.Errorf("Receiver not found with name: %s", name)
+    }
+    
+    return hub.startClientExec(receiver, MacronFunction{Id: &id}, args, clientId, replyTo), nil
+}
+
+// StaleFunctionError is returned when a client execs a function key or
+// version that no longer matches the receiver's cached catalog.
+type StaleFunctionError struct {
+    ReceiverName    string
+    Key		    string
+    Version	    string
+}
+
+// CatalogUnavailableError is returned when a receiver has not sent its
+// function catalog and does not answer when asked for it.
+type CatalogUnavailableError struct {
+    ReceiverName    string
+}
+
+func (e *CatalogUnavailableError) Error() string {
+    return fmt.Sprintf("Function catalog unavailable for receiver: %s", e.ReceiverName)
+}
+
+func (e *StaleFunctionError) Error() string {
+    if e.Version != "" {
+	return fmt.Sprintf("Function %s@%s is no longer offered by receiver: %s", e.Key, e.Version, e.ReceiverName)
+    }
+    return fmt.Sprintf("Function %s is no longer offered by receiver: %s", e.Key, e.ReceiverName)
+}
+
+// ExecFunctionByKey execs a function by its stable key, optionally pinned to
+// a version, rejecting the exec if the cached catalog no longer matches.
+func (hub *Hub) ExecFunctionByKey(name string, key string, version string, args map[string]interface{}, clientId string, replyTo string) (*pendingExec, error) {
+    receiver, fn, err := hub.resolveFunction(name, key, version)
+    if err != nil {
+	return nil, err
+    }
+
+    return hub.startClientExec(receiver, fn, args, clientId, replyTo), nil
+}
+
+func (hub *Hub) resolveFunction(name string, key string, version string) (*Receiver, MacronFunction, error) {
+    if name == "" {
+	return nil, MacronFunction{}, errors.New("Receiver Name Empty.")
+    }
+    if key == "" {
+	return nil, MacronFunction{}, errors.New("Function Key Empty.")
+    }
+    if hub.isShuttingDown() {
+	return nil, MacronFunction{}, errShuttingDown
+    }
+    hub.mu.Lock()
+    receiver := hub.receivers[name]
+    hub.mu.Unlock()
+    if receiver == nil {
+	return nil, MacronFunction{}, fmt.Errorf("Receiver not found with name: %s", name)
+    }
+    // A receiver that has not sent its catalog yet is asked for it, rather
+    // than reporting every key as stale.
+    functions, err := hub.fetchCatalog(receiver, catalogFetchTimeout)
+    if err != nil {
+	return nil, MacronFunction{}, &CatalogUnavailableError{ReceiverName: name}
+    }
+    fn, ok := functionWithKey(functions, key)
+    if !ok || (version != "" && fn.Version != version) {
+	return nil, MacronFunction{}, &StaleFunctionError{ReceiverName: name, Key: key, Version: version}
+    }
+    return receiver, fn, nil
+}
+
 
 func (hub *Hub) HandlerReceiver(w http.ResponseWriter, r *http.Request) {
-    ws, err := upgrader.Upgrade(w, r, nil)
+    ws, err := hub.upgrade(w, r, hub.config().WebSocket.receiverLimit())
     if err != nil {
-	log.Println(err)
-	ws.Close()
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
 	return
     }
-    log.Println("Receiver connecting...")
-    _, p, err := ws.ReadMessage()
+    p, err := readWireMessage(ws, hub.config().WebSocket.receiverLimit())
     if err != nil {
-	log.Println("Error: ", err)
+	requestLogger(r).Warn("Reading receiver auth message failed", "error", err)
 	ws.Close()
 	return
     }
 
-    log.Println("Receiver auth: ", string(p))
-
     var msg ReceiverInbound
     err = json.Unmarshal(p, &msg)
     if err != nil {
@@ -130,7 +422,7 @@ func (hub *Hub) HandlerReceiver(w http.ResponseWriter, r *http.Request) {
 	    return
 	}
     }else {
-	log.Println("Reciever name is nil")
+	requestLogger(r).Warn("Receiver name missing")
 	return
     }
 
@@ -138,7 +430,8 @@ func (hub *Hub) HandlerReceiver(w http.ResponseWriter, r *http.Request) {
 	name: msg.ReceiverName,
 	conn: ws,
 	hub: hub,
-	egress: make(chan []byte),
+	log: requestLogger(r).With("receiver", msg.ReceiverName),
+	egress: make(chan []byte, egressBuffer),
     }
 
     hub.receivers[receiver.name] = receiver
@@ -0,0 +1,261 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/go-chi/chi/v5/middleware"
+)
+
+// logLevel is shared by every handler so a reload can change it without
+// rebuilding the logger.
+var logLevel = new(slog.LevelVar)
+
+var logLevels = map[string]slog.Level{
+    "debug": slog.LevelDebug,
+    "info": slog.LevelInfo,
+    "warn": slog.LevelWarn,
+    "error": slog.LevelError,
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+    if name == "" {
+	return slog.LevelInfo, nil
+    }
+    level, ok := logLevels[strings.ToLower(name)]
+    if !ok {
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+    }
+    return level, nil
+}
+
+// secretKeys are attribute and query parameter names whose values are never
+// logged.
+var secretKeys = map[string]bool{
+    "password": true,
+    "token": true,
+    "session_token": true,
+    "secret": true,
+    "authorization": true,
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+    if secretKeys[strings.ToLower(a.Key)] {
+	return slog.String(a.Key, redacted)
+    }
+    return a
+}
+
+// newLogHandler writes "text" or "json" records to w, hiding secrets.
+func newLogHandler(w io.Writer, format string) slog.Handler {
+    opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactAttr}
+    if format == "json" {
+	return slog.NewJSONHandler(w, opts)
+    }
+    return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging points the default logger, and the log package, at the
+// configured file or stderr. The returned closer closes the file.
+func setupLogging(config ServerConfig, stderr io.Writer) (io.Closer, error) {
+    level, err := parseLogLevel(config.LogLevel)
+    if err != nil {
+	return nil, err
+    }
+    logLevel.Set(level)
+    var w io.Writer = stderr
+    var closer io.Closer = io.NopCloser(nil)
+    if config.LogFile != "" {
+	file, err := openLogFile(config.LogFile, int64(config.LogMaxSize) << 20, config.logMaxAge(), config.LogMaxBackups)
+	if err != nil {
+	    return nil, err
+	}
+	w, closer = file, file
+    }
+    slog.SetDefault(slog.New(newLogHandler(w, config.LogFormat)))
+    return closer, nil
+}
+
+func (c ServerConfig) logMaxAge() time.Duration {
+    d, _ := time.ParseDuration(c.LogMaxAge)
+    return d
+}
+
+// requestLogger tags the default logger with the request's id, so lines
+// logged for a connection can be tied back to the request that opened it.
+func requestLogger(r *http.Request) *slog.Logger {
+    return slog.Default().With("request_id", middleware.GetReqID(r.Context()))
+}
+
+// redactURL renders u's path and query with secret parameters hidden.
+func redactURL(u *url.URL) string {
+    if u.RawQuery == "" {
+	return u.Path
+    }
+    query := u.Query()
+    for key := range query {
+	if secretKeys[strings.ToLower(key)] {
+	    query[key] = []string{redacted}
+	}
+    }
+    return u.Path + "?" + strings.ReplaceAll(query.Encode(), url.QueryEscape(redacted), redacted)
+}
+
+// logRequests logs each request once it completes. It replaces chi's
+// middleware.Logger, which logs full URLs including session tokens.
+func logRequests(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	start := time.Now()
+	defer func() {
+	    requestLogger(r).Info("Request",
+		"method", r.Method,
+		"path", redactURL(r.URL),
+		"status", ww.Status(),
+		"bytes", ww.BytesWritten(),
+		"duration", time.Since(start),
+		"remote_addr", r.RemoteAddr,
+	    )
+	}()
+	next.ServeHTTP(ww, r)
+    })
+}
+
+// backupLayout is the timestamp suffix of rotated log files.
+const backupLayout = "20060102-150405.000"
+
+// rotateRetry is how long a failed rotation waits before it is tried again;
+// until then the current file keeps growing.
+const rotateRetry = time.Minute
+
+// rotatingFile is a log file that is appended to, and moved aside to
+// path.<timestamp> once it passes maxSize bytes or is older than maxAge.
+// Zero disables either limit. Only the newest maxBackups old files
+// are kept; zero keeps them all.
+type rotatingFile struct {
+    path         string
+    maxSize      int64
+    maxAge       time.Duration
+    maxBackups   int
+    mu           sync.Mutex
+    file         *os.File
+    size         int64
+    // started is when the current file was begun, which can be before
+    // this process opened it.
+    started      time.Time
+    // rotateFailed holds off retrying a rotation that failed.
+    rotateFailed time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+    f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+    err := f.open()
+    if err != nil {
+	return nil, err
+    }
+    return f, nil
+}
+
+func (f *rotatingFile) open() error {
+    file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+	return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+	file.Close()
+	return err
+    }
+    f.file = file
+    f.size = info.Size()
+    f.started = f.startedAt(info)
+    return nil
+}
+
+// startedAt works out when the log file was begun, so that max age holds
+// across restarts. A file made by rotation began when the newest backup was
+// moved aside; failing that, its modification time is the best estimate.
+func (f *rotatingFile) startedAt(info os.FileInfo) time.Time {
+    if info.Size() == 0 {
+	return time.Now()
+    }
+    backups := f.backups()
+    if len(backups) > 0 {
+	suffix := strings.TrimPrefix(backups[len(backups)-1], f.path + ".")
+	if t, err := time.ParseInLocation(backupLayout, suffix, time.Local); err == nil {
+	    return t
+	}
+    }
+    return info.ModTime()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    full := f.maxSize > 0 && f.size > 0 && f.size + int64(len(p)) > f.maxSize
+    old := f.maxAge > 0 && time.Since(f.started) >= f.maxAge
+    if (full || old) && time.Since(f.rotateFailed) >= rotateRetry {
+	err := f.rotate()
+	if err != nil {
+	    // Logging cannot report its own failure, and losing the log
+	    // is worse than letting it grow.
+	    f.rotateFailed = time.Now()
+	    fmt.Fprintf(os.Stderr, "Rotating log file %s failed: %v\n", f.path, err)
+	}
+    }
+    n, err := f.file.Write(p)
+    f.size += int64(n)
+    return n, err
+}
+
+// rotate moves the current file aside and starts a new one. The old file
+// stays open until the new one is, so a failure leaves logging on the file
+// it was already writing.
+func (f *rotatingFile) rotate() error {
+    err := os.Rename(f.path, f.path + "." + time.Now().Format(backupLayout))
+    if err != nil {
+	return err
+    }
+    old := f.file
+    err = f.open()
+    if err != nil {
+	return err
+    }
+    old.Close()
+    f.prune()
+    return nil
+}
+
+func (f *rotatingFile) backups() []string {
+    backups, _ := filepath.Glob(f.path + ".*")
+    sort.Strings(backups)
+    return backups
+}
+
+// prune removes the oldest backups past maxBackups. Timestamps sort in the
+// order the files were rotated.
+func (f *rotatingFile) prune() {
+    if f.maxBackups <= 0 {
+	return
+    }
+    backups := f.backups()
+    for len(backups) > f.maxBackups {
+	os.Remove(backups[0])
+	backups = backups[1:]
+    }
+}
+
+func (f *rotatingFile) Close() error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.file.Close()
+}
@@ -1,75 +1,76 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	dotenv "github.com/joho/godotenv"
-	"github.com/pelletier/go-toml/v2"
 )
 
+// Config is read from TOML. Every Server and WebSocket setting can also be
+// set by the environment or a flag; see ConfigSource.
 type Config struct {
     Server      ServerConfig
+    WebSocket   WebSocketConfig `toml:"websocket,omitempty"`
+    Hooks       []HookConfig    `toml:"hooks,omitempty"`
+    Webhooks    []WebhookConfig `toml:"webhooks,omitempty"`
 }
 type ServerConfig struct {
-    AuthType    string  `toml:"auth_type"`
-    Email       string  `toml:"email,omitempty"`
-    Password    string  `toml:"password"`
+    AuthType        string      `toml:"auth_type"`
+    Email           string      `toml:"email,omitempty"`
+    Password        string      `toml:"password"`
+    DataDir         string      `toml:"data_dir,omitempty"`
+    AllowedOrigins  []string    `toml:"allowed_origins,omitempty"`
+    Listen          string      `toml:"listen,omitempty"`
+    // TLSCert and TLSKey serve HTTPS when both are set.
+    TLSCert         string      `toml:"tls_cert,omitempty"`
+    TLSKey          string      `toml:"tls_key,omitempty"`
+    LogFile         string      `toml:"log_file,omitempty"`
+    LogLevel        string      `toml:"log_level,omitempty"`
+    // LogFormat is "text" or "json".
+    LogFormat       string      `toml:"log_format,omitempty"`
+    // LogMaxSize (in megabytes) and LogMaxAge rotate the log file;
+    // LogMaxBackups is how many rotated files to keep.
+    LogMaxSize      int         `toml:"log_max_size,omitempty"`
+    LogMaxAge       string      `toml:"log_max_age,omitempty"`
+    LogMaxBackups   int         `toml:"log_max_backups,omitempty"`
+    // ControlSocket is the admin socket used by `macron-server ctl`.
+    ControlSocket   string      `toml:"control_socket,omitempty"`
+    // ShutdownTimeout bounds how long a shutdown waits for in-flight execs.
+    ShutdownTimeout string      `toml:"shutdown_timeout,omitempty"`
+    // RestartHint tells peers how soon the server expects to be back.
+    RestartHint     string      `toml:"restart_hint,omitempty"`
+    // MetricsToken, when set, must be sent as a bearer token to read
+    // /metrics.
+    MetricsToken    string      `toml:"metrics_token,omitempty"`
+    // TrustedProxies are the addresses or CIDR ranges whose
+    // X-Forwarded-Proto header is believed.
+    TrustedProxies  []string    `toml:"trusted_proxies,omitempty"`
+    // InsecureCookies lets session cookies be sent over plain HTTP, for
+    // deployments without TLS. Otherwise they are always Secure.
+    InsecureCookies bool        `toml:"insecure_cookies,omitempty"`
 }
 
 
 func parseConfig(dir string) (*Config, error) {
     configBytes, err := os.ReadFile(dir)
     if err != nil {
-        log.Printf("Error: %v", err)
         return nil, err
     }
-    var cfg Config
-    err = toml.Unmarshal(configBytes, &cfg)
-    if err != nil {
-        log.Printf("Error: %v", err)
-        return nil, err
-    }
-
-    return &cfg, nil
+    return decodeConfig(dir, configBytes)
 }
 
 func main() {
-    args := os.Args[1:]
-    
-
-    err := dotenv.Load()
-    if err != nil {
-        log.Fatal("Could not load environment")
-    }
-
-
-    logDir := os.Getenv("MACRON_LOG")
-    if logDir == "" {
-        log.Fatal("Could not find log file directory in env: MACRON_LOG is empty")
-    }
-
-    logfile, err := os.Create(logDir)
-
-    if err != nil {
-        log.Fatal(err)
-    }
-    defer logfile.Close()
-
-    log.SetOutput(logfile)
-
-
-    switch len(args) {
-    case 0:
-        startServer()
-    default:
-        os.Exit(0)
-    }
+    os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
 
 func (hub *Hub) HandlerInfo(w http.ResponseWriter, r *http.Request) {
@@ -79,13 +80,13 @@ func (hub *Hub) HandlerInfo(w http.ResponseWriter, r *http.Request) {
     }
     msg := InfoResponse {
         Type: "info",
-        AuthType: hub.config.Server.AuthType,
+        AuthType: hub.config().Server.AuthType,
     }
     bytes, err := json.Marshal(msg)
     if err != nil {
         w.WriteHeader(500)
         w.Write([]byte("Internal Error"))
-        log.Printf("Error marshalling json: %v", err)
+        slog.Error("Marshalling JSON failed", "error", err)
     }
     w.Header().Add("Content-Type", "application/json")
     w.WriteHeader(200)
@@ -95,13 +96,15 @@ func (hub *Hub) HandlerInfo(w http.ResponseWriter, r *http.Request) {
 func setupRoutes(hub *Hub) chi.Router {
     router := chi.NewRouter()
     router.Use(middleware.RequestID)
+    router.Use(keepPeerAddr)
     router.Use(middleware.RealIP)
-    router.Use(middleware.Logger)
+    router.Use(logRequests)
     router.Use(middleware.Recoverer)
+    router.Use(hub.CORS)
     v1Router := chi.NewRouter()
     wsRouter := chi.NewRouter()
     
-    if hub.config.Server.AuthType == "password" {
+    if hub.config().Server.AuthType == "password" {
         wsRouter.Get("/client", hub.HandlerClientPassword)
         wsRouter.Get("/receiver", hub.HandlerReceiverPassword)
     } else {
@@ -111,62 +114,152 @@ func setupRoutes(hub *Hub) chi.Router {
 
     v2Router := chi.NewRouter()
     v2Router.Post("/login", hub.LoginHandler)
+    v2Router.Post("/logout", hub.LogoutHandler)
+    v2Router.Get("/openapi.json", HandlerOpenAPI)
     v2Router.Get("/client", hub.ClientHandler)
     v2Router.Get("/receiver", hub.ReceiverHandler)
+    v2Router.Route("/schedules", func(r chi.Router) {
+        r.Use(hub.SessionAuth)
+        r.Get("/", hub.HandlerListSchedules)
+        r.Post("/", hub.HandlerCreateSchedule)
+        r.Get("/{id}", hub.HandlerGetSchedule)
+        r.Put("/{id}", hub.HandlerUpdateSchedule)
+        r.Delete("/{id}", hub.HandlerDeleteSchedule)
+    })
+    v2Router.Route("/workflows", func(r chi.Router) {
+        r.Use(hub.SessionAuth)
+        r.Get("/", hub.HandlerListWorkflows)
+        r.Post("/{name}/runs", hub.HandlerRunWorkflow)
+        r.Get("/runs/{id}", hub.HandlerGetWorkflowRun)
+    })
 
     v1Router.Mount("/ws", wsRouter)
     router.Mount("/v1", v1Router)
+    v2Router.Route("/receivers", func(r chi.Router) {
+        r.Use(hub.SessionAuth)
+        r.Get("/", hub.HandlerListReceivers)
+        r.Get("/{name}/functions", hub.HandlerListFunctions)
+        r.Post("/{name}/functions/{id}/exec", hub.HandlerExecFunction)
+    })
+    v2Router.Post("/hooks/{id}", hub.HandlerHook)
+    v2Router.With(hub.SessionAuth).Get("/events", hub.HandlerEvents)
+    v2Router.With(hub.SessionAuth).Get("/sessions", hub.HandlerListSessions)
+
     router.Mount("/v2", v2Router)
+
+    v3Router := chi.NewRouter()
+    v3Router.Get("/ws", hub.HandlerV3)
+    v3Router.With(hub.SessionAuth).Get("/rpc", hub.HandlerRPCSocket)
+    v3Router.With(hub.SessionAuth).Post("/rpc", hub.HandlerRPC)
+    router.Mount("/v3", v3Router)
     router.Get("/info", hub.HandlerInfo)
+    router.Get("/metrics", hub.HandlerMetrics)
+    router.Get("/healthz", hub.HandlerHealthz)
+    router.Get("/readyz", hub.HandlerReadyz)
 
     fs := http.FileServer(http.Dir("./static/"))
     router.Handle("/static/*", http.StripPrefix("/static/", fs))
+    router.Get("/dashboard", hub.HandlerDashboard)
     router.HandleFunc("/", indexHandler)
     
     return router
 }
 
-func startServer() {
-    println("Starting Macron Server...")
-    log.Println("Starting Macron Server...")
+// startServer runs until a signal shuts it down, or returns the error that
+// stopped it from listening.
+func startServer(config *Config, source ConfigSource) error {
+    slog.Info("Starting Macron Server", "listen", config.Server.Listen, "version", version)
 
-    home := os.Getenv("HOME")
-    cfgDir := filepath.Join(home, "/.config/macron-server/config.toml")
+    hub := NewHub(config)
+    err := hub.scheduler.Load()
+    if err != nil {
+        slog.Error("Loading schedules failed", "error", err)
+    }
+    go hub.scheduler.Run()
+    go hub.webhooks.Run()
+    watcher := NewConfigWatcher(hub, source)
+    go watcher.Run()
+    control, controlErr := ListenControl(hub, config.Server.ControlSocket, source)
+    if controlErr != nil {
+        slog.Warn("Control socket disabled", "error", controlErr)
+    } else {
+        go control.Serve()
+    }
+
+    router := setupRoutes(hub)
 
-    config, err := parseConfig(cfgDir)
+    server := http.Server{
+        Handler: router,
+        Addr: config.Server.Listen,
+    }
 
-    switch config.Server.AuthType {
-    case "password":
-        if config.Server.Password == "" {
-            println("AuthType is 'password' but password is not configured.")
-            os.Exit(1)
+    listener, err := net.Listen("tcp", config.Server.Listen)
+    if err != nil {
+        watcher.Stop()
+        if control != nil {
+            control.Close()
         }
+        return err
     }
+    serveErr := make(chan error, 1)
+    go func() {
+        if config.Server.TLSCert != "" {
+            serveErr <- server.ServeTLS(listener, config.Server.TLSCert, config.Server.TLSKey)
+        } else {
+            serveErr <- server.Serve(listener)
+        }
+    }()
+
+    // Tell systemd we are up once the listener is bound, and keep its
+    // watchdog fed when it asks for one.
+    err = sdNotify("READY=1")
     if err != nil {
-        log.Printf("Error parsing config: %v", err)
+        slog.Warn("Notifying service manager failed", "error", err)
     }
-    portString := os.Getenv("PORT")
-    if portString == "" {
-        log.Fatal("PORT not found in the environment")
+    stopWatchdog := make(chan struct{})
+    if interval := watchdogInterval(); interval > 0 {
+        go hub.runWatchdog(interval, stopWatchdog)
     }
 
-    hub := Hub{
-        make(map[string]*Session),
-        make(map[string]*Client),
-        make(map[string]*Receiver),
-        config,
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    err = nil
+    select {
+    case err = <-serveErr:
+    case sig := <-signals:
+        signal.Stop(signals)
+        sdNotify("STOPPING=1")
+        shutdownServer(&server, hub, sig.String())
+    }
+    close(stopWatchdog)
+    watcher.Stop()
+    if control != nil {
+        control.Close()
     }
+    return err
+}
 
-    router := setupRoutes(&hub)
+// shutdownServer stops accepting connections, then drains the hub. HTTP requests
+// waiting on execs get a little longer than the hub so they can answer with
+// the final result.
+func shutdownServer(server *http.Server, hub *Hub, reason string) {
+    timeout := hub.config().Server.shutdownTimeout()
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    httpCtx, httpCancel := context.WithTimeout(context.Background(), timeout + 5 * time.Second)
+    defer httpCancel()
 
-    server := http.Server{
-        Handler: router,
-        Addr: ":" + portString,
+    httpDone := make(chan error, 1)
+    go func() {
+        httpDone <- server.Shutdown(httpCtx)
+    }()
+    err := hub.Shutdown(ctx, reason)
+    if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+        slog.Error("Shutting down hub failed", "error", err)
     }
-
-    err = server.ListenAndServe()
-    //err = server.ListenAndServeTLS("server.crt", "server.key")
+    err = <-httpDone
     if err != nil {
-        log.Fatal(err)
+        slog.Error("Shutting down HTTP server failed", "error", err)
     }
+    slog.Info("Macron Server stopped")
 }
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/gorilla/websocket"
@@ -13,14 +13,37 @@ type ClientInbound struct {
     Password	    string  `json:"password"`
     ReceiverName    string  `json:"receiver_name,omitempty"`
     FunctionId	    *int    `json:"function_id,omitempty"`
+    FunctionName    string  `json:"function_name,omitempty"`
+    FunctionKey	    string  `json:"function_key,omitempty"`
+    FunctionVersion string  `json:"function_version,omitempty"`
+    Args	    map[string]interface{}  `json:"args,omitempty"`
+    Selector	    string  `json:"selector,omitempty"`
+    ScheduleId	    string  `json:"schedule_id,omitempty"`
+    Enabled	    *bool   `json:"enabled,omitempty"`
+    WorkflowName    string  `json:"workflow_name,omitempty"`
+    Limit	    int	    `json:"limit,omitempty"`
 }
 
 type ClientResponse struct {
     Type	    string		`json:"type"`
     Error	    string		`json:"error,omitempty"`
+    Code	    string		`json:"code,omitempty"`
+    ExecId	    string		`json:"exec_id,omitempty"`
     ReceiverName    string		`json:"receiver_name,omitempty"`
     Receivers	    *[]string		`json:"receivers,omitempty"`
     Functions	    *[]MacronFunction   `json:"functions,omitempty"`
+    Selector	    string		`json:"selector,omitempty"`
+    Result	    *ExecResult		`json:"result,omitempty"`
+    Results	    *[]ExecResult	`json:"results,omitempty"`
+    Schedule	    *Schedule		`json:"schedule,omitempty"`
+    Schedules	    *[]Schedule		`json:"schedules,omitempty"`
+    Workflows	    *[]Workflow		`json:"workflows,omitempty"`
+    WorkflowRun	    *WorkflowRun	`json:"workflow_run,omitempty"`
+    Sessions	    *[]SessionInfo	`json:"sessions,omitempty"`
+    History	    *[]ExecRecord	`json:"history,omitempty"`
+    Reason	    string		`json:"reason,omitempty"`
+    // RestartIn is how many seconds a server_shutdown expects to be down.
+    RestartIn	    int			`json:"restart_in,omitempty"`
 }
 
 type ReceiverInbound struct {
@@ -28,21 +51,33 @@ type ReceiverInbound struct {
     ClientId	    string		`json:"client_id,omitempty"`
     Password	    string  		`json:"password,omitempty"`
     ReceiverName    string  		`json:"receiver_name"`
+    Tags	    []string		`json:"tags,omitempty"`
+    Group	    string		`json:"group,omitempty"`
     Functions	    *[]MacronFunction	`json:"functions,omitempty"`
+    ExecId	    string		`json:"exec_id,omitempty"`
+    Status	    string		`json:"status,omitempty"`
+    Output	    string		`json:"output,omitempty"`
+    Error	    string		`json:"error,omitempty"`
 }
 
 type ReceiverResponse struct {
     Type	string	`json:"type"`
     ClientId	string	`json:"client_id,omitempty"`
     Id		*int	`json:"id,omitempty"`
+    Key		string	`json:"key,omitempty"`
+    ExecId	string	`json:"exec_id,omitempty"`
+    Args	map[string]interface{}	`json:"args,omitempty"`
+    Code	string	`json:"code,omitempty"`
     Error	string	`json:"error,omitempty"`
+    Reason	string	`json:"reason,omitempty"`
+    RestartIn	int	`json:"restart_in,omitempty"`
 }
 
 
 func sendJsonWs(ws *websocket.Conn, payload interface{}) {
-    err := ws.WriteJSON(payload)
+    err := writeWire(ws, payload)
     if err != nil {
-	log.Printf("Failed to marshal JSON response: %v", payload)
+	slog.Warn("Writing WebSocket message failed", "error", err)
 	ws.Close()
 	return
     }
@@ -53,10 +88,22 @@ func sendErrorReceiverWs(ws *websocket.Conn, error string) {
 	Type: "error",
 	Error: error,
     }
-    err := ws.WriteJSON(msg)
+    err := writeWire(ws, msg)
+    if err != nil {
+	slog.Warn("Writing WebSocket error failed", "error", err)
+    }
+}
+
+func writeJSON(w http.ResponseWriter, code int, payload interface{}) {
+    bytes, err := json.Marshal(payload)
     if err != nil {
-	log.Printf("Failed to marshal Error response: %v", msg)
+	slog.Error("Marshalling JSON failed", "error", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	return
     }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    w.Write(bytes)
 }
 
 func writeClientResponse(w http.ResponseWriter, code int, msgType string, msg string) {
@@ -76,7 +123,7 @@ func (hub *Hub) wsWriteClientResponse(ws *websocket.Conn, msgType string, receiv
 	    Type: msgType,
 	    Error: error,
 	}
-	ws.WriteJSON(response)
+	writeWire(ws, response)
 	ws.WriteMessage(websocket.CloseAbnormalClosure, []byte(""))
 	ws.Close()
     } else {
@@ -84,7 +131,7 @@ func (hub *Hub) wsWriteClientResponse(ws *websocket.Conn, msgType string, receiv
 	    Type: msgType,
 	    Receivers: receivers,
 	}
-	ws.WriteJSON(response)
+	writeWire(ws, response)
     }
 }
 
@@ -94,13 +141,13 @@ func (hub *Hub) wsWriteReceiverResponse(ws *websocket.Conn, msgType string, erro
 	    Type: msgType,
 	    Error: error,
 	}
-	ws.WriteJSON(response)
+	writeWire(ws, response)
 	ws.WriteMessage(websocket.CloseAbnormalClosure, []byte(""))
 	ws.Close()
     } else {
 	response := ReceiverResponse {
 	    Type: msgType,
 	}
-	ws.WriteJSON(response)
+	writeWire(ws, response)
     }
 }
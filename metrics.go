@@ -0,0 +1,285 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// execBuckets are the upper bounds, in seconds, of the exec duration
+// histogram.
+var execBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Message types a peer can send. Anything else is counted as "unknown" so
+// a misbehaving peer cannot create unbounded series.
+var inboundTypes = map[string]map[string]bool{
+    "client": {
+	"receivers": true, "functions": true, "exec": true, "schedules": true, "schedule_toggle": true,
+	"workflows": true, "run_workflow": true, "broadcast_exec": true, "history": true,
+    },
+    "receiver": {
+	"functions": true, "exec_result": true,
+    },
+}
+
+var execStatuses = map[string]bool{
+    "success": true, "error": true, "timeout": true, "offline": true, "canceled": true, "shutdown": true,
+}
+
+// Metrics counts what the hub does, for /metrics in the Prometheus text
+// format. There are few enough series to keep them in maps rather than
+// pull in a client library.
+type Metrics struct {
+    mu          sync.Mutex
+    logins      map[string]uint64
+    messages    map[messageKey]uint64
+    writeErrors map[string]uint64
+    execs       map[execKey]*execStats
+}
+
+type messageKey struct {
+    peer        string
+    direction   string
+    msgType     string
+}
+
+type execKey struct {
+    receiver    string
+    function    string
+}
+
+type execStats struct {
+    statuses    map[string]uint64
+    // buckets counts durations up to each of execBuckets; the last entry
+    // is +Inf.
+    buckets     []uint64
+    sum         float64
+    count       uint64
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{
+	logins: make(map[string]uint64),
+	messages: make(map[messageKey]uint64),
+	writeErrors: make(map[string]uint64),
+	execs: make(map[execKey]*execStats),
+    }
+}
+
+// login counts a credential check; result is "success" or "failure".
+func (m *Metrics) login(result string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.logins[result]++
+}
+
+// messageIn counts a message read from a peer, which is "client" or
+// "receiver".
+func (m *Metrics) messageIn(peer string, msgType string) {
+    if !inboundTypes[peer][msgType] {
+	msgType = "unknown"
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.messages[messageKey{peer, "in", msgType}]++
+}
+
+// messageOut counts a message written to a peer, and a write error if err
+// is set.
+func (m *Metrics) messageOut(peer string, msgType string, err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.messages[messageKey{peer, "out", msgType}]++
+    if err != nil {
+	m.writeErrors[peer]++
+    }
+}
+
+func (m *Metrics) exec(receiver string, function string, status string, d time.Duration) {
+    if !execStatuses[status] {
+	status = "other"
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := execKey{receiver, function}
+    stats := m.execs[key]
+    if stats == nil {
+	stats = &execStats{statuses: make(map[string]uint64), buckets: make([]uint64, len(execBuckets) + 1)}
+	m.execs[key] = stats
+    }
+    stats.statuses[status]++
+    seconds := d.Seconds()
+    i := sort.SearchFloat64s(execBuckets, seconds)
+    stats.buckets[i]++
+    stats.sum += seconds
+    stats.count++
+}
+
+// responseType reads the type of a message about to be written.
+func responseType(v interface{}) string {
+    switch v := v.(type) {
+    case ClientResponse:
+	return v.Type
+    case *ClientResponse:
+	return v.Type
+    case ReceiverResponse:
+	return v.Type
+    case *ReceiverResponse:
+	return v.Type
+    }
+    return "other"
+}
+
+// messageType reads the type of an encoded JSON message.
+func messageType(message []byte) string {
+    var typed struct {
+	Type    string  `json:"type"`
+    }
+    if json.Unmarshal(message, &typed) != nil || typed.Type == "" {
+	return "other"
+    }
+    return typed.Type
+}
+
+// functionLabel names a function by key, falling back to its name for
+// receivers that do not send keys.
+func functionLabel(fn MacronFunction) string {
+    if fn.Key != "" {
+	return fn.Key
+    }
+    return fn.Name
+}
+
+// HandlerMetrics serves the metrics. With server.metrics_token set, the
+// scraper must send it as a bearer token.
+func (hub *Hub) HandlerMetrics(w http.ResponseWriter, r *http.Request) {
+    token := hub.config().Server.MetricsToken
+    if token != "" && subtle.ConstantTimeCompare([]byte(sessionToken(r)), []byte(token)) != 1 {
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    hub.writeMetrics(w)
+}
+
+func (hub *Hub) writeMetrics(w io.Writer) {
+    hub.mu.Lock()
+    sessions := 0
+    for _, session := range hub.sessions {
+	if !session.isExpired() {
+	    sessions++
+	}
+    }
+    clients, receivers, execs := len(hub.clients), len(hub.receivers), len(hub.execs)
+    clientQueue, receiverQueue := 0, 0
+    for _, c := range hub.clients {
+	clientQueue += len(c.egress)
+    }
+    for _, r := range hub.receivers {
+	receiverQueue += len(r.egress)
+    }
+    hub.mu.Unlock()
+
+    gauge(w, "macron_clients", "Connected clients.", clients)
+    gauge(w, "macron_receivers", "Connected receivers.", receivers)
+    gauge(w, "macron_sessions", "Unexpired sessions.", sessions)
+    gauge(w, "macron_pending_execs", "Execs waiting on a receiver.", execs)
+    header(w, "macron_egress_queue", "Messages queued for a connection's writer, by peer.", "gauge")
+    fmt.Fprintf(w, "macron_egress_queue{peer=\"client\"} %d\n", clientQueue)
+    fmt.Fprintf(w, "macron_egress_queue{peer=\"receiver\"} %d\n", receiverQueue)
+    gauge(w, "macron_webhook_deliveries", "Webhook deliveries in flight, including retries.", hub.webhooks.inFlight.Load())
+    gauge(w, "macron_event_backlog", "Events queued for subscribers.", hub.events.backlog())
+
+    m := hub.metrics
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    header(w, "macron_logins_total", "Credential checks by result.", "counter")
+    for _, result := range sortedKeys(m.logins) {
+	fmt.Fprintf(w, "macron_logins_total{result=%s} %d\n", quoteLabel(result), m.logins[result])
+    }
+
+    header(w, "macron_messages_total", "WebSocket messages by peer, direction and type.", "counter")
+    keys := make([]messageKey, 0, len(m.messages))
+    for key := range m.messages {
+	keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+	a, b := keys[i], keys[j]
+	return a.peer + a.direction + a.msgType < b.peer + b.direction + b.msgType
+    })
+    for _, key := range keys {
+	fmt.Fprintf(w, "macron_messages_total{peer=%s,direction=%s,type=%s} %d\n",
+	    quoteLabel(key.peer), quoteLabel(key.direction), quoteLabel(key.msgType), m.messages[key])
+    }
+
+    header(w, "macron_websocket_write_errors_total", "Failed WebSocket writes by peer.", "counter")
+    for _, peer := range sortedKeys(m.writeErrors) {
+	fmt.Fprintf(w, "macron_websocket_write_errors_total{peer=%s} %d\n", quoteLabel(peer), m.writeErrors[peer])
+    }
+
+    execKeys := make([]execKey, 0, len(m.execs))
+    for key := range m.execs {
+	execKeys = append(execKeys, key)
+    }
+    sort.Slice(execKeys, func(i, j int) bool {
+	if execKeys[i].receiver != execKeys[j].receiver {
+	    return execKeys[i].receiver < execKeys[j].receiver
+	}
+	return execKeys[i].function < execKeys[j].function
+    })
+    header(w, "macron_execs_total", "Finished execs by receiver, function and status.", "counter")
+    for _, key := range execKeys {
+	labels := fmt.Sprintf("receiver=%s,function=%s", quoteLabel(key.receiver), quoteLabel(key.function))
+	stats := m.execs[key]
+	for _, status := range sortedKeys(stats.statuses) {
+	    fmt.Fprintf(w, "macron_execs_total{%s,status=%s} %d\n", labels, quoteLabel(status), stats.statuses[status])
+	}
+    }
+    header(w, "macron_exec_duration_seconds", "Time from starting an exec to its result.", "histogram")
+    for _, key := range execKeys {
+	labels := fmt.Sprintf("receiver=%s,function=%s", quoteLabel(key.receiver), quoteLabel(key.function))
+	stats := m.execs[key]
+	cumulative := uint64(0)
+	for i, count := range stats.buckets {
+	    cumulative += count
+	    le := "+Inf"
+	    if i < len(execBuckets) {
+		le = fmt.Sprint(execBuckets[i])
+	    }
+	    fmt.Fprintf(w, "macron_exec_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "macron_exec_duration_seconds_sum{%s} %g\n", labels, stats.sum)
+	fmt.Fprintf(w, "macron_exec_duration_seconds_count{%s} %d\n", labels, stats.count)
+    }
+}
+
+func header(w io.Writer, name string, help string, kind string) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func gauge[T int | int64](w io.Writer, name string, help string, value T) {
+    header(w, name, help, "gauge")
+    fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+	keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+    return `"` + labelEscaper.Replace(value) + `"`
+}
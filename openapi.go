@@ -0,0 +1,18 @@
+package main
+
+import (
+    _ "embed"
+    "net/http"
+)
+
+// openapiSpec documents the HTTP routes from setupRoutes and, under
+// components.schemas, every WebSocket message keyed as "<Struct>.<type>".
+//
+//go:embed api/openapi.json
+var openapiSpec []byte
+
+func HandlerOpenAPI(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    w.Write(openapiSpec)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// schemaValidator checks decoded JSON against the subset of JSON Schema
+// used in api/openapi.json.
+type schemaValidator struct {
+    spec    map[string]interface{}
+}
+
+func newSchemaValidator(t *testing.T) *schemaValidator {
+    var spec map[string]interface{}
+    err := json.Unmarshal(openapiSpec, &spec)
+    if err != nil {
+	t.Fatalf("Error parsing openapi.json: %v", err)
+    }
+    return &schemaValidator{spec: spec}
+}
+
+func (v *schemaValidator) resolve(ref string) map[string]interface{} {
+    var node interface{} = v.spec
+    for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+	m, _ := node.(map[string]interface{})
+	node = m[part]
+    }
+    schema, _ := node.(map[string]interface{})
+    return schema
+}
+
+func jsonTypeMatches(t string, value interface{}) bool {
+    switch t {
+    case "null":
+	return value == nil
+    case "boolean":
+	_, ok := value.(bool)
+	return ok
+    case "string":
+	_, ok := value.(string)
+	return ok
+    case "number":
+	_, ok := value.(float64)
+	return ok
+    case "integer":
+	n, ok := value.(float64)
+	return ok && n == math.Trunc(n)
+    case "array":
+	_, ok := value.([]interface{})
+	return ok
+    case "object":
+	_, ok := value.(map[string]interface{})
+	return ok
+    }
+    return false
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string) error {
+    if schema == nil {
+	return fmt.Errorf("%s: unresolved schema", path)
+    }
+    if ref, ok := schema["$ref"].(string); ok {
+	return v.validate(v.resolve(ref), value, path)
+    }
+    if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+	return fmt.Errorf("%s: got=%v, expected const %v", path, value, c)
+    }
+    if enum, ok := schema["enum"].([]interface{}); ok {
+	found := false
+	for _, e := range enum {
+	    found = found || reflect.DeepEqual(e, value)
+	}
+	if !found {
+	    return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+	}
+    }
+    switch t := schema["type"].(type) {
+    case string:
+	if !jsonTypeMatches(t, value) {
+	    return fmt.Errorf("%s: %v is not of type %s", path, value, t)
+	}
+    case []interface{}:
+	found := false
+	for _, option := range t {
+	    found = found || jsonTypeMatches(option.(string), value)
+	}
+	if !found {
+	    return fmt.Errorf("%s: %v is not of type %v", path, value, t)
+	}
+    }
+    for _, key := range []string{"oneOf", "anyOf"} {
+	options, ok := schema[key].([]interface{})
+	if !ok {
+	    continue
+	}
+	matches := 0
+	errs := make([]string, 0)
+	for _, option := range options {
+	    err := v.validate(option.(map[string]interface{}), value, path)
+	    if err == nil {
+		matches++
+	    } else {
+		errs = append(errs, err.Error())
+	    }
+	}
+	if matches == 0 || (key == "oneOf" && matches > 1) {
+	    return fmt.Errorf("%s: %d %s matches: %s", path, matches, key, strings.Join(errs, "; "))
+	}
+    }
+
+    if object, ok := value.(map[string]interface{}); ok {
+	properties, _ := schema["properties"].(map[string]interface{})
+	if required, ok := schema["required"].([]interface{}); ok {
+	    for _, name := range required {
+		if _, ok := object[name.(string)]; !ok {
+		    return fmt.Errorf("%s: missing required property %s", path, name)
+		}
+	    }
+	}
+	for name, field := range object {
+	    propSchema, ok := properties[name].(map[string]interface{})
+	    if !ok {
+		if schema["additionalProperties"] == false {
+		    return fmt.Errorf("%s: unexpected property %s", path, name)
+		}
+		continue
+	    }
+	    err := v.validate(propSchema, field, path + "." + name)
+	    if err != nil {
+		return err
+	    }
+	}
+    }
+    if array, ok := value.([]interface{}); ok {
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+	    for i, item := range array {
+		err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+		    return err
+		}
+	    }
+	}
+    }
+    return nil
+}
+
+func (v *schemaValidator) check(t *testing.T, ref string, raw []byte) map[string]interface{} {
+    var value map[string]interface{}
+    err := json.Unmarshal(raw, &value)
+    if err != nil {
+	t.Errorf("%s: invalid JSON %s", ref, raw)
+	return nil
+    }
+    err = v.validate(v.resolve(ref), value, ref)
+    if err != nil {
+	t.Errorf("%s: %v\nmessage: %s", ref, err, raw)
+    }
+    return value
+}
+
+func TestOpenAPIServed(t *testing.T) {
+    hub := NewHub(&Config{})
+    rec := httptest.NewRecorder()
+    setupRoutes(hub).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/openapi.json", nil))
+    if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), openapiSpec) {
+	t.Fatalf("got=%d, expected the embedded spec", rec.Code)
+    }
+}
+
+// TestEmittedMessagesMatchSchema drives a real receiver and client through
+// every message type and validates everything the server sends them.
+func TestEmittedMessagesMatchSchema(t *testing.T) {
+    v := newSchemaValidator(t)
+    dir := t.TempDir()
+    os.MkdirAll(filepath.Join(dir, "workflows"), 0700)
+    os.WriteFile(filepath.Join(dir, "workflows", "lock.toml"), []byte(`
+[[steps]]
+id = "lock"
+receiver = "desk"
+function = "lock"
+`), 0600)
+    hub := NewHub(&Config{Server: ServerConfig{AuthType: "session", Password: "pw", DataDir: dir}})
+    schedule, err := hub.scheduler.Create(Schedule{Cron: "@daily", ReceiverName: "desk", FunctionKey: "lock"})
+    if err != nil {
+	t.Fatalf("Error creating schedule: %v", err)
+    }
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+
+    get := func(path string, token string) []byte {
+	req, _ := http.NewRequest(http.MethodGet, server.URL + path, nil)
+	req.Header.Set("Authorization", "Bearer " + token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+	    t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	return buf.Bytes()
+    }
+    v.check(t, "#/components/schemas/InfoResponse", get("/info", ""))
+    v.check(t, "#/components/schemas/HealthResponse", get("/healthz", ""))
+    v.check(t, "#/components/schemas/HealthResponse", get("/readyz", ""))
+
+    resp, err := http.Post(server.URL + "/v2/login", "application/json", strings.NewReader(`{"email": "me@example.com", "password": "pw"}`))
+    if err != nil {
+	t.Fatalf("Error logging in: %v", err)
+    }
+    var login bytes.Buffer
+    login.ReadFrom(resp.Body)
+    resp.Body.Close()
+    token, _ := v.check(t, "#/components/schemas/AuthenticationMessage", login.Bytes())["session_token"].(string)
+
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+    receiver, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/receiver?session_token=" + token, nil)
+    if err != nil {
+	t.Fatalf("Error connecting receiver: %v", err)
+    }
+    defer receiver.Close()
+    receiver.WriteJSON(map[string]interface{}{
+	"type": "auth",
+	"receiver_name": "desk",
+	"tags": []string{"office"},
+	"functions": []map[string]interface{}{{"id": 1, "key": "lock", "name": "Lock", "description": "Lock the screen"}},
+    })
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+	defer wg.Done()
+	for {
+	    _, raw, err := receiver.ReadMessage()
+	    if err != nil {
+		return
+	    }
+	    msg := v.check(t, "#/components/schemas/ReceiverResponse", raw)
+	    switch msg["type"] {
+	    case "functions":
+		receiver.WriteJSON(map[string]interface{}{
+		    "type": "functions",
+		    "client_id": msg["client_id"],
+		    "receiver_name": "desk",
+		    "functions": []map[string]interface{}{{"id": 1, "key": "lock", "name": "Lock", "description": "Lock the screen"}},
+		})
+	    case "exec":
+		receiver.WriteJSON(map[string]interface{}{"type": "exec_result", "exec_id": msg["exec_id"], "output": "locked"})
+	    }
+	}
+    }()
+    for len(hub.GetReceivers()) == 0 {
+	time.Sleep(time.Millisecond)
+    }
+
+    client, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/client?session_token=" + token, nil)
+    if err != nil {
+	t.Fatalf("Error connecting client: %v", err)
+    }
+    defer client.Close()
+    read := func() map[string]interface{} {
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, raw, err := client.ReadMessage()
+	if err != nil {
+	    t.Fatalf("Error reading client message: %v", err)
+	}
+	return v.check(t, "#/components/schemas/ClientResponse", raw)
+    }
+    read()
+
+    requests := []struct {
+	message	    map[string]interface{}
+	expected    string
+    }{
+	{map[string]interface{}{"type": "receivers"}, "receivers"},
+	{map[string]interface{}{"type": "functions", "receiver_name": "desk"}, "functions"},
+	{map[string]interface{}{"type": "exec", "receiver_name": "desk", "function_key": "lock"}, "exec_result"},
+	{map[string]interface{}{"type": "exec", "receiver_name": "desk", "function_key": "gone"}, "error"},
+	{map[string]interface{}{"type": "broadcast_exec", "selector": "tag=office", "function_name": "Lock"}, "broadcast_result"},
+	{map[string]interface{}{"type": "schedules"}, "schedules"},
+	{map[string]interface{}{"type": "schedule_toggle", "schedule_id": schedule.Id, "enabled": true}, "schedule"},
+	{map[string]interface{}{"type": "workflows"}, "workflows"},
+	{map[string]interface{}{"type": "history", "receiver_name": "desk", "limit": 5}, "history"},
+    }
+    for _, tt := range requests {
+	client.WriteJSON(tt.message)
+	if msg := read(); msg["type"] != tt.expected {
+	    t.Fatalf("%v: got=%v, expected=%s", tt.message, msg, tt.expected)
+	}
+    }
+
+    client.WriteJSON(map[string]interface{}{"type": "run_workflow", "workflow_name": "lock"})
+    for {
+	msg := read()
+	run, _ := msg["workflow_run"].(map[string]interface{})
+	if run == nil {
+	    t.Fatalf("got=%v, expected workflow_run", msg)
+	}
+	if run["finished_at"] != nil {
+	    break
+	}
+    }
+
+    v.check(t, "#/components/schemas/ClientResponse", get("/v2/receivers/desk/functions", token))
+    v.check(t, "#/components/schemas/ClientResponse", get("/v2/schedules", token))
+    v.check(t, "#/components/schemas/ClientResponse", get("/v2/workflows", token))
+    v.check(t, "#/components/schemas/ClientResponse", get("/v2/sessions", token))
+
+    receiver.Close()
+    wg.Wait()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/websocket"
+)
+
+// ProtocolV3 frames every message in an Envelope. v1 and v2 peers keep
+// sending the bare ClientInbound/ReceiverInbound structs; the hub only deals
+// in those structs, and each connection converts at its edge, so peers of any
+// version can talk to each other through the hub.
+const ProtocolV3 = 3
+
+var supportedVersions = []int{1, 2, ProtocolV3}
+
+var serverFeatures = []string{
+    "broadcast",
+    "function_keys",
+    "schedules",
+    "workflows",
+    "events",
+}
+
+const helloTimeout = 10 * time.Second
+
+type Envelope struct {
+    Id          string          `json:"id"`
+    Type        string          `json:"type"`
+    ReplyTo     string          `json:"reply_to,omitempty"`
+    Ts          int64           `json:"ts"`
+    Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+// HelloPayload is the first message a v3 peer sends. Receivers also describe
+// themselves here instead of in a separate auth message.
+type HelloPayload struct {
+    Role            string              `json:"role"`
+    Versions        []int               `json:"versions"`
+    Features        []string            `json:"features,omitempty"`
+    SessionToken    string              `json:"session_token,omitempty"`
+    Password        string              `json:"password,omitempty"`
+    ReceiverName    string              `json:"receiver_name,omitempty"`
+    Tags            []string            `json:"tags,omitempty"`
+    Group           string              `json:"group,omitempty"`
+    Functions       *[]MacronFunction   `json:"functions,omitempty"`
+}
+
+type HelloReply struct {
+    Version         int         `json:"version"`
+    Versions        []int       `json:"versions"`
+    Features        []string    `json:"features"`
+    ClientId        string      `json:"client_id,omitempty"`
+    ReceiverName    string      `json:"receiver_name,omitempty"`
+}
+
+type ErrorPayload struct {
+    Error   string  `json:"error"`
+    Code    string  `json:"code,omitempty"`
+}
+
+func negotiateVersion(peer []int) int {
+    best := 0
+    for _, v := range peer {
+	for _, s := range supportedVersions {
+	    if v == s && v > best {
+		best = v
+	    }
+	}
+    }
+    return best
+}
+
+func negotiateFeatures(peer []string) []string {
+    features := make([]string, 0)
+    for _, f := range serverFeatures {
+	for _, p := range peer {
+	    if f == p {
+		features = append(features, f)
+	    }
+	}
+    }
+    return features
+}
+
+func newEnvelope(msgType string, replyTo string, payload interface{}) ([]byte, string, error) {
+    env := Envelope{
+	Id: uuid.New().String(),
+	Type: msgType,
+	ReplyTo: replyTo,
+	Ts: time.Now().UnixMilli(),
+    }
+    if payload != nil {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+	    return nil, "", err
+	}
+	env.Payload = raw
+    }
+    bytes, err := json.Marshal(env)
+    return bytes, env.Id, err
+}
+
+// toEnvelope wraps a legacy message: its "type" becomes the envelope type
+// and the remaining fields become the payload. drop lists fields that v3
+// carries in the envelope instead.
+func toEnvelope(message interface{}, replyTo string, drop ...string) ([]byte, string, map[string]interface{}, error) {
+    raw, ok := message.([]byte)
+    if !ok {
+	var err error
+	raw, err = json.Marshal(message)
+	if err != nil {
+	    return nil, "", nil, err
+	}
+    }
+    var fields map[string]interface{}
+    err := json.Unmarshal(raw, &fields)
+    if err != nil {
+	return nil, "", nil, err
+    }
+    msgType, _ := fields["type"].(string)
+    delete(fields, "type")
+    removed := make(map[string]interface{})
+    for _, name := range drop {
+	if value, ok := fields[name]; ok {
+	    removed[name] = value
+	    delete(fields, name)
+	}
+    }
+    bytes, id, err := newEnvelope(msgType, replyTo, fields)
+    return bytes, id, removed, err
+}
+
+// fromEnvelope unpacks an envelope's payload into a legacy message struct.
+func fromEnvelope(env Envelope, target interface{}) error {
+    fields := make(map[string]interface{})
+    if len(env.Payload) > 0 {
+	err := json.Unmarshal(env.Payload, &fields)
+	if err != nil {
+	    return err
+	}
+    }
+    fields["type"] = env.Type
+    raw, err := json.Marshal(fields)
+    if err != nil {
+	return err
+    }
+    return json.Unmarshal(raw, target)
+}
+
+func writeEnvelopeError(ws *websocket.Conn, replyTo string, code string, msg string) {
+    bytes, _, err := newEnvelope("error", replyTo, ErrorPayload{Error: msg, Code: code})
+    if err == nil {
+	writeWireMessage(ws, bytes)
+    }
+    ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, msg))
+    ws.Close()
+}
+
+// authenticateHello accepts a session token from the hello or the upgrade
+// request, or the server password when auth_type is "password".
+func (hub *Hub) authenticateHello(r *http.Request, hello *HelloPayload) error {
+    if hub.config().Server.AuthType == "password" {
+	if hello.Password == "" || hello.Password != hub.config().Server.Password {
+	    return errors.New("Incorrect password.")
+	}
+	return nil
+    }
+    token := hello.SessionToken
+    if token == "" {
+	token = sessionToken(r)
+    }
+    return hub.TokenAuth(token)
+}
+
+// HandlerV3 accepts clients and receivers speaking the v3 envelope protocol.
+// The first message must be a hello; the reply carries the negotiated
+// version and features. A peer that negotiates 1 or 2 carries on with bare
+// v2 messages after the handshake.
+func (hub *Hub) HandlerV3(w http.ResponseWriter, r *http.Request) {
+    ws, err := hub.upgrade(w, r, hub.config().WebSocket.receiverLimit())
+    if err != nil {
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
+	return
+    }
+
+    ws.SetReadDeadline(time.Now().Add(helloTimeout))
+    var env Envelope
+    err = readWire(ws, hub.config().WebSocket.receiverLimit(), &env)
+    var tooLarge *MessageTooLargeError
+    if errors.As(err, &tooLarge) {
+	bytes, _, _ := newEnvelope("error", "", ErrorPayload{Error: err.Error(), Code: "message_too_large"})
+	writeWireMessage(ws, bytes)
+	closeTooLarge(ws)
+	return
+    }
+    if err != nil || env.Type != "hello" {
+	writeEnvelopeError(ws, env.Id, "hello_required", "First message must be a hello.")
+	return
+    }
+    ws.SetReadDeadline(time.Time{})
+    var hello HelloPayload
+    err = json.Unmarshal(env.Payload, &hello)
+    if err != nil {
+	writeEnvelopeError(ws, env.Id, "invalid_payload", "Invalid hello payload.")
+	return
+    }
+    version := negotiateVersion(hello.Versions)
+    if version == 0 {
+	writeEnvelopeError(ws, env.Id, "unsupported_version", fmt.Sprintf("No common protocol version, server supports %v", supportedVersions))
+	return
+    }
+    err = hub.authenticateHello(r, &hello)
+    if err != nil {
+	if hub.config().Server.AuthType == "password" {
+	    hub.emitLoginFailed(r, "invalid_password")
+	} else {
+	    hub.emitLoginFailed(r, "invalid_session")
+	}
+	writeEnvelopeError(ws, env.Id, "unauthorized", err.Error())
+	return
+    }
+    if hub.config().Server.AuthType == "password" {
+	hub.metrics.login("success")
+    }
+    features := negotiateFeatures(hello.Features)
+    reply := HelloReply{
+	Version: version,
+	Versions: supportedVersions,
+	Features: features,
+    }
+
+    switch hello.Role {
+    case "client":
+	client := &Client{
+	    hub: hub,
+	    id: uuid.New().String(),
+	    conn: ws,
+	    egress: make(chan []byte, egressBuffer),
+	    version: version,
+	    features: features,
+	}
+	client.log = requestLogger(r).With("client_id", client.id)
+	reply.ClientId = client.id
+	setReadLimit(ws, hub.config().WebSocket.clientLimit())
+	err = hub.writeHelloReply(ws, env.Id, reply)
+	if err != nil {
+	    return
+	}
+	hub.mu.Lock()
+	hub.clients[client.id] = client
+	hub.mu.Unlock()
+	client.log.Info("Client connected", "remote_addr", r.RemoteAddr, "version", version)
+	go client.readPump()
+	go client.writePump()
+    case "receiver":
+	if hello.ReceiverName == "" {
+	    writeEnvelopeError(ws, env.Id, "invalid_receiver", "Receiver Name Empty.")
+	    return
+	}
+	receiver := &Receiver {
+	    name: hello.ReceiverName,
+	    tags: hello.Tags,
+	    group: hello.Group,
+	    functions: hello.Functions,
+	    conn: ws,
+	    hub: hub,
+	    log: requestLogger(r).With("receiver", hello.ReceiverName),
+	    egress: make(chan []byte, egressBuffer),
+	    version: version,
+	    features: features,
+	    requests: make(map[string]string),
+	}
+	err = hub.tryRegisterReceiver(receiver)
+	if err != nil {
+	    writeEnvelopeError(ws, env.Id, "invalid_receiver", err.Error())
+	    return
+	}
+	reply.ReceiverName = receiver.name
+	err = hub.writeHelloReply(ws, env.Id, reply)
+	if err != nil {
+	    hub.RemoveReceiver(receiver)
+	    return
+	}
+	receiver.log.Info("Receiver connected", "remote_addr", r.RemoteAddr, "version", version)
+	go receiver.readPump()
+	go receiver.writePump()
+	hub.receiverOnline(receiver)
+    default:
+	writeEnvelopeError(ws, env.Id, "invalid_role", "Role must be client or receiver.")
+    }
+}
+
+func (hub *Hub) writeHelloReply(ws *websocket.Conn, replyTo string, reply HelloReply) error {
+    bytes, _, err := newEnvelope("hello", replyTo, reply)
+    if err != nil {
+	return err
+    }
+    return writeWireMessage(ws, bytes)
+}
@@ -2,20 +2,40 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
 type Receiver struct {
     name	string
+    tags	[]string
+    group	string
+    functions	*[]MacronFunction
     conn	*websocket.Conn
     hub		*Hub
+    log		*slog.Logger
     egress	chan[]byte
+    writeMu	sync.Mutex
+    // version is the negotiated protocol version; 0 means the legacy v1/v2
+    // message format.
+    version	int
+    features	[]string
+    // requests maps the id of a v3 catalog request to the client that
+    // asked, since v3 receivers never see client ids.
+    requests	map[string]string
+    requestsMu	sync.Mutex
 }
 
+// Key is a stable identifier chosen by the receiver; unlike Id it must not
+// change when the receiver's macro list is reordered.
 type MacronFunction struct {
     Id		*int	`json:"id"`
+    Key		string	`json:"key,omitempty"`
+    Version	string	`json:"version,omitempty"`
     Name	string  `json:"name"`
     Description	string	`json:"description"`
 }
@@ -23,7 +43,7 @@ func (r *Receiver) close() {
     r.conn.WriteMessage(websocket.CloseAbnormalClosure, []byte(""))
     r.conn.Close()
 
-    r.hub.RemoveReceiver(r.name)
+    r.hub.RemoveReceiver(r)
 }
 
 func (r *Receiver) sendErrorResponse(error string) {
@@ -34,18 +54,21 @@ func (r *Receiver) sendErrorResponse(error string) {
 
     bytes, _ := json.Marshal(&response)
 
-    r.egress <- bytes
+    enqueue(r.egress, bytes)
 }
 
-func (r *Receiver) sendFunctionRequest(msgType string, clientId string) {
+func (r *Receiver) sendFunctionRequest(msgType string, clientId string) error {
+    return enqueue(r.egress, functionRequest(msgType, clientId))
+}
+
+func functionRequest(msgType string, clientId string) []byte {
     response := ReceiverResponse {
 	Type: msgType,
 	ClientId: clientId,
     }
 
     bytes, _ := json.Marshal(&response)
-
-    r.egress <- bytes
+    return bytes
 }
 func (r *Receiver) sendMessage(msgType string) {
     response := ReceiverResponse {
@@ -54,56 +77,133 @@ func (r *Receiver) sendMessage(msgType string) {
 
     bytes, _ := json.Marshal(&response)
 
-    r.egress <- bytes
+    enqueue(r.egress, bytes)
     //r.conn.WriteJSON(response)
 }
 
-func (r *Receiver) execFunction(id int) {
+func (r *Receiver) hasTag(tag string) bool {
+    for _, t := range r.tags {
+	if t == tag {
+	    return true
+	}
+    }
+    return false
+}
+
+// functionByName looks up a function in the catalog the receiver last
+// advertised.
+func (r *Receiver) functionByName(name string) (MacronFunction, bool) {
+    if r.functions == nil {
+	return MacronFunction{}, false
+    }
+    return functionNamed(*r.functions, name)
+}
+
+func functionNamed(functions []MacronFunction, name string) (MacronFunction, bool) {
+    for _, f := range functions {
+	if f.Name == name && (f.Id != nil || f.Key != "") {
+	    return f, true
+	}
+    }
+    return MacronFunction{}, false
+}
+
+func functionWithKey(functions []MacronFunction, key string) (MacronFunction, bool) {
+    for _, f := range functions {
+	if f.Key == key {
+	    return f, true
+	}
+    }
+    return MacronFunction{}, false
+}
+
+func (r *Receiver) execFunction(fn MacronFunction, args map[string]interface{}, execId string) error {
     response := ReceiverResponse {
 	Type: "exec",
-	Id: &id,
+	Id: fn.Id,
+	Key: fn.Key,
+	ExecId: execId,
+	Args: args,
+    }
+
+    bytes, _ := json.Marshal(&response)
+
+    return enqueue(r.egress, bytes)
+}
+
+func (r *Receiver) cancelExec(execId string) error {
+    response := ReceiverResponse {
+	Type: "cancel",
+	ExecId: execId,
     }
 
     bytes, _ := json.Marshal(&response)
 
-    r.egress <- bytes
+    return enqueue(r.egress, bytes)
 }
 
-func (r *Receiver) getFunctions(clientId string) {
+func (r *Receiver) getFunctions(clientId string) error {
     //r.sendMessage("functions")
-    r.sendFunctionRequest("functions", clientId)
+    return r.sendFunctionRequest("functions", clientId)
 }
 
 func (r *Receiver) readPump() {
     defer func() {
-	r.hub.RemoveReceiver(r.name)
+	r.hub.RemoveReceiver(r)
+	r.hub.failExecs(r.name)
 	r.conn.Close()
+	r.hub.emit(EventReceiverOffline, map[string]interface{}{"receiver_name": r.name})
     }()
 
     for {
-	var message ReceiverInbound
-	err := r.conn.ReadJSON(&message)
+	message, err := r.readMessage()
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+	    r.log.Warn("Message too large", "error", err)
+	    r.rejectTooLarge(err)
+	    break
+	}
 	if err != nil {
-	    log.Printf("error: %v", err)
+	    r.log.Info("Receiver disconnected", "error", err)
 	    break
 	}
-	log.Printf("Receiver message: %v", message)
+	r.log.Debug("Receiver message", "type", message.Type, "exec_id", message.ExecId)
+	r.hub.metrics.messageIn("receiver", message.Type)
 	switch message.Type {
 	case "functions":
-	    log.Println("Receiver sending functions...")
 	    clientId := message.ClientId
 	    if err != nil {
-		log.Printf("error: %v", err)
+		r.log.Warn("Receiver message failed", "error", err)
 	    } else {
-		r.hub.SendFunctions(clientId, message.Functions)
+		if message.Functions != nil {
+		    r.hub.mu.Lock()
+		    changed := r.functions == nil || !reflect.DeepEqual(*r.functions, *message.Functions)
+		    r.functions = message.Functions
+		    r.hub.mu.Unlock()
+		    if changed {
+			r.hub.emit(EventCatalogChanged, map[string]interface{}{
+			    "receiver_name": r.name,
+			    "functions": len(*message.Functions),
+			})
+		    }
+		}
+		r.hub.SendFunctions(clientId, r.name, message.Functions)
 	    }
+	case "exec_result":
+	    r.log.Info("Exec result", "exec_id", message.ExecId, "status", message.Status)
+	    r.hub.CompleteExec(ExecResult{
+		ExecId: message.ExecId,
+		Status: message.Status,
+		Output: message.Output,
+		Error: message.Error,
+	    })
 	}
     }
 }
 
 func (r *Receiver) writePump() {
     defer func() {
-	r.hub.RemoveReceiver(r.name)
+	r.hub.RemoveReceiver(r)
 	r.conn.Close()
     }()
 
@@ -112,14 +212,83 @@ func (r *Receiver) writePump() {
 	case message, ok := <- r.egress:
 	    if !ok {
 		r.conn.WriteMessage(websocket.CloseMessage, []byte{})
-		log.Println("Receiver egress error")
+		r.log.Warn("Receiver egress closed")
 	    }
-	    log.Println("Sending receiver message: ", string(message))
+	    r.log.Debug("Sending receiver message", "bytes", len(message))
 	    //sendJsonWs(r.conn, message)
-	    err := r.conn.WriteMessage(1, message)
+	    msgType := messageType(message)
+	    message, err := r.egressMessage(message)
+	    if err != nil {
+		r.log.Error("Framing receiver message failed", "error", err)
+		continue
+	    }
+	    r.writeMu.Lock()
+	    err = writeWireMessage(r.conn, message)
+	    r.writeMu.Unlock()
+	    r.hub.metrics.messageOut("receiver", msgType, err)
 	    if err != nil {
 		return
 	    }
 	}
     }
 }
+
+// rejectTooLarge reports a message_too_large error and closes the
+// connection. It writes directly since the read pump is about to close it.
+func (r *Receiver) rejectTooLarge(err error) {
+    bytes, _ := json.Marshal(ReceiverResponse{Type: "error", Code: "message_too_large", Error: err.Error()})
+    message, err := r.egressMessage(bytes)
+    if err == nil {
+	r.writeMu.Lock()
+	writeWireMessage(r.conn, message)
+	r.writeMu.Unlock()
+    }
+    closeTooLarge(r.conn)
+}
+
+// readMessage reads the next message, mapping a v3 catalog reply back to the
+// client that requested it.
+func (r *Receiver) readMessage() (ReceiverInbound, error) {
+    var message ReceiverInbound
+    if r.version < ProtocolV3 {
+	err := readWire(r.conn, r.hub.config().WebSocket.receiverLimit(), &message)
+	return message, err
+    }
+    var env Envelope
+    err := readWire(r.conn, r.hub.config().WebSocket.receiverLimit(), &env)
+    if err != nil {
+	return message, err
+    }
+    err = fromEnvelope(env, &message)
+    if err != nil {
+	return message, err
+    }
+    if env.ReplyTo != "" {
+	r.requestsMu.Lock()
+	clientId, ok := r.requests[env.ReplyTo]
+	delete(r.requests, env.ReplyTo)
+	r.requestsMu.Unlock()
+	if ok {
+	    message.ClientId = clientId
+	}
+    }
+    return message, nil
+}
+
+// egressMessage frames a legacy message queued for the receiver for its
+// protocol version.
+func (r *Receiver) egressMessage(message []byte) ([]byte, error) {
+    if r.version < ProtocolV3 {
+	return message, nil
+    }
+    bytes, id, removed, err := toEnvelope(message, "", "client_id")
+    if err != nil {
+	return nil, err
+    }
+    if clientId, ok := removed["client_id"].(string); ok {
+	r.requestsMu.Lock()
+	r.requests[id] = clientId
+	r.requestsMu.Unlock()
+    }
+    return bytes, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "log/slog"
+    "os"
+    "os/signal"
+    "reflect"
+    "syscall"
+    "time"
+)
+
+const configPollInterval = 2 * time.Second
+
+// ReloadConfig loads the config from source and swaps it in. Passwords, allowed
+// origins, hooks, webhooks, message limits, shutdown settings and the log
+// level apply immediately, without dropping connections. Settings that are
+// only read at startup keep their running values; their names are returned
+// so they can be logged.
+func (hub *Hub) ReloadConfig(source ConfigSource) ([]string, error) {
+    next, err := source.Load()
+    if err != nil {
+	return nil, err
+    }
+    pending := keepRestartSettings(next, hub.config())
+    hub.cfg.Store(next)
+    level, _ := parseLogLevel(next.Server.LogLevel)
+    logLevel.Set(level)
+    return pending, nil
+}
+
+// restartSettings only take effect on restart. Routes depend on auth_type,
+// stores on data_dir, and the upgrader on compression and buffer sizes. The
+// listen address, TLS, control socket and log output are set up once by
+// serve.
+var restartSettings = map[string]bool{
+    "server.auth_type": true,
+    "server.data_dir": true,
+    "server.listen": true,
+    "server.tls_cert": true,
+    "server.tls_key": true,
+    "server.log_file": true,
+    "server.log_format": true,
+    "server.log_max_size": true,
+    "server.log_max_age": true,
+    "server.log_max_backups": true,
+    "server.control_socket": true,
+    "websocket.compression": true,
+    "websocket.read_buffer_size": true,
+    "websocket.write_buffer_size": true,
+}
+
+// keepRestartSettings copies restart settings from prev into next,
+// returning the ones that differed.
+func keepRestartSettings(next *Config, prev *Config) []string {
+    pending := make([]string, 0)
+    for _, s := range settings {
+	if !restartSettings[s.key] {
+	    continue
+	}
+	nextValue := reflect.ValueOf(next).Elem().FieldByIndex(s.index)
+	prevValue := reflect.ValueOf(prev).Elem().FieldByIndex(s.index)
+	if !reflect.DeepEqual(nextValue.Interface(), prevValue.Interface()) {
+	    pending = append(pending, s.key)
+	    nextValue.Set(prevValue)
+	}
+    }
+    return pending
+}
+
+// ConfigWatcher reloads the config when its file changes or the process
+// gets SIGHUP. A config that fails to load is logged and the running one
+// kept.
+type ConfigWatcher struct {
+    hub         *Hub
+    source      ConfigSource
+    interval    time.Duration
+    modTime     time.Time
+    size        int64
+    stop        chan struct{}
+}
+
+func NewConfigWatcher(hub *Hub, source ConfigSource) *ConfigWatcher {
+    w := &ConfigWatcher{
+	hub: hub,
+	source: source,
+	interval: configPollInterval,
+	stop: make(chan struct{}),
+    }
+    w.changed()
+    return w
+}
+
+func (w *ConfigWatcher) Run() {
+    hangup := make(chan os.Signal, 1)
+    signal.Notify(hangup, syscall.SIGHUP)
+    defer signal.Stop(hangup)
+    ticker := time.NewTicker(w.interval)
+    defer ticker.Stop()
+    for {
+	select {
+	case <-ticker.C:
+	    if w.changed() {
+		w.reload("file changed")
+	    }
+	case <-hangup:
+	    w.changed()
+	    w.reload("SIGHUP")
+	case <-w.stop:
+	    return
+	}
+    }
+}
+
+func (w *ConfigWatcher) Stop() {
+    close(w.stop)
+}
+
+// changed reports whether the file's size or modification time moved since
+// the last call.
+func (w *ConfigWatcher) changed() bool {
+    info, err := os.Stat(w.source.Path)
+    if err != nil {
+	return false
+    }
+    if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+	return false
+    }
+    w.modTime = info.ModTime()
+    w.size = info.Size()
+    return true
+}
+
+func (w *ConfigWatcher) reload(trigger string) {
+    pending, err := w.hub.ReloadConfig(w.source)
+    if err != nil {
+	slog.Error("Config reload failed, keeping the running config", "trigger", trigger, "error", err)
+	return
+    }
+    slog.Info("Config reloaded", "trigger", trigger)
+    if len(pending) > 0 {
+	slog.Warn("Restart required to apply settings", "settings", pending)
+    }
+}
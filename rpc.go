@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "io"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// JSON-RPC 2.0 error codes. Codes from -32000 down are ours.
+const (
+    rpcParseError       = -32700
+    rpcInvalidRequest   = -32600
+    rpcMethodNotFound   = -32601
+    rpcInvalidParams    = -32602
+    rpcInternalError    = -32603
+    rpcServerError      = -32000
+    rpcStaleFunction    = -32001
+    rpcExecNotFound     = -32002
+    rpcMessageTooLarge  = -32003
+)
+
+type rpcRequest struct {
+    JSONRPC     string          `json:"jsonrpc"`
+    Method      string          `json:"method"`
+    Params      json.RawMessage `json:"params,omitempty"`
+    Id          json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcResponse is a success. JSON-RPC requires result even when it is null,
+// and forbids it alongside error, so failures are rpcErrorResponse.
+type rpcResponse struct {
+    JSONRPC     string          `json:"jsonrpc"`
+    Result      interface{}     `json:"result"`
+    Id          json.RawMessage `json:"id"`
+}
+
+type rpcErrorResponse struct {
+    JSONRPC     string          `json:"jsonrpc"`
+    Error       *rpcError       `json:"error"`
+    Id          json.RawMessage `json:"id"`
+}
+
+type rpcNotification struct {
+    JSONRPC     string          `json:"jsonrpc"`
+    Method      string          `json:"method"`
+    Params      interface{}     `json:"params"`
+}
+
+type rpcError struct {
+    Code        int             `json:"code"`
+    Message     string          `json:"message"`
+    Data        interface{}     `json:"data,omitempty"`
+}
+
+type rpcExecParams struct {
+    ReceiverName    string                  `json:"receiver_name"`
+    FunctionKey     string                  `json:"function_key,omitempty"`
+    FunctionId      *int                    `json:"function_id,omitempty"`
+    Version         string                  `json:"version,omitempty"`
+    Args            map[string]interface{}  `json:"args,omitempty"`
+    Wait            string                  `json:"wait,omitempty"`
+}
+
+// rpcSession serves one JSON-RPC connection. notify is nil over HTTP, where
+// execs that are not waited on can only be followed with history.query.
+// control is set on the admin socket and adds its methods.
+type rpcSession struct {
+    hub     *Hub
+    notify  func(method string, params interface{})
+    done    <-chan struct{}
+    control *ControlServer
+}
+
+var nullId = json.RawMessage("null")
+
+// handle answers a single request or a batch. It returns nil when there is
+// nothing to send back, i.e. the message held only notifications.
+func (s *rpcSession) handle(raw []byte) []byte {
+    raw = bytes.TrimSpace(raw)
+    if !json.Valid(raw) {
+	return mustMarshal(rpcErrorResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: "Parse error"}, Id: nullId})
+    }
+    if len(raw) == 0 || raw[0] != '[' {
+	response := s.handleOne(raw)
+	if response == nil {
+	    return nil
+	}
+	return mustMarshal(response)
+    }
+
+    var batch []json.RawMessage
+    json.Unmarshal(raw, &batch)
+    if len(batch) == 0 {
+	return mustMarshal(rpcErrorResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request"}, Id: nullId})
+    }
+    responses := make([]interface{}, len(batch))
+    var wg sync.WaitGroup
+    for i, item := range batch {
+	wg.Add(1)
+	go func(i int, item json.RawMessage) {
+	    defer wg.Done()
+	    responses[i] = s.handleOne(item)
+	}(i, item)
+    }
+    wg.Wait()
+    replies := make([]interface{}, 0, len(responses))
+    for _, response := range responses {
+	if response != nil {
+	    replies = append(replies, response)
+	}
+    }
+    if len(replies) == 0 {
+	return nil
+    }
+    return mustMarshal(replies)
+}
+
+// handleOne answers a single request with an rpcResponse or an
+// rpcErrorResponse, or returns nil for a notification.
+func (s *rpcSession) handleOne(raw json.RawMessage) interface{} {
+    var req rpcRequest
+    err := json.Unmarshal(raw, &req)
+    if err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+	return &rpcErrorResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request"}, Id: nullId}
+    }
+    result, rpcErr := s.call(req.Method, req.Params)
+    if req.Id == nil {
+	return nil
+    }
+    if rpcErr != nil {
+	return &rpcErrorResponse{JSONRPC: "2.0", Error: rpcErr, Id: req.Id}
+    }
+    return &rpcResponse{JSONRPC: "2.0", Result: result, Id: req.Id}
+}
+
+func decodeParams(raw json.RawMessage, target interface{}) *rpcError {
+    if len(raw) == 0 || bytes.Equal(raw, nullId) {
+	return nil
+    }
+    decoder := json.NewDecoder(bytes.NewReader(raw))
+    decoder.DisallowUnknownFields()
+    err := decoder.Decode(target)
+    if err != nil {
+	return &rpcError{Code: rpcInvalidParams, Message: "Invalid params", Data: err.Error()}
+    }
+    return nil
+}
+
+func invalidParams(msg string) *rpcError {
+    return &rpcError{Code: rpcInvalidParams, Message: "Invalid params", Data: msg}
+}
+
+func hubError(err error) *rpcError {
+    var stale *StaleFunctionError
+    if errors.As(err, &stale) {
+	return &rpcError{Code: rpcStaleFunction, Message: err.Error()}
+    }
+    return &rpcError{Code: rpcServerError, Message: err.Error()}
+}
+
+// call dispatches to the same Hub operations the WebSocket client protocol
+// uses.
+func (s *rpcSession) call(method string, raw json.RawMessage) (interface{}, *rpcError) {
+    switch method {
+    case "receivers.list":
+	return s.hub.GetReceivers(), nil
+    case "functions.list":
+	var params struct {
+	    ReceiverName    string  `json:"receiver_name"`
+	}
+	if err := decodeParams(raw, &params); err != nil {
+	    return nil, err
+	}
+	if params.ReceiverName == "" {
+	    return nil, invalidParams("receiver_name is required")
+	}
+	functions, err := s.hub.FetchFunctions(params.ReceiverName, catalogFetchTimeout)
+	if err != nil {
+	    return nil, hubError(err)
+	}
+	return functions, nil
+    case "functions.exec":
+	return s.exec(raw)
+    case "exec.cancel":
+	var params struct {
+	    ExecId  string  `json:"exec_id"`
+	}
+	if err := decodeParams(raw, &params); err != nil {
+	    return nil, err
+	}
+	if params.ExecId == "" {
+	    return nil, invalidParams("exec_id is required")
+	}
+	result, err := s.hub.CancelExec(params.ExecId)
+	if err != nil {
+	    return nil, &rpcError{Code: rpcExecNotFound, Message: err.Error()}
+	}
+	return result, nil
+    case "history.query":
+	var query HistoryQuery
+	if err := decodeParams(raw, &query); err != nil {
+	    return nil, err
+	}
+	return s.hub.QueryHistory(query), nil
+    }
+    if s.control != nil {
+	return s.control.call(method, raw)
+    }
+    return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+}
+
+// exec starts a function. With a wait duration it returns the ExecResult;
+// otherwise it returns the exec id, and WebSocket sessions get an
+// "exec.result" notification when the receiver reports back.
+func (s *rpcSession) exec(raw json.RawMessage) (interface{}, *rpcError) {
+    var params rpcExecParams
+    if err := decodeParams(raw, &params); err != nil {
+	return nil, err
+    }
+    var timeout time.Duration
+    if params.Wait != "" {
+	var err error
+	timeout, err = time.ParseDuration(params.Wait)
+	if err != nil || timeout <= 0 || timeout > maxExecWait {
+	    return nil, invalidParams("Invalid wait duration: " + params.Wait)
+	}
+    }
+
+    var exec *pendingExec
+    var err error
+    if params.FunctionKey != "" {
+	exec, err = s.hub.ExecFunctionByKey(params.ReceiverName, params.FunctionKey, params.Version, params.Args, "", "")
+    } else if params.FunctionId != nil {
+	exec, err = s.hub.ExecFunction(params.ReceiverName, *params.FunctionId, params.Args, "", "")
+    } else {
+	return nil, invalidParams("function_key or function_id is required")
+    }
+    if err != nil {
+	return nil, hubError(err)
+    }
+
+    if timeout > 0 {
+	return s.hub.awaitExec(exec, timeout), nil
+    }
+    if s.notify != nil {
+	go func() {
+	    select {
+	    case result := <-exec.done:
+		s.notify("exec.result", result)
+	    case <-s.done:
+	    }
+	}()
+    }
+    return ClientResponse{Type: "exec", ExecId: exec.id, ReceiverName: exec.receiverName}, nil
+}
+
+func mustMarshal(v interface{}) []byte {
+    bytes, err := json.Marshal(v)
+    if err != nil {
+	slog.Error("Marshalling JSON-RPC response failed", "error", err)
+	return []byte(`{"jsonrpc":"2.0","error":{"code":-32603,"message":"Internal error"},"id":null}`)
+    }
+    return bytes
+}
+
+// HandlerRPC serves JSON-RPC over HTTP POST.
+func (hub *Hub) HandlerRPC(w http.ResponseWriter, r *http.Request) {
+    limit := hub.config().WebSocket.clientLimit()
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+	tooLargeErr := &MessageTooLargeError{Limit: limit}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write(mustMarshal(rpcErrorResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcMessageTooLarge, Message: tooLargeErr.Error(), Data: "message_too_large"}, Id: nullId}))
+	return
+    }
+    if err != nil {
+	w.WriteHeader(http.StatusBadRequest)
+	return
+    }
+    session := &rpcSession{hub: hub, done: r.Context().Done()}
+    response := session.handle(body)
+    if response == nil {
+	w.WriteHeader(http.StatusNoContent)
+	return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(response)
+}
+
+// HandlerRPCSocket serves JSON-RPC over a WebSocket, one request or batch
+// per message. Requests run concurrently, so a waiting exec does not hold
+// up the rest of the connection.
+func (hub *Hub) HandlerRPCSocket(w http.ResponseWriter, r *http.Request) {
+    limit := hub.config().WebSocket.clientLimit()
+    ws, err := hub.upgrade(w, r, limit)
+    if err != nil {
+	requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
+	return
+    }
+    defer ws.Close()
+
+    var writeMu sync.Mutex
+    write := func(message []byte) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	writeWireMessage(ws, message)
+    }
+    done := make(chan struct{})
+    defer close(done)
+    session := &rpcSession{
+	hub: hub,
+	done: done,
+	notify: func(method string, params interface{}) {
+	    write(mustMarshal(rpcNotification{JSONRPC: "2.0", Method: method, Params: params}))
+	},
+    }
+
+    go func() {
+	select {
+	case <-hub.shutdown:
+	    session.notify("server.shutdown", ClientResponse{Type: "server_shutdown", RestartIn: hub.config().Server.restartIn()})
+	    closeGoingAway(ws)
+	case <-done:
+	}
+    }()
+
+    for {
+	message, err := readWireMessage(ws, limit)
+	var tooLarge *MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+	    write(mustMarshal(rpcErrorResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcMessageTooLarge, Message: err.Error(), Data: "message_too_large"}, Id: nullId}))
+	    closeTooLarge(ws)
+	    return
+	}
+	if err != nil {
+	    return
+	}
+	go func(message []byte) {
+	    response := session.handle(message)
+	    if response != nil {
+		write(response)
+	    }
+	}(message)
+    }
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+const (
+    scheduleExecTimeout = 60 * time.Second
+    schedulerTick       = time.Second
+)
+
+// Missed run policies decide what happens when a schedule comes due while
+// its receiver is offline (or while the server was down).
+const (
+    MissedRunSkip       = "skip"
+    MissedRunOnConnect  = "run_on_connect"
+)
+
+type Schedule struct {
+    Id              string                  `json:"id"`
+    Name            string                  `json:"name,omitempty"`
+    Cron            string                  `json:"cron,omitempty"`
+    At              *time.Time              `json:"at,omitempty"`
+    ReceiverName    string                  `json:"receiver_name"`
+    FunctionKey     string                  `json:"function_key,omitempty"`
+    FunctionId      *int                    `json:"function_id,omitempty"`
+    Args            map[string]interface{}  `json:"args,omitempty"`
+    MissedRun       string                  `json:"missed_run,omitempty"`
+    Enabled         bool                    `json:"enabled"`
+    NextRun         *time.Time              `json:"next_run,omitempty"`
+    LastRun         *time.Time              `json:"last_run,omitempty"`
+    LastStatus      string                  `json:"last_status,omitempty"`
+    LastError       string                  `json:"last_error,omitempty"`
+    // Pending is set when a run was missed and is waiting for the receiver.
+    Pending         bool                    `json:"pending,omitempty"`
+}
+
+func (s *Schedule) validate() error {
+    if s.ReceiverName == "" {
+	return errors.New("Receiver Name Empty.")
+    }
+    if s.FunctionKey == "" && s.FunctionId == nil {
+	return errors.New("Function Key Empty.")
+    }
+    if (s.Cron == "") == (s.At == nil) {
+	return errors.New("Schedule needs exactly one of cron or at.")
+    }
+    if s.Cron != "" {
+	if _, err := ParseCron(s.Cron); err != nil {
+	    return err
+	}
+    }
+    switch s.MissedRun {
+    case "":
+	s.MissedRun = MissedRunSkip
+    case MissedRunSkip, MissedRunOnConnect:
+    default:
+	return fmt.Errorf("Unknown missed_run policy: %s", s.MissedRun)
+    }
+    return nil
+}
+
+// computeNext sets NextRun to the first run after t, clearing it for one-shot
+// schedules that have already fired.
+func (s *Schedule) computeNext(t time.Time) {
+    s.NextRun = nil
+    if s.At != nil {
+	if s.LastRun == nil {
+	    at := *s.At
+	    s.NextRun = &at
+	}
+	return
+    }
+    cron, err := ParseCron(s.Cron)
+    if err != nil {
+	return
+    }
+    next := cron.Next(t)
+    if !next.IsZero() {
+	s.NextRun = &next
+    }
+}
+
+type Scheduler struct {
+    hub         *Hub
+    path        string
+    schedules   map[string]*Schedule
+    mu          sync.Mutex
+    stop        chan struct{}
+}
+
+func NewScheduler(hub *Hub, path string) *Scheduler {
+    return &Scheduler{
+	hub: hub,
+	path: path,
+	schedules: make(map[string]*Schedule),
+	stop: make(chan struct{}),
+    }
+}
+
+// Load reads persisted schedules and applies the missed run policy to any
+// that came due while the server was down.
+func (s *Scheduler) Load() error {
+    if s.path == "" {
+	return nil
+    }
+    bytes, err := os.ReadFile(s.path)
+    if errors.Is(err, os.ErrNotExist) {
+	return nil
+    }
+    if err != nil {
+	return err
+    }
+    var schedules []*Schedule
+    err = json.Unmarshal(bytes, &schedules)
+    if err != nil {
+	return err
+    }
+
+    now := time.Now()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, schedule := range schedules {
+	if schedule.NextRun != nil && schedule.NextRun.Before(now) {
+	    slog.Warn("Schedule missed a run", "schedule", schedule.Id, "at", *schedule.NextRun)
+	    if schedule.MissedRun == MissedRunOnConnect {
+		schedule.Pending = true
+	    }
+	    if schedule.At != nil {
+		schedule.LastRun = &now
+	    }
+	}
+	schedule.computeNext(now)
+	s.schedules[schedule.Id] = schedule
+    }
+    slog.Info("Loaded schedules", "count", len(s.schedules))
+    return nil
+}
+
+// Save writes every schedule to disk.
+func (s *Scheduler) Save() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.save()
+}
+
+// save writes every schedule to disk. Callers must hold s.mu.
+func (s *Scheduler) save() error {
+    if s.path == "" {
+	return nil
+    }
+    bytes, err := json.MarshalIndent(s.sortedLocked(), "", "  ")
+    if err != nil {
+	return err
+    }
+    err = os.MkdirAll(filepath.Dir(s.path), 0700)
+    if err != nil {
+	return err
+    }
+    tmp := s.path + ".tmp"
+    err = os.WriteFile(tmp, bytes, 0600)
+    if err != nil {
+	return err
+    }
+    return os.Rename(tmp, s.path)
+}
+
+func (s *Scheduler) sortedLocked() []Schedule {
+    list := make([]Schedule, 0, len(s.schedules))
+    for _, schedule := range s.schedules {
+	list = append(list, *schedule)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+    return list
+}
+
+func (s *Scheduler) List() []Schedule {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.sortedLocked()
+}
+
+func (s *Scheduler) Get(id string) (Schedule, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    schedule, ok := s.schedules[id]
+    if !ok {
+	return Schedule{}, false
+    }
+    return *schedule, true
+}
+
+func (s *Scheduler) Create(schedule Schedule) (Schedule, error) {
+    err := schedule.validate()
+    if err != nil {
+	return Schedule{}, err
+    }
+    schedule.Id = uuid.New().String()
+    schedule.LastRun = nil
+    schedule.LastStatus = ""
+    schedule.LastError = ""
+    schedule.Pending = false
+    schedule.computeNext(time.Now())
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.schedules[schedule.Id] = &schedule
+    return schedule, s.save()
+}
+
+func (s *Scheduler) Update(id string, schedule Schedule) (Schedule, error) {
+    err := schedule.validate()
+    if err != nil {
+	return Schedule{}, err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    existing, ok := s.schedules[id]
+    if !ok {
+	return Schedule{}, fmt.Errorf("Schedule not found with id: %s", id)
+    }
+    schedule.Id = id
+    schedule.LastRun = existing.LastRun
+    schedule.LastStatus = existing.LastStatus
+    schedule.LastError = existing.LastError
+    schedule.Pending = false
+    schedule.computeNext(time.Now())
+    s.schedules[id] = &schedule
+    return schedule, s.save()
+}
+
+func (s *Scheduler) Delete(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.schedules[id]; !ok {
+	return fmt.Errorf("Schedule not found with id: %s", id)
+    }
+    delete(s.schedules, id)
+    return s.save()
+}
+
+func (s *Scheduler) SetEnabled(id string, enabled bool) (Schedule, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    schedule, ok := s.schedules[id]
+    if !ok {
+	return Schedule{}, fmt.Errorf("Schedule not found with id: %s", id)
+    }
+    schedule.Enabled = enabled
+    if !enabled {
+	schedule.Pending = false
+    }
+    schedule.computeNext(time.Now())
+    return *schedule, s.save()
+}
+
+func (s *Scheduler) Run() {
+    ticker := time.NewTicker(schedulerTick)
+    defer ticker.Stop()
+    for {
+	select {
+	case now := <-ticker.C:
+	    s.tick(now)
+	case <-s.stop:
+	    return
+	}
+    }
+}
+
+func (s *Scheduler) Stop() {
+    close(s.stop)
+}
+
+// tick fires the schedules that are due. Each runs on its own goroutine so
+// that a receiver which is slow to accept an exec holds up only its own
+// schedules.
+func (s *Scheduler) tick(now time.Time) {
+    s.mu.Lock()
+    due := make([]Schedule, 0)
+    for _, schedule := range s.schedules {
+	if schedule.Enabled && schedule.NextRun != nil && !schedule.NextRun.After(now) {
+	    due = append(due, s.claim(schedule, now))
+	}
+    }
+    s.mu.Unlock()
+
+    for _, target := range due {
+	go s.fire(target)
+    }
+}
+
+// ReceiverOnline runs schedules that missed their slot while the receiver
+// was offline and asked to be caught up.
+func (s *Scheduler) ReceiverOnline(name string) {
+    now := time.Now()
+    s.mu.Lock()
+    pending := make([]Schedule, 0)
+    for _, schedule := range s.schedules {
+	if schedule.Enabled && schedule.Pending && schedule.ReceiverName == name {
+	    pending = append(pending, s.claim(schedule, now))
+	}
+    }
+    s.mu.Unlock()
+
+    for _, target := range pending {
+	slog.Info("Running missed schedule", "schedule", target.Id, "receiver", name)
+	go s.fire(target)
+    }
+}
+
+// claim marks a schedule as run at now and moves it on to its next slot, so
+// the next tick does not fire it again. The caller holds s.mu.
+func (s *Scheduler) claim(schedule *Schedule, now time.Time) Schedule {
+    schedule.LastRun = &now
+    schedule.Pending = false
+    schedule.computeNext(now)
+    return *schedule
+}
+
+func (s *Scheduler) fire(target Schedule) {
+    exec, err := s.execute(target)
+    s.record(target.Id, func(schedule *Schedule) {
+	if errors.Is(err, errReceiverOffline) {
+	    slog.Warn("Schedule missed, receiver is offline", "schedule", schedule.Id, "receiver", schedule.ReceiverName)
+	    schedule.LastStatus = "missed"
+	    schedule.LastError = err.Error()
+	    schedule.Pending = schedule.MissedRun == MissedRunOnConnect
+	} else if err != nil {
+	    schedule.LastStatus = "error"
+	    schedule.LastError = err.Error()
+	} else {
+	    schedule.LastStatus = "started"
+	    schedule.LastError = ""
+	}
+    })
+    if exec != nil {
+	s.awaitResult(target.Id, exec)
+    }
+}
+
+// record updates the schedule with id and saves. It looks the schedule up
+// again rather than keeping a pointer, since Update replaces it; a schedule
+// deleted meanwhile is left alone.
+func (s *Scheduler) record(id string, update func(schedule *Schedule)) {
+    s.mu.Lock()
+    schedule, ok := s.schedules[id]
+    if !ok {
+	s.mu.Unlock()
+	return
+    }
+    update(schedule)
+    err := s.save()
+    s.mu.Unlock()
+    if err != nil {
+	slog.Error("Saving schedules failed", "error", err)
+    }
+}
+
+var errReceiverOffline = errors.New("Receiver is offline.")
+
+func (s *Scheduler) execute(schedule Schedule) (*pendingExec, error) {
+    s.hub.mu.Lock()
+    receiver := s.hub.receivers[schedule.ReceiverName]
+    s.hub.mu.Unlock()
+    if receiver == nil {
+	return nil, errReceiverOffline
+    }
+
+    fn := MacronFunction{Id: schedule.FunctionId}
+    if schedule.FunctionKey != "" {
+	var err error
+	receiver, fn, err = s.hub.resolveFunction(schedule.ReceiverName, schedule.FunctionKey, "")
+	if err != nil {
+	    return nil, err
+	}
+    }
+    return s.hub.startExec(receiver, fn, schedule.Args, ""), nil
+}
+
+func (s *Scheduler) awaitResult(id string, exec *pendingExec) {
+    result := s.hub.awaitExec(exec, scheduleExecTimeout)
+    slog.Info("Schedule finished", "schedule", id, "status", result.Status)
+
+    s.record(id, func(schedule *Schedule) {
+	schedule.LastStatus = result.Status
+	schedule.LastError = result.Error
+    })
+}
@@ -1,30 +1,2634 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/pelletier/go-toml/v2"
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
 )
 
 func TestConfigLoad(t *testing.T) {
-    testString := `
-    [Server]
-    auth_type = "password"
-    password = "foobar"
+    home := t.TempDir()
+    t.Setenv("HOME", home)
+    defaults := func(c Config) Config {
+	c.Server.DataDir = filepath.Join(home, "/.local/share/macron-server")
+	c.Server.ControlSocket = filepath.Join(c.Server.DataDir, "control.sock")
+	c.Server.ShutdownTimeout = "30s"
+	c.WebSocket = WebSocketConfig{
+	    ReadBufferSize: defaultReadBufferSize,
+	    WriteBufferSize: defaultWriteBufferSize,
+	    MaxClientMessage: defaultMaxClientMessage,
+	    MaxReceiverMessage: defaultMaxReceiverMessage,
+	}
+	return c
+    }
+    tests := []struct {
+	name        string
+	config      string
+	expected    *Config
+	problems    []string
+    }{
+	{
+	    name: "password",
+	    config: `
+	    [Server]
+	    auth_type = "password"
+	    password = "foobar"
+	    allowed_origins = ["https://dash.example.com"]
+	    `,
+	    expected: &Config{Server: ServerConfig{
+		AuthType: "password",
+		Password: "foobar",
+		AllowedOrigins: []string{"https://dash.example.com"},
+	    }},
+	},
+	{
+	    name: "auth type defaults to session",
+	    config: `
+	    [server]
+	    password = "foobar"
+	    `,
+	    expected: &Config{Server: ServerConfig{AuthType: "session", Password: "foobar"}},
+	},
+	{
+	    name: "unknown keys",
+	    config: `
+	    [Server]
+	    password = "foobar"
+	    pasword = "foobar"
+	    [websocket]
+	    compresion = true
+	    `,
+	    problems: []string{"line 4: unknown key Server.pasword", "line 6: unknown key websocket.compresion"},
+	},
+	{
+	    name: "syntax error",
+	    config: `
+	    [Server]
+	    password = foobar
+	    `,
+	    problems: []string{"line 3:"},
+	},
+	{
+	    name: "unknown auth type",
+	    config: `
+	    [Server]
+	    auth_type = "token"
+	    password = "foobar"
+	    `,
+	    problems: []string{`server.auth_type: unknown value "token"`},
+	},
+	{
+	    name: "missing password",
+	    config: `
+	    [Server]
+	    auth_type = "password"
+	    `,
+	    problems: []string{"server.password: required"},
+	},
+	{
+	    name: "full without email",
+	    config: `
+	    [Server]
+	    auth_type = "full"
+	    password = "foobar"
+	    `,
+	    problems: []string{"server.email: required"},
+	},
+	{
+	    name: "bad server settings",
+	    config: `
+	    [Server]
+	    password = "foobar"
+	    allowed_origins = ["dash.example.com", "https://dash.example.com/app", "*"]
+	    shutdown_timeout = "soon"
+	    restart_hint = "-5s"
+	    `,
+	    problems: []string{
+		`server.allowed_origins: "dash.example.com"`,
+		`server.allowed_origins: "https://dash.example.com/app"`,
+		"server.shutdown_timeout:",
+		"server.restart_hint:",
+	    },
+	},
+	{
+	    name: "bad websocket settings",
+	    config: `
+	    [Server]
+	    password = "foobar"
+	    [websocket]
+	    compression_level = 12
+	    read_buffer_size = -1
+	    max_client_message = -1
+	    `,
+	    problems: []string{"websocket.compression_level:", "websocket.read_buffer_size:", "websocket.max_client_message:"},
+	},
+	{
+	    name: "bad hooks",
+	    config: `
+	    [Server]
+	    password = "foobar"
+	    [[hooks]]
+	    id = "deploy"
+	    receiver = "desk"
+	    function = "deploy"
+	    secret = "s3cret"
+	    auth = "basic"
+	    wait = "1h"
+	    [[hooks]]
+	    id = "deploy"
+	    `,
+	    problems: []string{
+		`hooks[0].auth: unknown value "basic"`,
+		"hooks[0].wait: 1h is longer than the 5m0s maximum",
+		`hooks[1].id: duplicate id "deploy"`,
+		"hooks[1].receiver: required",
+		"hooks[1].function: required",
+		"hooks[1].secret: required",
+	    },
+	},
+	{
+	    name: "bad webhooks",
+	    config: `
+	    [Server]
+	    password = "foobar"
+	    [[webhooks]]
+	    url = "ftp://example.com"
+	    events = ["exec.finished", "exec.done"]
+	    max_attempts = -1
+	    backoff = "fast"
+	    [[webhooks]]
+	    events = ["exec.failed"]
+	    `,
+	    problems: []string{
+		`webhooks[0].url: "ftp://example.com"`,
+		`webhooks[0].events: unknown event type "exec.done"`,
+		"webhooks[0].max_attempts:",
+		"webhooks[0].backoff:",
+		"webhooks[1].url: required",
+	    },
+	},
+	{
+	    name: "bad trusted proxies",
+	    config: `
+	    [Server]
+	    password = "foobar"
+	    trusted_proxies = ["10.0.0.1", "192.168.0.0/16", "proxy.local"]
+	    `,
+	    problems: []string{
+		`server.trusted_proxies: "proxy.local" is not an address or CIDR range`,
+	    },
+	},
+    }
+    for _, tt := range tests {
+	path := filepath.Join(home, "config.toml")
+	os.WriteFile(path, []byte(tt.config), 0600)
+	cfg, err := loadConfig(path)
+	if tt.expected != nil {
+	    if err != nil {
+		t.Fatalf("%s: unexpected error: %v", tt.name, err)
+	    }
+	    if expected := defaults(*tt.expected); !reflect.DeepEqual(*cfg, expected) {
+		t.Fatalf("%s: got=%+v, expected=%+v", tt.name, *cfg, expected)
+	    }
+	    continue
+	}
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+	    t.Fatalf("%s: got=%v, expected a ConfigError", tt.name, err)
+	}
+	if len(configErr.Problems) != len(tt.problems) {
+	    t.Fatalf("%s: got=%q, expected %d problems", tt.name, configErr.Problems, len(tt.problems))
+	}
+	for i, problem := range tt.problems {
+	    if !strings.HasPrefix(configErr.Problems[i], problem) {
+		t.Fatalf("%s: got=%q, expected it to start with %q", tt.name, configErr.Problems[i], problem)
+	    }
+	}
+    }
+
+    if code := checkConfig([]string{filepath.Join(home, "missing.toml")}, io.Discard, io.Discard); code != 1 {
+	t.Fatalf("got=%d, expected check-config to fail for a missing file", code)
+    }
+}
+
+func TestBroadcastExec(t *testing.T) {
+    hub := NewHub(&Config{})
+    lockId := 1
+    functions := []MacronFunction{{Id: &lockId, Name: "lock"}}
+    echo := func(r *Receiver) {
+	for bytes := range r.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(bytes, &msg)
+	    if msg.Type == "functions" {
+		// Only nas has no cached catalog, so it is asked for one.
+		hub.SendFunctions(msg.ClientId, r.name, &functions)
+		continue
+	    }
+	    hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: r.name})
+	}
+    }
+    for _, r := range []*Receiver{
+	{name: "desk", tags: []string{"office"}, functions: &functions},
+	{name: "nas", tags: []string{"office"}},
+	{name: "laptop", tags: []string{"home"}, functions: &functions},
+    } {
+	r.hub = hub
+	r.egress = make(chan []byte)
+	hub.receivers[r.name] = r
+	go echo(r)
+    }
+
+    results, err := hub.BroadcastExec("tag=office", "lock")
+    if err != nil {
+	t.Fatalf("Error broadcasting: %v", err)
+    }
+    if len(results) != 2 {
+	t.Fatalf("got=%d results, expected=2", len(results))
+    }
+    sort.Slice(results, func(i, j int) bool { return results[i].ReceiverName < results[j].ReceiverName })
+    for i, name := range []string{"desk", "nas"} {
+	if results[i].ReceiverName != name || results[i].Status != "success" || results[i].Output != name {
+	    t.Fatalf("unexpected result: %+v", results[i])
+	}
+    }
+
+    if _, err := hub.BroadcastExec("office", "lock"); err == nil {
+	t.Fatalf("expected error for malformed selector")
+    }
+}
+
+func TestExecFunctionByKeyStale(t *testing.T) {
+    hub := NewHub(&Config{})
+    functions := []MacronFunction{{Key: "lock-screen", Version: "2", Name: "Lock"}}
+    hub.receivers["desk"] = &Receiver{name: "desk", hub: hub, functions: &functions}
+
+    tests := []struct {
+	key	    string
+	version	    string
+    }{
+	{"lock-screen", "1"},
+	{"sleep", ""},
+    }
+    for _, tt := range tests {
+	_, err := hub.ExecFunctionByKey("desk", tt.key, tt.version, nil, "", "")
+	var stale *StaleFunctionError
+	if !errors.As(err, &stale) {
+	    t.Fatalf("key=%s version=%s: got=%v, expected StaleFunctionError", tt.key, tt.version, err)
+	}
+    }
+}
+
+func TestExecFunctionByKeyFetchesCatalog(t *testing.T) {
+    hub := NewHub(&Config{})
+    // desk connected but has not sent its catalog yet.
+    desk := &Receiver{name: "desk", hub: hub, egress: make(chan []byte)}
+    hub.receivers["desk"] = desk
+    functions := []MacronFunction{{Key: "lock-screen", Name: "Lock"}}
+    go func() {
+	for bytes := range desk.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(bytes, &msg)
+	    if msg.Type == "functions" {
+		hub.SendFunctions(msg.ClientId, "desk", &functions)
+		continue
+	    }
+	    hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: msg.Key})
+	}
+    }()
+    result, err := hub.ExecAndWait("desk", "lock-screen", nil, 2 * time.Second)
+    if err != nil {
+	t.Fatalf("Error execing before the catalog arrived: %v", err)
+    }
+    if result.Status != "success" || result.Output != "lock-screen" {
+	t.Fatalf("unexpected result: %+v", result)
+    }
+}
+
+func TestFetchFunctions(t *testing.T) {
+    hub := NewHub(&Config{})
+    // Nothing reads this receiver's egress, as when its writePump died.
+    hub.receivers["stuck"] = &Receiver{name: "stuck", hub: hub, egress: make(chan []byte)}
+    done := make(chan error, 1)
+    go func() {
+	_, err := hub.FetchFunctions("stuck", 50 * time.Millisecond)
+	done <- err
+    }()
+    select {
+    case err := <-done:
+	if err == nil {
+	    t.Fatalf("expected a timeout from a stuck receiver")
+	}
+    case <-time.After(2 * time.Second):
+	t.Fatalf("FetchFunctions hung on a stuck receiver")
+    }
+
+    desk := &Receiver{name: "desk", hub: hub, egress: make(chan []byte)}
+    hub.receivers["desk"] = desk
+    functions := []MacronFunction{{Key: "lock", Name: "Lock"}}
+    go func() {
+	var msg ReceiverResponse
+	json.Unmarshal(<-desk.egress, &msg)
+	// Answering twice must not block the second reply.
+	hub.SendFunctions(msg.ClientId, "desk", &functions)
+	hub.SendFunctions(msg.ClientId, "desk", &functions)
+	close(done)
+    }()
+    got, err := hub.FetchFunctions("desk", 2 * time.Second)
+    if err != nil || len(got) != 1 || got[0].Key != "lock" {
+	t.Fatalf("got=%v err=%v, expected the lock function", got, err)
+    }
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+	t.Fatalf("second SendFunctions blocked")
+    }
+}
+
+func TestStuckReceiver(t *testing.T) {
+    hub := NewHub(&Config{})
+    functions := []MacronFunction{{Key: "lock", Name: "Lock"}}
+    // A full queue that nothing drains, as when the writePump has exited.
+    stuck := &Receiver{name: "stuck", hub: hub, functions: &functions, egress: make(chan []byte, 1)}
+    stuck.egress <- []byte("{}")
+    hub.receivers["stuck"] = stuck
+
+    done := make(chan ExecResult, 1)
+    go func() {
+	result, _ := hub.ExecAndWait("stuck", "lock", nil, time.Minute)
+	done <- result
+    }()
+    select {
+    case result := <-done:
+	if result.Status != "error" || !strings.Contains(result.Error, "not accepting") {
+	    t.Fatalf("got=%+v, expected an error result", result)
+	}
+    case <-time.After(enqueueTimeout + 2 * time.Second):
+	t.Fatalf("Exec hung on a stuck receiver")
+    }
+    if len(hub.execs) != 0 {
+	t.Fatalf("got=%d pending execs, expected the failed exec to be finished", len(hub.execs))
+    }
+    if err := hub.GetFunctions("stuck", "client"); err == nil {
+	t.Fatalf("expected an error requesting functions from a stuck receiver")
+    }
+}
+
+func TestReceiverNameRace(t *testing.T) {
+    hub := NewHub(&Config{})
+    receivers := make([]*Receiver, 8)
+    errs := make(chan error, len(receivers))
+    var wg sync.WaitGroup
+    for i := range receivers {
+	receivers[i] = &Receiver{name: "desk", hub: hub}
+	wg.Add(1)
+	go func(r *Receiver) {
+	    defer wg.Done()
+	    errs <- hub.tryRegisterReceiver(r)
+	}(receivers[i])
+    }
+    wg.Wait()
+    close(errs)
+    registered := 0
+    for err := range errs {
+	if err == nil {
+	    registered++
+	}
+    }
+    if registered != 1 {
+	t.Fatalf("got=%d registered, expected=1", registered)
+    }
+
+    live := hub.receivers["desk"]
+    for _, r := range receivers {
+	if r != live {
+	    hub.RemoveReceiver(r)
+	}
+    }
+    if hub.receivers["desk"] != live {
+	t.Fatalf("removing a rejected receiver removed the live one")
+    }
+    hub.RemoveReceiver(live)
+    if hub.receivers["desk"] != nil {
+	t.Fatalf("live receiver was not removed")
+    }
+}
+
+func TestCronNext(t *testing.T) {
+    from := time.Date(2024, time.March, 15, 10, 30, 0, 0, time.UTC)
+    tests := []struct {
+	expr	    string
+	expected    time.Time
+    }{
+	{"*/15 * * * *", time.Date(2024, time.March, 15, 10, 45, 0, 0, time.UTC)},
+	{"0 9 * * 1-5", time.Date(2024, time.March, 18, 9, 0, 0, 0, time.UTC)},
+	{"@daily", time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+	{"30 2 1 * *", time.Date(2024, time.April, 1, 2, 30, 0, 0, time.UTC)},
+    }
+    for _, tt := range tests {
+	cron, err := ParseCron(tt.expr)
+	if err != nil {
+	    t.Fatalf("Error parsing %s: %v", tt.expr, err)
+	}
+	if got := cron.Next(from); !got.Equal(tt.expected) {
+	    t.Fatalf("%s: got=%v, expected=%v", tt.expr, got, tt.expected)
+	}
+    }
+    if _, err := ParseCron("61 * * * *"); err == nil {
+	t.Fatalf("expected error for out of range minute")
+    }
+}
+
+func TestSchedulerMissedRunPersistence(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "schedules.json")
+    hub := NewHub(&Config{})
+    scheduler := NewScheduler(hub, path)
+    at := time.Now().Add(-time.Minute)
+    created, err := scheduler.Create(Schedule{
+	At: &at,
+	ReceiverName: "desk",
+	FunctionKey: "backup",
+	MissedRun: MissedRunOnConnect,
+	Enabled: true,
+    })
+    if err != nil {
+	t.Fatalf("Error creating schedule: %v", err)
+    }
+
+    reloaded := NewScheduler(hub, path)
+    err = reloaded.Load()
+    if err != nil {
+	t.Fatalf("Error loading schedules: %v", err)
+    }
+    schedule, ok := reloaded.Get(created.Id)
+    if !ok {
+	t.Fatalf("Schedule %s was not persisted", created.Id)
+    }
+    if !schedule.Pending || schedule.NextRun != nil {
+	t.Fatalf("expected missed one-shot to be pending, got=%+v", schedule)
+    }
+}
+
+func TestSchedulerStuckReceiver(t *testing.T) {
+    hub := NewHub(&Config{})
+    functions := []MacronFunction{{Key: "lock", Name: "Lock"}}
+    stuck := &Receiver{name: "stuck", hub: hub, functions: &functions, egress: make(chan []byte, 1)}
+    stuck.egress <- []byte("{}")
+    desk := &Receiver{name: "desk", hub: hub, functions: &functions, egress: make(chan []byte)}
+    hub.receivers["stuck"] = stuck
+    hub.receivers["desk"] = desk
+    go func() {
+	for message := range desk.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(message, &msg)
+	    hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: "locked"})
+	}
+    }()
+
+    scheduler := NewScheduler(hub, "")
+    at := time.Now().Add(-time.Second)
+    blocked, _ := scheduler.Create(Schedule{At: &at, ReceiverName: "stuck", FunctionKey: "lock", Enabled: true})
+    ok, _ := scheduler.Create(Schedule{At: &at, ReceiverName: "desk", FunctionKey: "lock", Enabled: true})
+    scheduler.tick(time.Now())
+
+    // The stuck receiver must not hold up the other schedule.
+    waitStatus := func(id string, status string, within time.Duration) Schedule {
+	deadline := time.Now().Add(within)
+	for {
+	    schedule, _ := scheduler.Get(id)
+	    if schedule.LastStatus == status || time.Now().After(deadline) {
+		return schedule
+	    }
+	    time.Sleep(5 * time.Millisecond)
+	}
+    }
+    if got := waitStatus(ok.Id, "success", enqueueTimeout / 2); got.LastStatus != "success" {
+	t.Fatalf("got=%q, expected the desk schedule to finish while the other is stuck", got.LastStatus)
+    }
+
+    // The result lands on the schedule even when it is replaced mid-run.
+    blocked.Name = "renamed"
+    if _, err := scheduler.Update(blocked.Id, blocked); err != nil {
+	t.Fatalf("Error updating schedule: %v", err)
+    }
+    got := waitStatus(blocked.Id, "error", enqueueTimeout + 2 * time.Second)
+    if got.LastStatus != "error" || got.Name != "renamed" {
+	t.Fatalf("got=%+v, expected the updated schedule to record the error", got)
+    }
+}
+
+func TestWorkflowRun(t *testing.T) {
+    dir := t.TempDir()
+    definition := `
+name = "backup"
+
+[[steps]]
+id = "wake"
+wait_for = "nas"
+timeout = "2s"
+
+[[steps]]
+id = "prepare"
+[[steps.parallel]]
+id = "mount"
+receiver = "desk"
+function = "mount-share"
+[[steps.parallel]]
+id = "spin-up"
+receiver = "nas"
+function = "spin-up"
+
+[[steps]]
+id = "backup"
+receiver = "desk"
+function = "start-backup"
+if = "mount.output contains mounted"
+
+[[steps]]
+id = "notify"
+receiver = "desk"
+function = "missing"
+
+[[steps]]
+id = "never"
+[[steps.parallel]]
+id = "never-child"
+receiver = "desk"
+function = "start-backup"
 `
-    expected := Config {
-	Server: ServerConfig{
-	    AuthType: "password",
-	    Password: "foobar",
+    err := os.WriteFile(filepath.Join(dir, "backup.toml"), []byte(definition), 0600)
+    if err != nil {
+	t.Fatalf("Error writing workflow: %v", err)
+    }
+
+    hub := NewHub(&Config{})
+    hub.workflows = NewWorkflowRunner(hub, dir)
+    for name, keys := range map[string][]string{
+	"desk": {"mount-share", "start-backup"},
+	"nas": {"spin-up"},
+    } {
+	functions := make([]MacronFunction, 0)
+	for _, key := range keys {
+	    functions = append(functions, MacronFunction{Key: key, Name: key})
+	}
+	r := &Receiver{name: name, hub: hub, functions: &functions, egress: make(chan []byte)}
+	hub.receivers[name] = r
+	go func(r *Receiver) {
+	    for bytes := range r.egress {
+		var msg ReceiverResponse
+		json.Unmarshal(bytes, &msg)
+		hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: msg.Key + " mounted"})
+	    }
+	}(r)
+    }
+
+    // Fill the run history so finishing this run evicts the oldest.
+    for i := 0; i < workflowRunHistorySize; i++ {
+	id := fmt.Sprintf("old-%d", i)
+	hub.workflows.runs[id] = &WorkflowRun{Id: id, Status: "success"}
+	hub.workflows.finished = append(hub.workflows.finished, id)
+    }
+
+    done := make(chan WorkflowRun, 32)
+    _, err = hub.workflows.Start("backup", func(run WorkflowRun) {
+	if run.FinishedAt != nil {
+	    done <- run
+	}
+    })
+    if err != nil {
+	t.Fatalf("Error starting workflow: %v", err)
+    }
+
+    var run WorkflowRun
+    select {
+    case run = <-done:
+    case <-time.After(5 * time.Second):
+	t.Fatalf("Workflow did not finish")
+    }
+    expected := map[string]string{
+	"wake": "success",
+	"prepare": "success",
+	"mount": "success",
+	"spin-up": "success",
+	"backup": "success",
+	"notify": "failed",
+	"never": "skipped",
+	"never-child": "skipped",
+    }
+    if run.Status != "failed" {
+	t.Fatalf("got=%s, expected=failed", run.Status)
+    }
+    for _, step := range run.Steps {
+	if step.Status != expected[step.Id] {
+	    t.Fatalf("step %s: got=%s, expected=%s", step.Id, step.Status, expected[step.Id])
+	}
+    }
+
+    if _, ok := hub.workflows.Run(run.Id); !ok {
+	t.Fatalf("finished run %s was evicted", run.Id)
+    }
+    if _, ok := hub.workflows.Run("old-0"); ok {
+	t.Fatalf("oldest run was kept past the cap")
+    }
+    if got := len(hub.workflows.runs); got != workflowRunHistorySize {
+	t.Fatalf("got=%d runs, expected=%d", got, workflowRunHistorySize)
+    }
+}
+
+func TestWorkflowValidate(t *testing.T) {
+    exec := func(id string) WorkflowStep {
+	return WorkflowStep{Id: id, ReceiverName: "desk", FunctionKey: "lock"}
+    }
+    when := func(step WorkflowStep, cond string) WorkflowStep {
+	step.If = cond
+	return step
+    }
+    tests := []struct {
+	name        string
+	workflow    Workflow
+	valid       bool
+    }{
+	{"earlier step", Workflow{Name: "w", Steps: []WorkflowStep{exec("a"), when(exec("b"), "a.status == success")}}, true},
+	{"finished parallel child", Workflow{Name: "w", Steps: []WorkflowStep{
+	    {Id: "p", Parallel: []WorkflowStep{exec("a"), exec("b")}},
+	    when(exec("c"), "b.status == success"),
+	}}, true},
+	{"unknown step", Workflow{Name: "w", Steps: []WorkflowStep{when(exec("a"), "typo.status == success")}}, false},
+	{"later step", Workflow{Name: "w", Steps: []WorkflowStep{when(exec("a"), "b.status == success"), exec("b")}}, false},
+	{"own step", Workflow{Name: "w", Steps: []WorkflowStep{when(exec("a"), "a.status == success")}}, false},
+	{"parallel sibling", Workflow{Name: "w", Steps: []WorkflowStep{
+	    {Id: "p", Parallel: []WorkflowStep{exec("a"), when(exec("b"), "a.status == success")}},
+	}}, false},
+	{"negative retries", Workflow{Name: "w", Steps: []WorkflowStep{{Id: "a", ReceiverName: "desk", FunctionKey: "lock", Retries: -1}}}, false},
+	{"workflow on_failure", Workflow{Name: "w", OnFailure: "ignore", Steps: []WorkflowStep{exec("a")}}, false},
+	{"step on_failure", Workflow{Name: "w", Steps: []WorkflowStep{{Id: "a", ReceiverName: "desk", FunctionKey: "lock", OnFailure: "Abort"}}}, false},
+	{"known on_failure", Workflow{Name: "w", OnFailure: FailureContinue, Steps: []WorkflowStep{{Id: "a", ReceiverName: "desk", FunctionKey: "lock", OnFailure: FailureAbort}}}, true},
+    }
+    for _, tt := range tests {
+	err := tt.workflow.validate()
+	if (err == nil) != tt.valid {
+	    t.Fatalf("%s: got=%v, expected valid=%v", tt.name, err, tt.valid)
+	}
+    }
+}
+
+func TestHookHMAC(t *testing.T) {
+    hub := NewHub(&Config{
+	Hooks: []HookConfig{{
+	    Id: "deploy",
+	    Receiver: "desk",
+	    Function: "deploy",
+	    Args: map[string]interface{}{"ref": "{{ .ref }}", "env": "prod"},
+	    Auth: "hmac",
+	    Secret: "s3cret",
+	    Wait: "2s",
+	}},
+    })
+    functions := []MacronFunction{{Key: "deploy", Name: "Deploy"}}
+    r := &Receiver{name: "desk", hub: hub, functions: &functions, egress: make(chan []byte)}
+    hub.receivers["desk"] = r
+    go func() {
+	for bytes := range r.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(bytes, &msg)
+	    hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: fmt.Sprint(msg.Args["ref"], " ", msg.Args["env"])})
+	}
+    }()
+    router := setupRoutes(hub)
+
+    body := []byte(`{"ref": "refs/heads/main"}`)
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write(body)
+    tests := []struct {
+	signature   string
+	code	    int
+    }{
+	{"sha256=" + hex.EncodeToString(mac.Sum(nil)), http.StatusOK},
+	{"sha256=deadbeef", http.StatusUnauthorized},
+    }
+    for _, tt := range tests {
+	req := httptest.NewRequest(http.MethodPost, "/v2/hooks/deploy", bytes.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", tt.signature)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != tt.code {
+	    t.Fatalf("got=%d, expected=%d: %s", rec.Code, tt.code, rec.Body.String())
+	}
+	if tt.code != http.StatusOK {
+	    continue
+	}
+	var response ClientResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if response.Result == nil || response.Result.Output != "refs/heads/main prod" {
+	    t.Fatalf("unexpected hook response: %s", rec.Body.String())
+	}
+    }
+}
+
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+    var mu sync.Mutex
+    calls := 0
+    signatures := make([]string, 0)
+    flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	calls++
+	signatures = append(signatures, r.Header.Get("X-Macron-Signature"))
+	if calls < 3 {
+	    w.WriteHeader(http.StatusInternalServerError)
+	}
+    }))
+    defer flaky.Close()
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusBadGateway)
+    }))
+    defer down.Close()
+
+    dir := t.TempDir()
+    hub := NewHub(&Config{
+	Server: ServerConfig{DataDir: dir},
+	Webhooks: []WebhookConfig{
+	    {Url: flaky.URL, Events: []string{EventReceiverOffline}, Secret: "s3cret", Backoff: "1ms"},
+	    {Url: down.URL, MaxAttempts: 2, Backoff: "1ms"},
 	},
+    })
+    go hub.webhooks.Run()
+    for {
+	hub.webhooks.mu.Lock()
+	running := hub.webhooks.running
+	hub.webhooks.mu.Unlock()
+	if running {
+	    break
+	}
+	time.Sleep(time.Millisecond)
+    }
+
+    hub.emit(EventReceiverOffline, map[string]interface{}{"receiver_name": "nas"})
+    deadLetterPath := filepath.Join(dir, "webhooks-dead-letter.jsonl")
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+	_, err := os.Stat(deadLetterPath)
+	mu.Lock()
+	finished := err == nil && calls == 3
+	mu.Unlock()
+	if finished || time.Now().After(deadline) {
+	    break
+	}
+	time.Sleep(time.Millisecond)
+    }
+    hub.webhooks.Stop()
+    hub.webhooks.Wait(context.Background())
+
+    mu.Lock()
+    defer mu.Unlock()
+    if calls != 3 {
+	t.Fatalf("got=%d calls, expected=3", calls)
+    }
+    if !strings.HasPrefix(signatures[0], "sha256=") {
+	t.Fatalf("missing signature header: %q", signatures[0])
+    }
+    deadLetters, err := os.ReadFile(deadLetterPath)
+    if err != nil {
+	t.Fatalf("Error reading dead letters: %v", err)
+    }
+    if !strings.Contains(string(deadLetters), down.URL) {
+	t.Fatalf("dead letter log missing %s: %s", down.URL, deadLetters)
+    }
+}
+
+func TestWebhookStopDelivers(t *testing.T) {
+    var delivered atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	delivered.Add(1)
+    }))
+    defer server.Close()
+
+    hub := NewHub(&Config{Webhooks: []WebhookConfig{{Url: server.URL}}})
+    go hub.webhooks.Run()
+    for {
+	hub.webhooks.mu.Lock()
+	running := hub.webhooks.running
+	hub.webhooks.mu.Unlock()
+	if running {
+	    break
+	}
+	time.Sleep(time.Millisecond)
+    }
+    // Events still queued when Stop is called must be delivered before
+    // Wait returns, including a burst bigger than a regular subscriber's
+    // buffer.
+    burst := 4 * subscriberBuffer
+    for i := 0; i < burst; i++ {
+	hub.emit(EventReceiverOnline, map[string]interface{}{"receiver_name": "desk"})
+    }
+    hub.webhooks.Stop()
+    hub.webhooks.Wait(context.Background())
+    if got := delivered.Load(); got != int32(burst) {
+	t.Fatalf("got=%d deliveries, expected=%d", got, burst)
+    }
+
+    // Stopping a dispatcher that never ran must not hang.
+    idle := NewWebhookDispatcher(hub, "")
+    idle.Stop()
+    idle.Wait(context.Background())
+    idle.Run()
+}
+
+func TestWebhookStopDuringBackoff(t *testing.T) {
+    var calls atomic.Int32
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	calls.Add(1)
+	w.WriteHeader(http.StatusBadGateway)
+    }))
+    defer down.Close()
+    hung := make(chan struct{})
+    stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	<-hung
+    }))
+    defer stuck.Close()
+    defer close(hung)
+
+    dir := t.TempDir()
+    hub := NewHub(&Config{
+	Server: ServerConfig{DataDir: dir},
+	Webhooks: []WebhookConfig{{Url: down.URL, Backoff: "1h"}},
+    })
+    go hub.webhooks.Run()
+    for {
+	hub.webhooks.mu.Lock()
+	running := hub.webhooks.running
+	hub.webhooks.mu.Unlock()
+	if running {
+	    break
+	}
+	time.Sleep(time.Millisecond)
     }
-    var cfg Config 
-    err := toml.Unmarshal([]byte(testString), &cfg)
+    hub.emit(EventReceiverOnline, map[string]interface{}{"receiver_name": "desk"})
+    for calls.Load() == 0 {
+	time.Sleep(time.Millisecond)
+    }
+
+    // Stopping must cut the hour-long backoff short and dead-letter the
+    // delivery with the one attempt it made.
+    hub.webhooks.Stop()
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    if err := hub.webhooks.Wait(ctx); err != nil {
+	t.Fatalf("Wait did not return after Stop: %v", err)
+    }
+    deadLetters, err := os.ReadFile(filepath.Join(dir, "webhooks-dead-letter.jsonl"))
+    if err != nil {
+	t.Fatalf("Error reading dead letters: %v", err)
+    }
+    if !strings.Contains(string(deadLetters), `"attempts":1`) {
+	t.Fatalf("dead letter should record 1 attempt: %s", deadLetters)
+    }
+
+    // A delivery stuck in its request is bounded by the caller's ctx.
+    stuckHub := NewHub(&Config{Webhooks: []WebhookConfig{{Url: stuck.URL}}})
+    stuckHub.webhooks.dispatch(Event{Type: EventReceiverOnline})
+    stuckHub.webhooks.Stop()
+    ctx, cancel = context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    if err := stuckHub.webhooks.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+	t.Fatalf("got=%v, expected=%v", err, context.DeadlineExceeded)
+    }
+}
+
+func TestRESTExecFunction(t *testing.T) {
+    hub := NewHub(&Config{})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    id := 3
+    functions := []MacronFunction{{Id: &id, Key: "lock", Name: "Lock"}}
+    r := &Receiver{name: "desk", hub: hub, functions: &functions, egress: make(chan []byte)}
+    hub.receivers["desk"] = r
+    go func() {
+	for message := range r.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(message, &msg)
+	    hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: fmt.Sprintf("%s/%d", msg.Key, *msg.Id)})
+	}
+    }()
+    router := setupRoutes(hub)
+
+    tests := []struct {
+	method	    string
+	path	    string
+	token	    string
+	code	    int
+	output	    string
+    }{
+	{http.MethodGet, "/v2/receivers", "", http.StatusUnauthorized, ""},
+	{http.MethodGet, "/v2/receivers", "token", http.StatusOK, ""},
+	{http.MethodPost, "/v2/receivers/desk/functions/lock/exec?wait=2s", "token", http.StatusOK, "lock/3"},
+	{http.MethodPost, "/v2/receivers/desk/functions/3/exec?wait=2s", "token", http.StatusOK, "/3"},
+	{http.MethodPost, "/v2/receivers/desk/functions/sleep/exec", "token", http.StatusConflict, ""},
+	{http.MethodPost, "/v2/receivers/nas/functions/lock/exec", "token", http.StatusNotFound, ""},
+    }
+    for _, tt := range tests {
+	req := httptest.NewRequest(tt.method, tt.path, nil)
+	if tt.token != "" {
+	    req.Header.Set("Authorization", "Bearer " + tt.token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != tt.code {
+	    t.Fatalf("%s %s: got=%d, expected=%d: %s", tt.method, tt.path, rec.Code, tt.code, rec.Body.String())
+	}
+	if tt.output == "" {
+	    continue
+	}
+	var response ClientResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if response.Result == nil || response.Result.Output != tt.output {
+	    t.Fatalf("%s: unexpected response: %s", tt.path, rec.Body.String())
+	}
+    }
+}
+
+func TestEventStreamResume(t *testing.T) {
+    hub := NewHub(&Config{})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    hub.emit(EventReceiverOnline, map[string]interface{}{"receiver_name": "desk"})
+    hub.emit(EventExecStarted, map[string]interface{}{"receiver_name": "desk"})
+    hub.emit(EventReceiverOnline, map[string]interface{}{"receiver_name": "nas"})
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+
+    req, _ := http.NewRequest(http.MethodGet, server.URL + "/v2/events?types=receiver.*", nil)
+    req.Header.Set("Authorization", "Bearer token")
+    req.Header.Set("Last-Event-ID", "1")
+    resp, err := http.DefaultClient.Do(req)
     if err != nil {
-	t.Fatalf("Error unmarshalling config string: %v", err)
+	t.Fatalf("Error connecting to event stream: %v", err)
+    }
+    defer resp.Body.Close()
+
+    hub.emit(EventExecFinished, map[string]interface{}{"receiver_name": "desk"})
+    hub.emit(EventReceiverOffline, map[string]interface{}{"receiver_name": "desk"})
+
+    scanner := bufio.NewScanner(resp.Body)
+    ids := make([]string, 0)
+    for len(ids) < 2 && scanner.Scan() {
+	if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+	    ids = append(ids, id)
+	}
+    }
+    if !reflect.DeepEqual(ids, []string{"3", "5"}) {
+	t.Fatalf("got=%v, expected=[3 5]", ids)
+    }
+}
+
+func TestEventSubscriberOverflow(t *testing.T) {
+    bus := NewEventBus()
+    events, unsubscribe := bus.Subscribe()
+    defer unsubscribe()
+    for i := 0; i < subscriberBuffer + 1; i++ {
+	bus.Publish(EventExecStarted, nil)
+    }
+
+    // A subscriber that falls behind is closed, not silently skipped, and
+    // can resume from the last id it read without missing anything.
+    var lastId uint64
+    for event := range events {
+	lastId = event.Id
     }
-    if cfg != expected {
-	t.Fatalf("got=%v, expected=%v", cfg, expected)
+    if lastId != subscriberBuffer {
+	t.Fatalf("got=%d, expected=%d", lastId, subscriberBuffer)
     }
+    replay, _, resume := bus.SubscribeSince(lastId)
+    defer resume()
+    if len(replay) != 1 || replay[0].Id != subscriberBuffer + 1 {
+	t.Fatalf("unexpected replay after overflow: %+v", replay)
+    }
+    if got := bus.backlog(); got != 0 {
+	t.Fatalf("got=%d backlog, expected=0", got)
+    }
+}
 
+// TestProtocolV3Interop connects v2 and v3 clients and receivers to one hub
+// and checks that catalogs and execs flow between every pairing.
+func TestProtocolV3Interop(t *testing.T) {
+    hub := NewHub(&Config{})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+    dial := func(path string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL + path, nil)
+	if err != nil {
+	    t.Fatalf("Error dialing %s: %v", path, err)
+	}
+	return conn
+    }
+    hello := func(conn *websocket.Conn, payload HelloPayload) Envelope {
+	raw, _ := json.Marshal(payload)
+	conn.WriteJSON(Envelope{Id: "hello", Type: "hello", Payload: raw})
+	var env Envelope
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := conn.ReadJSON(&env)
+	if err != nil {
+	    t.Fatalf("Error reading hello reply: %v", err)
+	}
+	if env.ReplyTo != "hello" {
+	    t.Fatalf("got reply_to=%s, expected=hello", env.ReplyTo)
+	}
+	return env
+    }
+    catalog := func(name string) []MacronFunction {
+	id := 1
+	return []MacronFunction{{Id: &id, Key: "lock", Name: name}}
+    }
+
+    legacy := dial("/v2/receiver?session_token=token")
+    defer legacy.Close()
+    legacy.WriteJSON(ReceiverInbound{Type: "auth", ReceiverName: "legacy"})
+    legacy.ReadMessage()
+    go func() {
+	for {
+	    var msg ReceiverResponse
+	    if legacy.ReadJSON(&msg) != nil {
+		return
+	    }
+	    switch msg.Type {
+	    case "functions":
+		functions := catalog("Legacy Lock")
+		legacy.WriteJSON(ReceiverInbound{Type: "functions", ClientId: msg.ClientId, Functions: &functions})
+	    case "exec":
+		legacy.WriteJSON(ReceiverInbound{Type: "exec_result", ExecId: msg.ExecId, Output: "legacy"})
+	    }
+	}
+    }()
+
+    modern := dial("/v3/ws")
+    defer modern.Close()
+    env := hello(modern, HelloPayload{Role: "receiver", Versions: []int{3}, SessionToken: "token", ReceiverName: "modern"})
+    var reply HelloReply
+    json.Unmarshal(env.Payload, &reply)
+    if reply.Version != 3 || reply.ReceiverName != "modern" {
+	t.Fatalf("got=%+v, expected version 3 for modern", reply)
+    }
+    go func() {
+	for {
+	    var env Envelope
+	    if modern.ReadJSON(&env) != nil {
+		return
+	    }
+	    var msg map[string]interface{}
+	    json.Unmarshal(env.Payload, &msg)
+	    if _, ok := msg["client_id"]; ok {
+		t.Errorf("v3 receiver was sent a client_id: %s", env.Payload)
+	    }
+	    var out interface{}
+	    switch env.Type {
+	    case "functions":
+		out = map[string]interface{}{"functions": catalog("Modern Lock")}
+	    case "exec":
+		out = map[string]interface{}{"exec_id": msg["exec_id"], "output": "modern"}
+		env.Type = "exec_result"
+	    default:
+		continue
+	    }
+	    raw, _ := json.Marshal(out)
+	    modern.WriteJSON(Envelope{Id: "r-" + env.Id, Type: env.Type, ReplyTo: env.Id, Payload: raw})
+	}
+    }()
+    for len(hub.GetReceivers()) < 2 {
+	time.Sleep(time.Millisecond)
+    }
+
+    v3 := dial("/v3/ws")
+    defer v3.Close()
+    env = hello(v3, HelloPayload{Role: "client", Versions: []int{2, 3, 4}, Features: []string{"broadcast", "teleport"}, SessionToken: "token"})
+    json.Unmarshal(env.Payload, &reply)
+    if reply.Version != 3 || !reflect.DeepEqual(reply.Features, []string{"broadcast"}) {
+	t.Fatalf("got=%+v, expected version 3 with only broadcast", reply)
+    }
+    v2 := dial("/v2/client?session_token=token")
+    defer v2.Close()
+    v2.ReadMessage()
+
+    for _, receiver := range []string{"legacy", "modern"} {
+	for i, request := range []map[string]interface{}{
+	    {"receiver_name": receiver},
+	    {"receiver_name": receiver, "function_key": "lock"},
+	} {
+	    msgType := []string{"functions", "exec"}[i]
+	    expected := []string{"functions", "exec_result"}[i]
+
+	    raw, _ := json.Marshal(request)
+	    id := msgType + "-" + receiver
+	    v3.WriteJSON(Envelope{Id: id, Type: msgType, Payload: raw})
+	    var env Envelope
+	    v3.SetReadDeadline(time.Now().Add(5 * time.Second))
+	    err := v3.ReadJSON(&env)
+	    if err != nil {
+		t.Fatalf("v3 %s on %s: %v", msgType, receiver, err)
+	    }
+	    var v3Response ClientResponse
+	    fromEnvelope(env, &v3Response)
+	    if env.Type != expected || env.ReplyTo != id || v3Response.ReceiverName != receiver {
+		t.Fatalf("v3 %s on %s: got=%+v, expected %s replying to %s", msgType, receiver, env, expected, id)
+	    }
+
+	    request["type"] = msgType
+	    v2.WriteJSON(request)
+	    var v2Response ClientResponse
+	    v2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	    err = v2.ReadJSON(&v2Response)
+	    if err != nil || v2Response.Type != expected {
+		t.Fatalf("v2 %s on %s: got=%+v, expected %s: %v", msgType, receiver, v2Response, expected, err)
+	    }
+	    if expected == "exec_result" && (v3Response.Result.Output != receiver || v2Response.Result.Output != receiver) {
+		t.Fatalf("exec on %s: got=%s and %s", receiver, v3Response.Result.Output, v2Response.Result.Output)
+	    }
+	}
+    }
+
+    unsupported := dial("/v3/ws")
+    defer unsupported.Close()
+    env = hello(unsupported, HelloPayload{Role: "client", Versions: []int{4}, SessionToken: "token"})
+    var errPayload ErrorPayload
+    json.Unmarshal(env.Payload, &errPayload)
+    if env.Type != "error" || errPayload.Code != "unsupported_version" {
+	t.Fatalf("got=%+v, expected unsupported_version", env)
+    }
+}
+
+func TestRPC(t *testing.T) {
+    hub := NewHub(&Config{})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    id := 3
+    functions := []MacronFunction{{Id: &id, Key: "lock", Name: "Lock"}, {Key: "sleep", Name: "Sleep"}}
+    r := &Receiver{name: "desk", hub: hub, functions: &functions, egress: make(chan []byte)}
+    hub.receivers["desk"] = r
+    canceled := make(chan string, 1)
+    go func() {
+	for message := range r.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(message, &msg)
+	    switch {
+	    case msg.Type == "cancel":
+		canceled <- msg.ExecId
+	    case msg.Key == "lock":
+		hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Output: "locked"})
+	    }
+	}
+    }()
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+
+    post := func(body string) (int, string) {
+	req, _ := http.NewRequest(http.MethodPost, server.URL + "/v3/rpc", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+	    t.Fatalf("Error posting %s: %v", body, err)
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(buf.String())
+    }
+
+    tests := []struct {
+	body        string
+	code        int
+	expected    string
+    }{
+	{`{"jsonrpc": "2.0", "method": "receivers.list", "id": 1}`, http.StatusOK, `{"jsonrpc":"2.0","result":["desk"],"id":1}`},
+	{`{"jsonrpc": "2.0", "method": "receivers.list"}`, http.StatusNoContent, ``},
+	{`{"jsonrpc": "2.0", "method": "nope", "id": "a"}`, http.StatusOK, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"a"}`},
+	{`{"jsonrpc": "2.0", "method": "functions.list", "params": {"receiver": "desk"}, "id": 2}`, http.StatusOK, `"code":-32602`},
+	{`{"jsonrpc": "2.0", "method": "functions.exec", "params": {"receiver_name": "nas", "function_key": "lock"}, "id": 3}`, http.StatusOK, `"code":-32000`},
+	{`{"jsonrpc": "2.0", "method": "functions.exec", "params": {"receiver_name": "desk", "function_key": "gone"}, "id": 4}`, http.StatusOK, `"code":-32001`},
+	{`{"jsonrpc": "2.0", "method": "exec.cancel", "params": {"exec_id": "gone"}, "id": 5}`, http.StatusOK, `"code":-32002`},
+	{`{"jsonrpc": "2.0", "method"`, http.StatusOK, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+	{`[]`, http.StatusOK, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+	{`[1, {"jsonrpc": "2.0", "method": "receivers.list"}]`, http.StatusOK, `[{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`},
+	{`[{"jsonrpc": "2.0", "method": "functions.exec", "params": {"receiver_name": "desk", "function_key": "lock", "wait": "2s"}, "id": 6}, {"jsonrpc": "2.0", "method": "history.query", "params": {"receiver_name": "desk"}, "id": 7}]`, http.StatusOK, `"output":"locked"`},
+	{`{"jsonrpc": "2.0", "method": "history.query", "params": {"function_key": "lock", "limit": 1}, "id": 8}`, http.StatusOK, `"status":"success"`},
+    }
+    for _, tt := range tests {
+	code, body := post(tt.body)
+	if code != tt.code || !strings.Contains(body, tt.expected) {
+	    t.Fatalf("%s: got=%d %s, expected=%d %s", tt.body, code, body, tt.code, tt.expected)
+	}
+    }
+
+    // Successes always carry result, even when it is a zero value, and
+    // errors never do.
+    control := &rpcSession{hub: NewHub(&Config{}), control: &ControlServer{}}
+    control.control.hub = control.hub
+    for _, tt := range []struct {
+	body        string
+	expected    string
+    }{
+	{`{"jsonrpc": "2.0", "method": "sessions.revoke", "params": {"all": true}, "id": 1}`, `{"jsonrpc":"2.0","result":0,"id":1}`},
+	{`{"jsonrpc": "2.0", "method": "sessions.revoke", "params": {}, "id": 2}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":"id or all is required"},"id":2}`},
+    } {
+	if got := string(control.handle([]byte(tt.body))); got != tt.expected {
+	    t.Fatalf("%s: got=%s, expected=%s", tt.body, got, tt.expected)
+	}
+    }
+
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+    ws, _, err := websocket.DefaultDialer.Dial(wsURL + "/v3/rpc?session_token=token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting: %v", err)
+    }
+    defer ws.Close()
+    read := func() map[string]interface{} {
+	var msg map[string]interface{}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := ws.ReadJSON(&msg)
+	if err != nil {
+	    t.Fatalf("Error reading: %v", err)
+	}
+	return msg
+    }
+    ws.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "functions.exec", "params": map[string]interface{}{"receiver_name": "desk", "function_key": "sleep"}, "id": 1})
+    started, _ := read()["result"].(map[string]interface{})
+    execId, _ := started["exec_id"].(string)
+    if execId == "" {
+	t.Fatalf("got=%v, expected an exec id", started)
+    }
+    ws.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "exec.cancel", "params": map[string]interface{}{"exec_id": execId}, "id": 2})
+    for i := 0; i < 2; i++ {
+	msg := read()
+	if msg["method"] == "exec.result" {
+	    params, _ := msg["params"].(map[string]interface{})
+	    if params["exec_id"] != execId || params["status"] != "canceled" {
+		t.Fatalf("got=%v, expected canceled notification for %s", msg, execId)
+	    }
+	} else if result, _ := msg["result"].(map[string]interface{}); result["status"] != "canceled" {
+	    t.Fatalf("got=%v, expected canceled result", msg)
+	}
+    }
+    if got := <-canceled; got != execId {
+	t.Fatalf("got=%s, expected receiver to be told to cancel %s", got, execId)
+    }
+}
+
+// TestWireEncodings runs a MessagePack receiver against JSON and CBOR
+// clients through the same hub.
+func TestWireEncodings(t *testing.T) {
+    hub := NewHub(&Config{})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+    dial := func(path string, subprotocol string) *websocket.Conn {
+	dialer := websocket.Dialer{}
+	if subprotocol != "" {
+	    dialer.Subprotocols = []string{subprotocol}
+	}
+	conn, _, err := dialer.Dial(wsURL + path, nil)
+	if err != nil {
+	    t.Fatalf("Error dialing %s: %v", path, err)
+	}
+	if conn.Subprotocol() != subprotocol {
+	    t.Fatalf("got subprotocol=%q, expected=%q", conn.Subprotocol(), subprotocol)
+	}
+	return conn
+    }
+    encode := func(h codec.Handle, v interface{}) []byte {
+	var out []byte
+	codec.NewEncoderBytes(&out, h).MustEncode(v)
+	return out
+    }
+
+    receiver := dial("/v2/receiver?session_token=token", subprotocolMsgpack)
+    defer receiver.Close()
+    receiver.WriteMessage(websocket.BinaryMessage, encode(msgpackHandle, map[string]interface{}{
+	"type": "auth",
+	"receiver_name": "pi",
+	"functions": []map[string]interface{}{{"id": 7, "key": "lock", "name": "Lock", "description": ""}},
+    }))
+    receiver.ReadMessage()
+    ids := make(chan interface{}, 2)
+    go func() {
+	for {
+	    messageType, raw, err := receiver.ReadMessage()
+	    if err != nil {
+		return
+	    }
+	    if messageType != websocket.BinaryMessage {
+		t.Errorf("got message type %d, expected binary", messageType)
+	    }
+	    var msg map[string]interface{}
+	    codec.NewDecoderBytes(raw, msgpackHandle).MustDecode(&msg)
+	    ids <- msg["id"]
+	    receiver.WriteMessage(websocket.BinaryMessage, encode(msgpackHandle, map[string]interface{}{
+		"type": "exec_result",
+		"exec_id": msg["exec_id"],
+		"output": "locked",
+	    }))
+	}
+    }()
+    for len(hub.GetReceivers()) == 0 {
+	time.Sleep(time.Millisecond)
+    }
+
+    tests := []struct {
+	subprotocol string
+	handle      codec.Handle
+    }{
+	{"", nil},
+	{subprotocolJSON, nil},
+	{subprotocolCBOR, cborHandle},
+    }
+    for _, tt := range tests {
+	client := dial("/v2/client?session_token=token", tt.subprotocol)
+	client.ReadMessage()
+	request := map[string]interface{}{"type": "exec", "receiver_name": "pi", "function_key": "lock"}
+	if tt.handle == nil {
+	    client.WriteJSON(request)
+	} else {
+	    client.WriteMessage(websocket.BinaryMessage, encode(tt.handle, request))
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, raw, err := client.ReadMessage()
+	if err != nil {
+	    t.Fatalf("%q: error reading result: %v", tt.subprotocol, err)
+	}
+	var response map[string]interface{}
+	if tt.handle == nil {
+	    err = json.Unmarshal(raw, &response)
+	} else {
+	    err = codec.NewDecoderBytes(raw, tt.handle).Decode(&response)
+	}
+	result, _ := response["result"].(map[string]interface{})
+	if err != nil || result["output"] != "locked" {
+	    t.Fatalf("%q: got=%v, expected exec_result with output locked: %v", tt.subprotocol, response, err)
+	}
+	if id := <-ids; id != int64(7) && id != uint64(7) {
+	    t.Fatalf("%q: receiver got id=%v (%T), expected integer 7", tt.subprotocol, id, id)
+	}
+	client.Close()
+    }
+}
+
+func TestMessageSizeLimits(t *testing.T) {
+    hub := NewHub(&Config{WebSocket: WebSocketConfig{Compression: true, MaxClientMessage: 1024, MaxReceiverMessage: 4096}})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+    dialer := websocket.Dialer{EnableCompression: true}
+
+    receiver, _, err := dialer.Dial(wsURL + "/v2/receiver?session_token=token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting receiver: %v", err)
+    }
+    defer receiver.Close()
+    functions := make([]map[string]interface{}, 0)
+    for i := 0; i < 20; i++ {
+	functions = append(functions, map[string]interface{}{"id": i, "name": fmt.Sprintf("Function %d", i), "description": strings.Repeat("x", 80)})
+    }
+    receiver.WriteJSON(map[string]interface{}{"type": "auth", "receiver_name": "desk", "functions": functions})
+    var auth ReceiverResponse
+    if err := receiver.ReadJSON(&auth); err != nil || auth.Type != "auth_success" {
+	t.Fatalf("got=%+v, expected a %d byte catalog to fit the receiver limit: %v", auth, len(fmt.Sprint(functions)), err)
+    }
+
+    tests := []struct {
+	name        string
+	compress    bool
+	size        int
+	expected    string
+    }{
+	{"under limit", false, 512, "receivers"},
+	{"over limit", false, 1536, "message_too_large"},
+	// Past twice the limit the WebSocket layer closes before reading it.
+	{"far over limit", false, 8192, ""},
+	// Compresses to well under the wire limit but inflates past it.
+	{"compressed over limit", true, 64 << 10, "message_too_large"},
+    }
+    for _, tt := range tests {
+	client, _, err := dialer.Dial(wsURL + "/v2/client?session_token=token", nil)
+	if err != nil {
+	    t.Fatalf("%s: error connecting client: %v", tt.name, err)
+	}
+	client.ReadMessage()
+	client.EnableWriteCompression(tt.compress)
+	message := fmt.Sprintf(`{"type": "receivers", "selector": "%s"}`, strings.Repeat("a", tt.size))
+	client.WriteMessage(websocket.TextMessage, []byte(message))
+
+	var response ClientResponse
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = client.ReadJSON(&response)
+	if tt.expected == "" {
+	    if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("%s: got=%v, expected close 1009", tt.name, err)
+	    }
+	} else if err != nil {
+	    t.Fatalf("%s: error reading response: %v", tt.name, err)
+	} else if tt.expected == "receivers" {
+	    if response.Type != "receivers" {
+		t.Fatalf("%s: got=%+v, expected receivers", tt.name, response)
+	    }
+	} else {
+	    if response.Code != tt.expected {
+		t.Fatalf("%s: got=%+v, expected code %s", tt.name, response, tt.expected)
+	    }
+	    _, _, err = client.ReadMessage()
+	    if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("%s: got=%v, expected close 1009", tt.name, err)
+	    }
+	}
+	client.Close()
+    }
+
+    req, _ := http.NewRequest(http.MethodPost, server.URL + "/v3/rpc", strings.NewReader(strings.Repeat(" ", 2048) + `{"jsonrpc": "2.0", "method": "receivers.list", "id": 1}`))
+    req.Header.Set("Authorization", "Bearer token")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+	t.Fatalf("Error posting: %v", err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusRequestEntityTooLarge {
+	t.Fatalf("got=%d, expected=%d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+    }
+}
+
+// countingConn counts the bytes a benchmark client reads off the wire.
+type countingConn struct {
+    net.Conn
+    read    *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    atomic.AddInt64(c.read, int64(n))
+    return n, err
+}
+
+// BenchmarkCatalogTransfer fetches a 500 function catalog through the hub
+// for each encoding, with and without compression, and reports the bytes the
+// client received per fetch.
+func BenchmarkCatalogTransfer(b *testing.B) {
+    functions := make([]MacronFunction, 500)
+    for i := range functions {
+	id := i
+	functions[i] = MacronFunction{
+	    Id: &id,
+	    Key: fmt.Sprintf("macro-%d", i),
+	    Name: fmt.Sprintf("Macro %d", i),
+	    Description: "Runs a keyboard macro on the desktop receiver.",
+	}
+    }
+    for _, subprotocol := range []string{subprotocolJSON, subprotocolMsgpack, subprotocolCBOR} {
+	for _, compress := range []bool{false, true} {
+	    name := strings.TrimPrefix(subprotocol, "macron.")
+	    if compress {
+		name += "+deflate"
+	    }
+	    b.Run(name, func(b *testing.B) {
+		hub := NewHub(&Config{WebSocket: WebSocketConfig{Compression: compress}})
+		hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+		server := httptest.NewServer(setupRoutes(hub))
+		defer server.Close()
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+		var read int64
+		dialer := websocket.Dialer{
+		    Subprotocols: []string{subprotocol},
+		    EnableCompression: compress,
+		    NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{Conn: conn, read: &read}, err
+		    },
+		}
+		receiver, _, err := (&websocket.Dialer{Subprotocols: []string{subprotocol}, EnableCompression: compress}).Dial(wsURL + "/v2/receiver?session_token=token", nil)
+		if err != nil {
+		    b.Fatalf("Error connecting receiver: %v", err)
+		}
+		defer receiver.Close()
+		writeWire(receiver, ReceiverInbound{Type: "auth", ReceiverName: "desk"})
+		receiver.ReadMessage()
+		go func() {
+		    for {
+			var msg ReceiverResponse
+			if readWire(receiver, 1 << 20, &msg) != nil {
+			    return
+			}
+			writeWire(receiver, ReceiverInbound{Type: "functions", ClientId: msg.ClientId, Functions: &functions})
+		    }
+		}()
+		for len(hub.GetReceivers()) == 0 {
+		    time.Sleep(time.Millisecond)
+		}
+		client, _, err := dialer.Dial(wsURL + "/v2/client?session_token=token", nil)
+		if err != nil {
+		    b.Fatalf("Error connecting client: %v", err)
+		}
+		defer client.Close()
+		client.ReadMessage()
+
+		atomic.StoreInt64(&read, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+		    writeWire(client, ClientInbound{Type: "functions", ReceiverName: "desk"})
+		    var response ClientResponse
+		    err := readWire(client, 1 << 20, &response)
+		    if err != nil || response.Functions == nil || len(*response.Functions) != len(functions) {
+			b.Fatalf("got=%v, expected the catalog: %v", response.Type, err)
+		    }
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&read)) / float64(b.N), "wire-B/op")
+	    })
+	}
+    }
+}
+
+func TestOriginPolicy(t *testing.T) {
+    hub := NewHub(&Config{Server: ServerConfig{AllowedOrigins: []string{"https://dash.example.com"}}})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+    origins := []struct {
+	origin  string
+	allowed bool
+    }{
+	{"", true},
+	{server.URL, true},
+	{"https://dash.example.com", true},
+	{"https://evil.example.com", false},
+    }
+    for _, path := range []string{"/v2/client", "/v2/receiver", "/v3/ws", "/v3/rpc"} {
+	for _, tt := range origins {
+	    header := http.Header{}
+	    if tt.origin != "" {
+		header.Set("Origin", tt.origin)
+	    }
+	    conn, resp, err := websocket.DefaultDialer.Dial(wsURL + path + "?session_token=token", header)
+	    if tt.allowed && err != nil {
+		t.Fatalf("%s from %q: expected upgrade, got %v", path, tt.origin, err)
+	    }
+	    if !tt.allowed && (err == nil || resp.StatusCode != http.StatusForbidden) {
+		t.Fatalf("%s from %q: expected 403, got %v", path, tt.origin, err)
+	    }
+	    if conn != nil {
+		conn.Close()
+	    }
+	}
+    }
+
+    tests := []struct {
+	method      string
+	path        string
+	origin      string
+	code        int
+	allowOrigin string
+    }{
+	{http.MethodOptions, "/v2/login", "https://dash.example.com", http.StatusNoContent, "https://dash.example.com"},
+	{http.MethodOptions, "/v2/login", "https://evil.example.com", http.StatusForbidden, ""},
+	{http.MethodGet, "/info", "https://dash.example.com", http.StatusOK, "https://dash.example.com"},
+	{http.MethodGet, "/info", "https://evil.example.com", http.StatusOK, ""},
+	{http.MethodGet, "/info", "", http.StatusOK, ""},
+    }
+    router := setupRoutes(hub)
+    for _, tt := range tests {
+	req := httptest.NewRequest(tt.method, tt.path, nil)
+	if tt.origin != "" {
+	    req.Header.Set("Origin", tt.origin)
+	}
+	if tt.method == http.MethodOptions {
+	    req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != tt.code || rec.Header().Get("Access-Control-Allow-Origin") != tt.allowOrigin {
+	    t.Fatalf("%s %s from %q: got=%d %q, expected=%d %q", tt.method, tt.path, tt.origin, rec.Code, rec.Header().Get("Access-Control-Allow-Origin"), tt.code, tt.allowOrigin)
+	}
+	if tt.code == http.StatusNoContent && rec.Header().Get("Access-Control-Allow-Headers") == "" {
+	    t.Fatalf("%s %s: preflight is missing Access-Control-Allow-Headers", tt.method, tt.path)
+	}
+    }
+}
+
+func TestGracefulShutdown(t *testing.T) {
+    dir := t.TempDir()
+    hub := NewHub(&Config{Server: ServerConfig{DataDir: dir, RestartHint: "10s"}})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+    receiver, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/receiver?session_token=token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting receiver: %v", err)
+    }
+    defer receiver.Close()
+    receiver.WriteJSON(map[string]interface{}{"type": "auth", "receiver_name": "desk", "functions": []map[string]interface{}{
+	{"id": 1, "key": "fast", "name": "Fast"},
+	{"id": 2, "key": "slow", "name": "Slow"},
+    }})
+    var auth ReceiverResponse
+    if err := receiver.ReadJSON(&auth); err != nil || auth.Type != "auth_success" {
+	t.Fatalf("got=%+v, expected auth_success: %v", auth, err)
+    }
+    client, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/client?session_token=token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting client: %v", err)
+    }
+    defer client.Close()
+    client.ReadMessage()
+
+    exec := func(key string) int {
+	req, _ := http.NewRequest(http.MethodPost, server.URL + "/v2/receivers/desk/functions/" + key + "/exec?wait=5s", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+	    return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+    }
+    results := make(map[string]chan ExecResult)
+    for _, key := range []string{"fast", "slow"} {
+	done := make(chan ExecResult, 1)
+	results[key] = done
+	go func(key string) {
+	    req, _ := http.NewRequest(http.MethodPost, server.URL + "/v2/receivers/desk/functions/" + key + "/exec?wait=5s", nil)
+	    req.Header.Set("Authorization", "Bearer token")
+	    resp, err := http.DefaultClient.Do(req)
+	    if err != nil {
+		close(done)
+		return
+	    }
+	    defer resp.Body.Close()
+	    var response ClientResponse
+	    json.NewDecoder(resp.Body).Decode(&response)
+	    if response.Result != nil {
+		done <- *response.Result
+	    }
+	    close(done)
+	}(key)
+    }
+    for deadline := time.Now().Add(2 * time.Second); ; {
+	hub.mu.Lock()
+	pending := len(hub.execs)
+	hub.mu.Unlock()
+	if pending == 2 {
+	    break
+	}
+	if time.Now().After(deadline) {
+	    t.Fatalf("got=%d pending execs, expected=2", pending)
+	}
+	time.Sleep(10 * time.Millisecond)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+    defer cancel()
+    shutdownErr := make(chan error, 1)
+    go func() {
+	shutdownErr <- hub.Shutdown(ctx, "terminated")
+    }()
+
+    // The receiver only finishes the fast exec once it has been told about
+    // the shutdown, so the hub must still be draining at that point.
+    fastId := ""
+    notified := false
+    receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+    for {
+	var msg ReceiverResponse
+	err := receiver.ReadJSON(&msg)
+	if err != nil {
+	    if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("got=%v, expected close 1001", err)
+	    }
+	    break
+	}
+	switch msg.Type {
+	case "exec":
+	    if msg.Key == "fast" {
+		fastId = msg.ExecId
+	    }
+	case "server_shutdown":
+	    if msg.Reason != "terminated" || msg.RestartIn != 10 {
+		t.Fatalf("got=%+v, expected reason and restart hint", msg)
+	    }
+	    notified = true
+	}
+	if notified && fastId != "" {
+	    receiver.WriteJSON(map[string]interface{}{"type": "exec_result", "exec_id": fastId, "output": "done"})
+	    fastId = ""
+	}
+    }
+    if !notified {
+	t.Fatalf("Receiver was not sent server_shutdown")
+    }
+
+    var notice ClientResponse
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if err := client.ReadJSON(&notice); err != nil || notice.Type != "server_shutdown" || notice.RestartIn != 10 {
+	t.Fatalf("got=%+v, expected server_shutdown: %v", notice, err)
+    }
+    if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+	t.Fatalf("got=%v, expected close 1001", err)
+    }
+
+    if err := <-shutdownErr; !errors.Is(err, context.DeadlineExceeded) {
+	t.Fatalf("got=%v, expected the slow exec to hit the deadline", err)
+    }
+    expected := map[string]string{"fast": "success", "slow": "shutdown"}
+    for key, status := range expected {
+	result, ok := <-results[key]
+	if !ok || result.Status != status {
+	    t.Fatalf("%s: got=%+v, expected status %s", key, result, status)
+	}
+    }
+    if _, err := os.Stat(filepath.Join(dir, "schedules.json")); err != nil {
+	t.Fatalf("Schedules were not saved: %v", err)
+    }
+
+    _, resp, err := websocket.DefaultDialer.Dial(wsURL + "/v2/client?session_token=token", nil)
+    if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+	t.Fatalf("got=%v, expected 503 for a new connection", err)
+    }
+    if code := exec("fast"); code != http.StatusServiceUnavailable {
+	t.Fatalf("got=%d, expected 503 for a new exec", code)
+    }
+}
+
+func TestConfigReload(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "config.toml")
+    write := func(password string, extra string) {
+	config := fmt.Sprintf("[Server]\nauth_type = \"password\"\npassword = %q\ndata_dir = %q\n%s", password, dir, extra)
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+	    t.Fatalf("Error writing config: %v", err)
+	}
+    }
+    write("old", "")
+    config, err := loadConfig(path)
+    if err != nil {
+	t.Fatalf("Error loading config: %v", err)
+    }
+    hub := NewHub(config)
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+    login := func(password string) (*websocket.Conn, string) {
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL + "/v1/ws/client", nil)
+	if err != nil {
+	    t.Fatalf("Error connecting client: %v", err)
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "auth", "password": password})
+	var response ClientResponse
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.ReadJSON(&response)
+	return conn, response.Type
+    }
+    client, status := login("old")
+    if status != "auth_success" {
+	t.Fatalf("got=%s, expected auth_success", status)
+    }
+    defer client.Close()
+
+    write("new", "allowed_origins = [\"https://dash.example.com\"]\n[websocket]\nread_buffer_size = 8192\n")
+    pending, err := hub.ReloadConfig(ConfigSource{Path: path})
+    if err != nil {
+	t.Fatalf("Error reloading config: %v", err)
+    }
+    if !reflect.DeepEqual(pending, []string{"websocket.read_buffer_size"}) {
+	t.Fatalf("got=%v, expected only read_buffer_size to need a restart", pending)
+    }
+    if hub.config().WebSocket.ReadBufferSize != defaultReadBufferSize || len(hub.config().Server.AllowedOrigins) != 1 {
+	t.Fatalf("got=%+v, expected allowed_origins applied and read_buffer_size kept", hub.config())
+    }
+
+    // The connection made with the old password survives the reload.
+    client.WriteJSON(map[string]interface{}{"type": "receivers"})
+    var response ClientResponse
+    if err := client.ReadJSON(&response); err != nil || response.Type != "receivers" {
+	t.Fatalf("got=%+v, expected the existing client to keep working: %v", response, err)
+    }
+    tests := []struct {
+	password    string
+	expected    string
+    }{
+	{"old", "error"},
+	{"new", "auth_success"},
+    }
+    for _, tt := range tests {
+	conn, status := login(tt.password)
+	conn.Close()
+	if status != tt.expected {
+	    t.Fatalf("%s: got=%s, expected=%s", tt.password, status, tt.expected)
+	}
+    }
+
+    write("", "")
+    if _, err := hub.ReloadConfig(ConfigSource{Path: path}); err == nil || hub.config().Server.Password != "new" {
+	t.Fatalf("got=%v, expected an invalid config to be rejected", err)
+    }
+
+    watcher := NewConfigWatcher(hub, ConfigSource{Path: path})
+    watcher.interval = 10 * time.Millisecond
+    go watcher.Run()
+    defer watcher.Stop()
+    write("watched", "")
+    for deadline := time.Now().Add(5 * time.Second); hub.config().Server.Password != "watched"; {
+	if time.Now().After(deadline) {
+	    t.Fatalf("Watcher did not reload the changed config")
+	}
+	time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestCLI(t *testing.T) {
+    dir := t.TempDir()
+    t.Setenv("HOME", dir)
+    for _, env := range []string{"MACRON_CONFIG", "MACRON_LISTEN", "PORT", "MACRON_LOG", "MACRON_LOG_LEVEL", "MACRON_SERVER", "MACRON_TOKEN"} {
+	t.Setenv(env, "")
+    }
+    path := filepath.Join(dir, "config.toml")
+    os.WriteFile(path, []byte("[Server]\nauth_type = \"full\"\nemail = \"me@example.com\"\npassword = \"foobar\"\nlisten = \":9000\"\nlog_level = \"warn\"\n"), 0600)
+
+    hub := NewHub(&Config{Server: ServerConfig{AuthType: "full", Email: "me@example.com", Password: "foobar"}})
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    hub.receivers["desk"] = &Receiver{name: "desk", hub: hub}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+
+    tests := []struct {
+	args        []string
+	code        int
+	contains    []string
+	excludes    []string
+    }{
+	{[]string{"version"}, 0, []string{"macron-server dev"}, nil},
+	{[]string{"help"}, 0, []string{"check-config", "sessions"}, nil},
+	{[]string{"frobnicate"}, 2, []string{"Unknown command: frobnicate"}, nil},
+	{[]string{"serve", "--bogus"}, 2, []string{"flag provided but not defined"}, nil},
+	{[]string{"check-config", "--config", path}, 0, []string{"is valid"}, nil},
+	{[]string{"users", "--config", path}, 0, []string{"me@example.com", "full"}, nil},
+	{[]string{"receivers", "--server", server.URL, "--token", "token"}, 0, []string{"desk"}, nil},
+	{[]string{"receivers", "--server", server.URL, "--token", "nope"}, 1, []string{"401"}, nil},
+	// Without a token the command logs in with the config's credentials,
+	// adding a second session.
+	{[]string{"sessions", "--server", server.URL, "--config", path}, 0, []string{sessionId("token")}, []string{"token"}},
+    }
+    for _, tt := range tests {
+	var out bytes.Buffer
+	code := run(tt.args, &out, &out)
+	if code != tt.code {
+	    t.Fatalf("%v: got=%d, expected=%d: %s", tt.args, code, tt.code, out.String())
+	}
+	for _, s := range tt.contains {
+	    if !strings.Contains(out.String(), s) {
+		t.Fatalf("%v: got=%q, expected it to contain %q", tt.args, out.String(), s)
+	    }
+	}
+	for _, s := range tt.excludes {
+	    if strings.Contains(out.String(), s) {
+		t.Fatalf("%v: got=%q, expected it not to contain %q", tt.args, out.String(), s)
+	    }
+	}
+    }
+    if sessions := hub.ListSessions(); len(sessions) != 2 {
+	t.Fatalf("got=%d sessions, expected the CLI to have logged in", len(sessions))
+    }
+
+    precedence := []struct {
+	name        string
+	flags       map[string]string
+	env         map[string]string
+	expected    ServerConfig
+    }{
+	{"config file", nil, nil, ServerConfig{Listen: ":9000", LogLevel: "warn"}},
+	{"PORT", nil, map[string]string{"PORT": "9001"}, ServerConfig{Listen: ":9001", LogLevel: "warn"}},
+	{"env", nil, map[string]string{"PORT": "9001", "MACRON_LISTEN": "127.0.0.1:9002", "MACRON_LOG": "/tmp/env.log", "MACRON_LOG_LEVEL": "debug"},
+	    ServerConfig{Listen: "127.0.0.1:9002", LogFile: "/tmp/env.log", LogLevel: "debug"}},
+	{"MACRON_LOG_FILE", nil, map[string]string{"MACRON_LOG": "/tmp/old.log", "MACRON_LOG_FILE": "/tmp/env.log"},
+	    ServerConfig{Listen: ":9000", LogFile: "/tmp/env.log", LogLevel: "warn"}},
+	{"flags", map[string]string{"server.listen": ":9003", "server.log_file": "/tmp/flag.log", "server.log_level": "error"}, map[string]string{"MACRON_LISTEN": ":9002", "MACRON_LOG_LEVEL": "debug"},
+	    ServerConfig{Listen: ":9003", LogFile: "/tmp/flag.log", LogLevel: "error"}},
+    }
+    for _, tt := range precedence {
+	for key, value := range tt.env {
+	    t.Setenv(key, value)
+	}
+	config, err := loadServeConfig(ConfigSource{Path: path, Flags: tt.flags})
+	if err != nil {
+	    t.Fatalf("%s: %v", tt.name, err)
+	}
+	got := ServerConfig{Listen: config.Server.Listen, LogFile: config.Server.LogFile, LogLevel: config.Server.LogLevel}
+	if !reflect.DeepEqual(got, tt.expected) {
+	    t.Fatalf("%s: got=%+v, expected=%+v", tt.name, got, tt.expected)
+	}
+	for key := range tt.env {
+	    t.Setenv(key, "")
+	}
+    }
+    if _, err := loadServeConfig(ConfigSource{Path: path, Flags: map[string]string{"server.log_level": "loud"}}); err == nil {
+	t.Fatalf("expected an invalid --log-level to be rejected")
+    }
+}
+
+func TestConfigSources(t *testing.T) {
+    dir := t.TempDir()
+    t.Setenv("HOME", dir)
+    env := map[string]string{
+	"MACRON_PASSWORD": "hunter2",
+	"MACRON_LISTEN": "127.0.0.1:9000",
+	"MACRON_ALLOWED_ORIGINS": "https://a.example.com, https://b.example.com",
+	"MACRON_WEBSOCKET_MAX_CLIENT_MESSAGE": "1024",
+    }
+    for key, value := range env {
+	t.Setenv(key, value)
+    }
+
+    // Without a config file everything comes from the environment.
+    config, err := ConfigSource{Path: defaultConfigPath()}.Load()
+    if err != nil {
+	t.Fatal(err)
+    }
+    if config.Server.Password != "hunter2" || config.Server.Listen != "127.0.0.1:9000" || config.WebSocket.MaxClientMessage != 1024 ||
+	!reflect.DeepEqual(config.Server.AllowedOrigins, []string{"https://a.example.com", "https://b.example.com"}) {
+	t.Fatalf("got=%+v, expected the environment's settings", config)
+    }
+    if _, err := loadConfig(filepath.Join(dir, "missing.toml")); !errors.Is(err, os.ErrNotExist) {
+	t.Fatalf("got=%v, expected a config path that was asked for to be required", err)
+    }
+
+    tests := []struct {
+	name        string
+	env         map[string]string
+	args        []string
+	code        int
+	contains    []string
+	excludes    []string
+    }{
+	{"redacted", nil, nil, 0, []string{redacted, "9000", "https://b.example.com"}, []string{"hunter2"}},
+	{"flags", nil, []string{"--listen", ":9001", "--websocket-compression", "--log-level", "debug"}, 0, []string{"9001", "compression = true", "debug"}, nil},
+	{"bad flag", nil, []string{"--websocket-read-buffer-size", "big"}, 2, []string{"not a whole number"}, nil},
+	{"bad env", map[string]string{"MACRON_WEBSOCKET_COMPRESSION": "sometimes"}, nil, 1, []string{"MACRON_WEBSOCKET_COMPRESSION", "not true or false"}, nil},
+	{"tls", map[string]string{"MACRON_TLS_CERT": "/etc/macron/cert.pem"}, nil, 1, []string{"set both or neither"}, nil},
+    }
+    for _, tt := range tests {
+	for key, value := range tt.env {
+	    t.Setenv(key, value)
+	}
+	var out bytes.Buffer
+	code := run(append([]string{"print-config"}, tt.args...), &out, &out)
+	if code != tt.code {
+	    t.Fatalf("%s: got=%d, expected=%d: %s", tt.name, code, tt.code, out.String())
+	}
+	for _, s := range tt.contains {
+	    if !strings.Contains(out.String(), s) {
+		t.Fatalf("%s: got=%q, expected it to contain %q", tt.name, out.String(), s)
+	    }
+	}
+	for _, s := range tt.excludes {
+	    if strings.Contains(out.String(), s) {
+		t.Fatalf("%s: got=%q, expected it not to contain %q", tt.name, out.String(), s)
+	    }
+	}
+	for key := range tt.env {
+	    t.Setenv(key, "")
+	}
+    }
+
+    // .env is optional, and does not replace variables already set.
+    if err := loadDotenv(filepath.Join(dir, ".env")); err != nil {
+	t.Fatalf("got=%v, expected a missing .env to be ignored", err)
+    }
+    os.WriteFile(filepath.Join(dir, ".env"), []byte("MACRON_PASSWORD=fromfile\nMACRON_TEST_DOTENV=set\n"), 0600)
+    t.Cleanup(func() { os.Unsetenv("MACRON_TEST_DOTENV") })
+    if err := loadDotenv(filepath.Join(dir, ".env")); err != nil {
+	t.Fatal(err)
+    }
+    if os.Getenv("MACRON_TEST_DOTENV") != "set" || os.Getenv("MACRON_PASSWORD") != "hunter2" {
+	t.Fatalf("got=%q, %q, expected .env to fill in unset variables only", os.Getenv("MACRON_TEST_DOTENV"), os.Getenv("MACRON_PASSWORD"))
+    }
+}
+
+func TestControlSocket(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "config.toml")
+    os.WriteFile(path, []byte(fmt.Sprintf("[Server]\npassword = \"foobar\"\ndata_dir = %q\n", dir)), 0600)
+    config, err := loadConfig(path)
+    if err != nil {
+	t.Fatal(err)
+    }
+    hub := NewHub(config)
+    hub.sessions["token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    hub.sessions["other"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+    receiver, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/receiver?session_token=token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting receiver: %v", err)
+    }
+    defer receiver.Close()
+    receiver.WriteJSON(map[string]interface{}{"type": "auth", "receiver_name": "desk", "functions": []map[string]interface{}{
+	{"id": 1, "key": "ping", "name": "Ping"},
+    }})
+    var auth ReceiverResponse
+    if err := receiver.ReadJSON(&auth); err != nil || auth.Type != "auth_success" {
+	t.Fatalf("got=%+v, expected auth_success: %v", auth, err)
+    }
+    // The receiver answers every exec until it is kicked.
+    receiverErr := make(chan error, 1)
+    go func() {
+	for {
+	    var msg ReceiverResponse
+	    err := receiver.ReadJSON(&msg)
+	    if err != nil {
+		receiverErr <- err
+		return
+	    }
+	    if msg.Type == "exec" {
+		receiver.WriteJSON(map[string]interface{}{"type": "exec_result", "exec_id": msg.ExecId, "output": "pong"})
+	    }
+	}
+    }()
+    client, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/client?session_token=token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting client: %v", err)
+    }
+    defer client.Close()
+    client.ReadMessage()
+
+    socket := filepath.Join(dir, "control.sock")
+    control, err := ListenControl(hub, socket, ConfigSource{Path: path})
+    if err != nil {
+	t.Fatal(err)
+    }
+    go control.Serve()
+    info, err := os.Stat(socket)
+    if err != nil || info.Mode().Perm() != 0600 {
+	t.Fatalf("got=%v, expected the socket to be private: %v", info.Mode(), err)
+    }
+    if _, err := ListenControl(hub, socket, ConfigSource{Path: path}); err == nil {
+	t.Fatalf("expected a second server on the same socket to be refused")
+    }
+
+    // Changing the listen address needs a restart; reload should say so.
+    os.WriteFile(path, []byte(fmt.Sprintf("[Server]\npassword = \"foobar\"\ndata_dir = %q\nlisten = \":9000\"\n", dir)), 0600)
+    tests := []struct {
+	args        []string
+	code        int
+	contains    []string
+    }{
+	{[]string{"receivers", "ls"}, 0, []string{"NAME", "desk", "v1/v2"}},
+	{[]string{"clients", "ls"}, 0, []string{"127.0.0.1"}},
+	{[]string{"exec", "desk", "ping"}, 0, []string{"success", "pong"}},
+	{[]string{"exec", "--wait", "2s", "desk", "1"}, 0, []string{"pong"}},
+	{[]string{"exec", "desk", "missing"}, 1, []string{"missing"}},
+	{[]string{"sessions", "ls"}, 0, []string{sessionId("other")}},
+	{[]string{"sessions", "revoke", sessionId("other")}, 0, []string{"Revoked 1"}},
+	{[]string{"sessions", "revoke", "nope"}, 1, []string{"No session"}},
+	{[]string{"reload"}, 0, []string{"server.listen"}},
+	{[]string{"receivers", "kick", "nobody"}, 1, []string{"nobody"}},
+	{[]string{"receivers", "kick", "desk"}, 0, []string{"Kicked desk"}},
+	{[]string{"frobnicate"}, 2, []string{"Unknown command"}},
+    }
+    for _, tt := range tests {
+	var out bytes.Buffer
+	code := run(append([]string{"ctl", "--socket", socket}, tt.args...), &out, &out)
+	if code != tt.code {
+	    t.Fatalf("%v: got=%d, expected=%d: %s", tt.args, code, tt.code, out.String())
+	}
+	for _, s := range tt.contains {
+	    if !strings.Contains(out.String(), s) {
+		t.Fatalf("%v: got=%q, expected it to contain %q", tt.args, out.String(), s)
+	    }
+	}
+    }
+
+    select {
+    case err := <-receiverErr:
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+	    t.Fatalf("got=%v, expected close 1008", err)
+	}
+    case <-time.After(5 * time.Second):
+	t.Fatalf("Receiver was not disconnected")
+    }
+    if sessions := hub.ListSessions(); len(sessions) != 1 {
+	t.Fatalf("got=%d sessions, expected=1", len(sessions))
+    }
+    if hub.config().Server.Listen != "" {
+	t.Fatalf("got=%q, expected listen to keep its running value", hub.config().Server.Listen)
+    }
+
+    control.Close()
+    if _, err := os.Stat(socket); !os.IsNotExist(err) {
+	t.Fatalf("got=%v, expected the socket to be removed", err)
+    }
+}
+
+// lockedBuffer collects log output written from several goroutines.
+type lockedBuffer struct {
+    mu      sync.Mutex
+    buf     bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) records() []map[string]interface{} {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    records := make([]map[string]interface{}, 0)
+    for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+	var record map[string]interface{}
+	if json.Unmarshal([]byte(line), &record) == nil {
+	    records = append(records, record)
+	}
+    }
+    return records
+}
+
+func TestLogging(t *testing.T) {
+    defer slog.SetDefault(slog.Default())
+    defer logLevel.Set(slog.LevelInfo)
+    var out lockedBuffer
+    slog.SetDefault(slog.New(newLogHandler(&out, "json")))
+    logLevel.Set(slog.LevelDebug)
+
+    hub := NewHub(&Config{Server: ServerConfig{AuthType: AuthSession, Password: "hunter2"}})
+    hub.sessions["s3cret-token"] = &Session{expiry: time.Now().Add(time.Minute)}
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+    client, _, err := websocket.DefaultDialer.Dial(wsURL + "/v2/client?session_token=s3cret-token", nil)
+    if err != nil {
+	t.Fatalf("Error connecting client: %v", err)
+    }
+    client.ReadMessage()
+    client.WriteJSON(map[string]interface{}{"type": "receivers"})
+    client.ReadMessage()
+    client.Close()
+    slog.Info("Login attempt", "password", "hunter2", "Authorization", "Bearer s3cret-token")
+
+    // The request line is logged once the handler returns, and the client
+    // lines come from its pumps, so wait for both.
+    var connected, request, message map[string]interface{}
+    for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	for _, record := range out.records() {
+	    switch record["msg"] {
+	    case "Client connected":
+		connected = record
+	    case "Request":
+		request = record
+	    case "Client message":
+		message = record
+	    }
+	}
+	if connected != nil && request != nil && message != nil {
+	    break
+	}
+    }
+    if connected == nil || request == nil || message == nil {
+	t.Fatalf("got=%v, expected request, connection and message records", out.records())
+    }
+    if connected["request_id"] == "" || connected["request_id"] != request["request_id"] || message["client_id"] != connected["client_id"] {
+	t.Fatalf("got=%v, %v and %v, expected them to share request and client ids", request, connected, message)
+    }
+    if request["path"] != "/v2/client?session_token=" + redacted {
+	t.Fatalf("got=%v, expected the token to be redacted from the path", request["path"])
+    }
+    out.mu.Lock()
+    logged := out.buf.String()
+    out.mu.Unlock()
+    for _, secret := range []string{"s3cret-token", "hunter2"} {
+	if strings.Contains(logged, secret) {
+	    t.Fatalf("got=%q, expected %q to be redacted", logged, secret)
+	}
+    }
+
+    // The log file is appended to, then rotated by size and by age.
+    dir := t.TempDir()
+    path := filepath.Join(dir, "macron.log")
+    os.WriteFile(path, []byte("previous run\n"), 0600)
+    file, err := openLogFile(path, 64, time.Hour, 2)
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer file.Close()
+    line := []byte(strings.Repeat("x", 40) + "\n")
+    file.Write(line)
+    if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data), "previous run\n") {
+	t.Fatalf("got=%q, expected the existing log to be kept", data)
+    }
+    for i := 0; i < 3; i++ {
+	time.Sleep(2 * time.Millisecond)
+	file.Write(line)
+    }
+    file.started = time.Now().Add(-2 * time.Hour)
+    time.Sleep(2 * time.Millisecond)
+    file.Write([]byte("new\n"))
+    backups, _ := filepath.Glob(path + ".*")
+    if len(backups) != 2 {
+	t.Fatalf("got=%v, expected the two newest backups", backups)
+    }
+    if data, _ := os.ReadFile(path); string(data) != "new\n" {
+	t.Fatalf("got=%q, expected the file to be rotated by age", data)
+    }
+
+    // Age counts from when the file was begun, not from this process
+    // opening it.
+    stale := filepath.Join(dir, "stale.log")
+    os.WriteFile(stale, []byte("old run\n"), 0600)
+    os.Chtimes(stale, time.Now().Add(-2 * time.Hour), time.Now().Add(-2 * time.Hour))
+    restarted, err := openLogFile(stale, 0, time.Hour, 0)
+    if err != nil {
+	t.Fatal(err)
+    }
+    defer restarted.Close()
+    restarted.Write([]byte("new\n"))
+    if data, _ := os.ReadFile(stale); string(data) != "new\n" {
+	t.Fatalf("got=%q, expected a stale file to be rotated after a restart", data)
+    }
+
+    // A failed rotation keeps logging to the current file.
+    os.Remove(stale)
+    restarted.started = time.Now().Add(-2 * time.Hour)
+    if n, err := restarted.Write(line); err != nil || n != len(line) {
+	t.Fatalf("got n=%d err=%v, expected writes to go on after a failed rotation", n, err)
+    }
+    if n, err := restarted.Write(line); err != nil || n != len(line) {
+	t.Fatalf("got n=%d err=%v, expected writes to go on after a failed rotation", n, err)
+    }
+}
+
+func TestMetrics(t *testing.T) {
+    hub := NewHub(&Config{Server: ServerConfig{AuthType: "full", Email: "me@example.com", Password: "pw"}})
+    id := 3
+    functions := []MacronFunction{{Id: &id, Key: "lock", Name: "Lock"}}
+    r := &Receiver{name: "desk", hub: hub, functions: &functions, egress: make(chan []byte)}
+    hub.receivers["desk"] = r
+    go func() {
+	for message := range r.egress {
+	    var msg ReceiverResponse
+	    json.Unmarshal(message, &msg)
+	    hub.CompleteExec(ExecResult{ExecId: msg.ExecId, Status: "success"})
+	}
+    }()
+    router := setupRoutes(hub)
+    serve := func(method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+	    req.Header.Set("Authorization", "Bearer " + token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+    }
+
+    serve(http.MethodPost, "/v2/login", `{"email":"me@example.com","password":"wrong"}`, "")
+    rec := serve(http.MethodPost, "/v2/login", `{"email":"me@example.com","password":"pw"}`, "")
+    var auth AuthenticationMessage
+    json.Unmarshal(rec.Body.Bytes(), &auth)
+    rec = serve(http.MethodPost, "/v2/receivers/desk/functions/lock/exec?wait=2s", "", auth.SessionToken)
+    if rec.Code != http.StatusOK {
+	t.Fatalf("Exec failed: %d %s", rec.Code, rec.Body.String())
+    }
+    hub.metrics.messageIn("client", "exec")
+    hub.metrics.messageIn("client", "made_up")
+    hub.metrics.messageOut("receiver", "exec", errors.New("broken pipe"))
+    // A client whose writePump has not caught up yet.
+    slow := &Client{id: "slow", hub: hub, egress: make(chan []byte, egressBuffer)}
+    slow.egress <- []byte(`{"type":"receivers"}`)
+    slow.egress <- []byte(`{"type":"receivers"}`)
+    hub.clients[slow.id] = slow
+
+    rec = serve(http.MethodGet, "/metrics", "", "")
+    if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+	t.Fatalf("Unexpected /metrics response: %d %q", rec.Code, rec.Header().Get("Content-Type"))
+    }
+    body := rec.Body.String()
+    for _, line := range []string{
+	"macron_receivers 1",
+	"macron_sessions 1",
+	"macron_pending_execs 0",
+	`macron_egress_queue{peer="client"} 2`,
+	`macron_egress_queue{peer="receiver"} 0`,
+	`macron_logins_total{result="failure"} 1`,
+	`macron_logins_total{result="success"} 1`,
+	`macron_messages_total{peer="client",direction="in",type="exec"} 1`,
+	`macron_messages_total{peer="client",direction="in",type="unknown"} 1`,
+	`macron_websocket_write_errors_total{peer="receiver"} 1`,
+	`macron_execs_total{receiver="desk",function="lock",status="success"} 1`,
+	`macron_exec_duration_seconds_bucket{receiver="desk",function="lock",le="+Inf"} 1`,
+	`macron_exec_duration_seconds_count{receiver="desk",function="lock"} 1`,
+	"# TYPE macron_exec_duration_seconds histogram",
+    } {
+	if !strings.Contains(body, line + "\n") {
+	    t.Errorf("Missing %q in:\n%s", line, body)
+	}
+    }
+
+    config := *hub.config()
+    config.Server.MetricsToken = "scrape"
+    hub.cfg.Store(&config)
+    if rec := serve(http.MethodGet, "/metrics", "", ""); rec.Code != http.StatusUnauthorized {
+	t.Fatalf("Expected 401 without the metrics token, got %d", rec.Code)
+    }
+    if rec := serve(http.MethodGet, "/metrics", "", auth.SessionToken); rec.Code != http.StatusUnauthorized {
+	t.Fatalf("Expected 401 with a session token, got %d", rec.Code)
+    }
+    if rec := serve(http.MethodGet, "/metrics", "", "scrape"); rec.Code != http.StatusOK {
+	t.Fatalf("Expected 200 with the metrics token, got %d", rec.Code)
+    }
+}
+
+func TestHealth(t *testing.T) {
+    dir := t.TempDir()
+    hub := NewHub(&Config{Server: ServerConfig{DataDir: filepath.Join(dir, "data")}})
+    router := setupRoutes(hub)
+    get := func(path string) (int, HealthResponse) {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var response HealthResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec.Code, response
+    }
+
+    if code, response := get("/healthz"); code != http.StatusOK || response.Status != "ok" {
+	t.Fatalf("healthz: got=%d %+v", code, response)
+    }
+    code, response := get("/readyz")
+    if code != http.StatusOK || response.Status != "ok" || len(response.Checks) != 3 {
+	t.Fatalf("readyz: got=%d %+v", code, response)
+    }
+
+    // A data directory that cannot be written to is not ready.
+    blocked := filepath.Join(dir, "file")
+    os.WriteFile(blocked, nil, 0600)
+    config := *hub.config()
+    config.Server.DataDir = blocked
+    hub.cfg.Store(&config)
+    code, response = get("/readyz")
+    if code != http.StatusServiceUnavailable || response.Checks["storage"].Status != "failed" || response.Checks["hub"].Status != "ok" {
+	t.Fatalf("readyz with a bad data dir: got=%d %+v", code, response)
+    }
+
+    // Nor is a hub that is shutting down, though it is still alive.
+    config.Server.DataDir = dir
+    hub.cfg.Store(&config)
+    hub.draining.Store(true)
+    code, response = get("/readyz")
+    if code != http.StatusServiceUnavailable || response.Checks["hub"].Error != errShuttingDown.Error() {
+	t.Fatalf("readyz while draining: got=%d %+v", code, response)
+    }
+    if code, _ := get("/healthz"); code != http.StatusOK {
+	t.Fatalf("healthz while draining: got=%d", code)
+    }
+}
+
+func TestSdNotify(t *testing.T) {
+    t.Setenv("NOTIFY_SOCKET", "")
+    if err := sdNotify("READY=1"); err != nil {
+	t.Fatalf("Expected no-op without NOTIFY_SOCKET, got %v", err)
+    }
+
+    path := filepath.Join(t.TempDir(), "notify.sock")
+    conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+    if err != nil {
+	t.Fatalf("Error listening: %v", err)
+    }
+    defer conn.Close()
+    t.Setenv("NOTIFY_SOCKET", path)
+    read := func() string {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+	    t.Fatalf("Error reading notification: %v", err)
+	}
+	return string(buf[:n])
+    }
+
+    if err := sdNotify("READY=1"); err != nil {
+	t.Fatalf("Error notifying: %v", err)
+    }
+    if state := read(); state != "READY=1" {
+	t.Fatalf("got=%q, expected READY=1", state)
+    }
+
+    t.Setenv("WATCHDOG_USEC", "40000")
+    t.Setenv("WATCHDOG_PID", "1")
+    if interval := watchdogInterval(); interval != 0 {
+	t.Fatalf("Expected no watchdog for another pid, got %v", interval)
+    }
+    t.Setenv("WATCHDOG_PID", fmt.Sprint(os.Getpid()))
+    interval := watchdogInterval()
+    if interval != 20 * time.Millisecond {
+	t.Fatalf("got=%v, expected half of WATCHDOG_USEC", interval)
+    }
+    hub := NewHub(&Config{})
+    stop := make(chan struct{})
+    defer close(stop)
+    go hub.runWatchdog(interval, stop)
+    if state := read(); state != "WATCHDOG=1" {
+	t.Fatalf("got=%q, expected WATCHDOG=1", state)
+    }
+}
+
+func TestDashboard(t *testing.T) {
+    hub := NewHub(&Config{Server: ServerConfig{AuthType: "session", Password: "pw"}})
+    server := httptest.NewServer(setupRoutes(hub))
+    defer server.Close()
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+    }}
+    do := func(method string, path string, body string, header http.Header, cookies ...*http.Cookie) (*http.Response, string) {
+	req, _ := http.NewRequest(method, server.URL + path, strings.NewReader(body))
+	for key, values := range header {
+	    req.Header[key] = values
+	}
+	for _, cookie := range cookies {
+	    req.AddCookie(cookie)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+	    t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+    }
+    cookieNamed := func(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+	    if cookie.Name == name {
+		return cookie
+	    }
+	}
+	return nil
+    }
+    form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+
+    _, index := do(http.MethodGet, "/", "", nil)
+    if !strings.Contains(index, `href="/dashboard"`) || strings.Contains(index, ">Team<") {
+	t.Fatalf("Index should link to the dashboard:\n%s", index)
+    }
+
+    // Signed out, the dashboard is a login form carrying a CSRF token.
+    resp, page := do(http.MethodGet, "/dashboard", "", nil)
+    csrf := cookieNamed(resp, csrfCookie)
+    if csrf == nil || !csrf.HttpOnly || csrf.SameSite != http.SameSiteStrictMode {
+	t.Fatalf("Expected an HttpOnly, SameSite=Strict CSRF cookie, got %+v", csrf)
+    }
+    for _, want := range []string{`id="login-form"`, `action="/v2/login"`, `value="` + csrf.Value + `"`, "Any address works"} {
+	if !strings.Contains(page, want) {
+	    t.Errorf("Login page is missing %s", want)
+	}
+    }
+    if strings.Contains(page, `id="receivers"`) {
+	t.Fatalf("Dashboard rendered without a session")
+    }
+
+    credentials := "email=me%40example.com&password=pw&csrf_token="
+    if resp, _ := do(http.MethodPost, "/v2/login", credentials + csrf.Value, form); resp.StatusCode != http.StatusForbidden {
+	t.Fatalf("Login without the CSRF cookie: got=%d, expected=403", resp.StatusCode)
+    }
+    resp, _ = do(http.MethodPost, "/v2/login", "email=me%40example.com&password=wrong&csrf_token=" + csrf.Value, form, csrf)
+    if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/dashboard?login=failed" {
+	t.Fatalf("Failed login: got=%d %s", resp.StatusCode, resp.Header.Get("Location"))
+    }
+    if _, page := do(http.MethodGet, "/dashboard?login=failed", "", nil, csrf); !strings.Contains(page, "Incorrect email or password.") {
+	t.Fatalf("Expected a login error")
+    }
+    resp, _ = do(http.MethodPost, "/v2/login", credentials + csrf.Value, form, csrf)
+    session := cookieNamed(resp, sessionCookie)
+    if resp.StatusCode != http.StatusSeeOther || session == nil {
+	t.Fatalf("Login: got=%d, cookies=%v", resp.StatusCode, resp.Cookies())
+    }
+    if !session.HttpOnly || session.SameSite != http.SameSiteLaxMode || !session.Secure {
+	t.Fatalf("Expected an HttpOnly, SameSite=Lax, Secure session cookie, got %+v", session)
+    }
+    if session.MaxAge != int(browserSessionIdle / time.Second) {
+	t.Fatalf("got MaxAge=%d, expected the browser session idle timeout", session.MaxAge)
+    }
+
+    // Using a browser session renews it and its cookie.
+    hub.mu.Lock()
+    hub.sessions[session.Value].expiry = time.Now().Add(time.Second)
+    hub.mu.Unlock()
+    resp, _ = do(http.MethodGet, "/dashboard", "", nil, csrf, session)
+    if renewed := cookieNamed(resp, sessionCookie); renewed == nil || renewed.Value != session.Value {
+	t.Fatalf("Expected the dashboard to renew the session cookie, got %v", resp.Cookies())
+    }
+    hub.mu.Lock()
+    expiry := hub.sessions[session.Value].expiry
+    hub.mu.Unlock()
+    if time.Until(expiry) < browserSessionIdle - time.Minute {
+	t.Fatalf("Session was not renewed: expires %v", expiry)
+    }
+
+    // Plain-HTTP cookies need insecure_cookies, and even then a forwarded
+    // HTTPS request keeps them Secure only when it comes from a trusted
+    // proxy.
+    config := *hub.config()
+    config.Server.InsecureCookies = true
+    hub.cfg.Store(&config)
+    https := http.Header{"Content-Type": form["Content-Type"], "X-Forwarded-Proto": {"https"}}
+    for _, tt := range []struct {
+	proxies	    []string
+	header	    http.Header
+	secure	    bool
+    }{
+	{nil, form, false},
+	{nil, https, false},
+	{[]string{"10.0.0.0/8"}, https, false},
+	{[]string{"127.0.0.1"}, https, true},
+	{[]string{"127.0.0.0/8"}, form, false},
+    } {
+	config.Server.TrustedProxies = tt.proxies
+	hub.cfg.Store(&config)
+	resp, _ := do(http.MethodPost, "/v2/login", credentials + csrf.Value, tt.header, csrf)
+	if got := cookieNamed(resp, sessionCookie); got == nil || got.Secure != tt.secure {
+	    t.Fatalf("proxies=%v header=%v: got=%+v, expected Secure=%v", tt.proxies, tt.header, got, tt.secure)
+	}
+    }
+
+    // Signed in, the page is the dashboard and its script needs no token.
+    _, page = do(http.MethodGet, "/dashboard", "", nil, csrf, session)
+    for _, want := range []string{`<title>Macron Dashboard</title>`, `id="receivers"`, `id="function-card"`, `id="history"`, `action="/v2/logout"`, `src="/static/js/dashboard.js"`} {
+	if !strings.Contains(page, want) {
+	    t.Errorf("Dashboard is missing %s", want)
+	}
+    }
+    if _, script := do(http.MethodGet, "/static/js/dashboard.js", "", nil); !strings.Contains(script, `"/v2/client"`) || strings.Contains(script, "session_token") {
+	t.Fatalf("Dashboard script should open the v2 client socket with the cookie")
+    }
+
+    // The cookie authenticates REST calls, but unsafe ones need the CSRF
+    // token as well. Bearer tokens are not sent by browsers on their own and
+    // need none.
+    if resp, _ := do(http.MethodGet, "/v2/receivers", "", nil, session); resp.StatusCode != http.StatusOK {
+	t.Fatalf("GET with the session cookie: got=%d", resp.StatusCode)
+    }
+    if resp, _ := do(http.MethodPost, "/v2/workflows/missing/runs", "", nil, session, csrf); resp.StatusCode != http.StatusForbidden {
+	t.Fatalf("POST with the cookie and no CSRF token: got=%d, expected=403", resp.StatusCode)
+    }
+    if resp, _ := do(http.MethodPost, "/v2/workflows/missing/runs", "", http.Header{csrfHeader: {csrf.Value}}, session, csrf); resp.StatusCode != http.StatusNotFound {
+	t.Fatalf("POST with the cookie and CSRF token: got=%d, expected=404", resp.StatusCode)
+    }
+    if resp, _ := do(http.MethodPost, "/v2/workflows/missing/runs", "", http.Header{"Authorization": {"Bearer " + session.Value}}); resp.StatusCode != http.StatusNotFound {
+	t.Fatalf("POST with a bearer token: got=%d, expected=404", resp.StatusCode)
+    }
+
+    // WebSocket clients can authenticate with a header or the cookie.
+    wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/v2/client"
+    for _, header := range []http.Header{
+	{"Authorization": {"Bearer " + session.Value}},
+	{"Cookie": {session.String()}},
+    } {
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+	    t.Fatalf("Connecting with %v: %v", header, err)
+	}
+	var msg ClientResponse
+	ws.ReadJSON(&msg)
+	ws.Close()
+	if msg.Type != "auth_success" {
+	    t.Fatalf("got=%+v, expected auth_success", msg)
+	}
+    }
+
+    resp, _ = do(http.MethodPost, "/v2/logout", "csrf_token=" + csrf.Value, form, session, csrf)
+    if resp.StatusCode != http.StatusSeeOther || cookieNamed(resp, sessionCookie).MaxAge >= 0 {
+	t.Fatalf("Logout: got=%d, cookies=%v", resp.StatusCode, resp.Cookies())
+    }
+    if _, page := do(http.MethodGet, "/dashboard", "", nil, csrf, session); !strings.Contains(page, `id="login-form"`) {
+	t.Fatalf("Expected the login form after signing out")
+    }
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+const (
+    defaultShutdownTimeout  = 30 * time.Second
+    shutdownPoll            = 50 * time.Millisecond
+)
+
+var errShuttingDown = errors.New("Server is shutting down.")
+
+func (c ServerConfig) shutdownTimeout() time.Duration {
+    timeout, err := time.ParseDuration(c.ShutdownTimeout)
+    if err != nil || timeout <= 0 {
+	return defaultShutdownTimeout
+    }
+    return timeout
+}
+
+// restartIn is the restart hint sent to peers, in whole seconds. Zero means
+// the server does not expect to come back on its own.
+func (c ServerConfig) restartIn() int {
+    hint, err := time.ParseDuration(c.RestartHint)
+    if err != nil || hint <= 0 {
+	return 0
+    }
+    return int(hint.Round(time.Second) / time.Second)
+}
+
+func (hub *Hub) isShuttingDown() bool {
+    return hub.draining.Load()
+}
+
+// Shutdown drains the hub: new connections and execs are refused, connected
+// peers get a server_shutdown message, and in-flight execs are given until
+// ctx is done to finish. Execs still running then complete with status
+// "shutdown". Schedules and webhook deliveries are flushed before the
+// remaining connections are closed.
+func (hub *Hub) Shutdown(ctx context.Context, reason string) error {
+    if !hub.draining.CompareAndSwap(false, true) {
+	return errShuttingDown
+    }
+    close(hub.shutdown)
+    slog.Info("Shutting down", "reason", reason)
+
+    hub.scheduler.Stop()
+    hub.notifyShutdown(ctx, reason)
+
+    err := hub.drainExecs(ctx)
+    if err != nil {
+	slog.Warn("Abandoning in-flight execs", "error", err)
+	hub.abandonExecs()
+    }
+
+    if saveErr := hub.scheduler.Save(); saveErr != nil {
+	slog.Error("Saving schedules failed", "error", saveErr)
+    }
+    hub.webhooks.Stop()
+    if waitErr := hub.webhooks.Wait(ctx); waitErr != nil {
+	slog.Warn("Abandoning webhook deliveries", "in_flight", hub.webhooks.inFlight.Load())
+    }
+
+    hub.closeConnections()
+    return err
+}
+
+// notifyShutdown tells every peer the server is going away. Each write gives
+// up after closeWait, or when ctx is done if that is sooner, so peers that
+// have stopped reading cannot hold up the shutdown.
+func (hub *Hub) notifyShutdown(ctx context.Context, reason string) {
+    restartIn := hub.config().Server.restartIn()
+    deadline := time.Now().Add(closeWait)
+    if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+	deadline = ctxDeadline
+    }
+    hub.mu.Lock()
+    clients := make([]*Client, 0, len(hub.clients))
+    for _, c := range hub.clients {
+	clients = append(clients, c)
+    }
+    receivers := make([]*Receiver, 0, len(hub.receivers))
+    for _, r := range hub.receivers {
+	receivers = append(receivers, r)
+    }
+    hub.mu.Unlock()
+
+    for _, c := range clients {
+	if c.conn == nil {
+	    continue
+	}
+	c.writeJSONBefore(ClientResponse{Type: "server_shutdown", Reason: reason, RestartIn: restartIn}, "", deadline)
+    }
+    for _, r := range receivers {
+	if r.conn == nil {
+	    continue
+	}
+	// Written directly: the write pump may already be gone, and the
+	// egress queue may be full.
+	bytes, _ := json.Marshal(ReceiverResponse{Type: "server_shutdown", Reason: reason, RestartIn: restartIn})
+	message, err := r.egressMessage(bytes)
+	if err != nil {
+	    continue
+	}
+	r.writeMu.Lock()
+	r.conn.SetWriteDeadline(deadline)
+	writeWireMessage(r.conn, message)
+	r.conn.SetWriteDeadline(time.Time{})
+	r.writeMu.Unlock()
+    }
+}
+
+// drainExecs waits until no execs are pending or ctx is done.
+func (hub *Hub) drainExecs(ctx context.Context) error {
+    ticker := time.NewTicker(shutdownPoll)
+    defer ticker.Stop()
+    for {
+	hub.mu.Lock()
+	pending := len(hub.execs)
+	hub.mu.Unlock()
+	if pending == 0 {
+	    return nil
+	}
+	select {
+	case <-ticker.C:
+	case <-ctx.Done():
+	    return ctx.Err()
+	}
+    }
+}
+
+func (hub *Hub) abandonExecs() {
+    hub.mu.Lock()
+    ids := make([]string, 0, len(hub.execs))
+    for id := range hub.execs {
+	ids = append(ids, id)
+    }
+    hub.mu.Unlock()
+
+    for _, id := range ids {
+	hub.CompleteExec(ExecResult{
+	    ExecId: id,
+	    Status: "shutdown",
+	    Error: "Server shut down before the receiver returned a result.",
+	})
+    }
+}
+
+// closeConnections closes every client and receiver with 1001 (going away).
+// The read pumps clean up after themselves.
+func (hub *Hub) closeConnections() {
+    hub.mu.Lock()
+    conns := make([]*websocket.Conn, 0, len(hub.clients) + len(hub.receivers))
+    for _, c := range hub.clients {
+	conns = append(conns, c.conn)
+    }
+    for _, r := range hub.receivers {
+	conns = append(conns, r.conn)
+    }
+    hub.mu.Unlock()
+
+    for _, ws := range conns {
+	closeGoingAway(ws)
+    }
+}
+
+func closeGoingAway(ws *websocket.Conn) {
+    if ws == nil {
+	return
+    }
+    ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server_shutdown"), time.Now().Add(closeWait))
+    ws.Close()
+}
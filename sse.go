@@ -0,0 +1,123 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const sseKeepAlive = 15 * time.Second
+
+// eventFilter narrows an event stream by event type (exact or a "prefix.*"
+// wildcard) and by receiver.
+type eventFilter struct {
+    types       []string
+    receivers   []string
+}
+
+func splitList(value string) []string {
+    list := make([]string, 0)
+    for _, item := range strings.Split(value, ",") {
+	if item = strings.TrimSpace(item); item != "" {
+	    list = append(list, item)
+	}
+    }
+    return list
+}
+
+func (f *eventFilter) matches(event Event) bool {
+    if len(f.types) > 0 {
+	ok := false
+	for _, t := range f.types {
+	    if t == event.Type || (strings.HasSuffix(t, ".*") && strings.HasPrefix(event.Type, strings.TrimSuffix(t, "*"))) {
+		ok = true
+		break
+	    }
+	}
+	if !ok {
+	    return false
+	}
+    }
+    if len(f.receivers) > 0 {
+	name, _ := event.Data["receiver_name"].(string)
+	for _, r := range f.receivers {
+	    if r == name {
+		return true
+	    }
+	}
+	return false
+    }
+    return true
+}
+
+// HandlerEvents streams hub events as Server-Sent Events. Consumers can
+// filter with ?types=exec.*,receiver.offline and ?receivers=desk,nas, and
+// resume after a disconnect by sending Last-Event-ID.
+func (hub *Hub) HandlerEvents(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+	writeJSON(w, http.StatusInternalServerError, ClientResponse{Type: "error", Error: "Streaming unsupported."})
+	return
+    }
+    filter := eventFilter{
+	types: splitList(r.URL.Query().Get("types")),
+	receivers: splitList(r.URL.Query().Get("receivers")),
+    }
+    lastId := r.Header.Get("Last-Event-ID")
+    if lastId == "" {
+	lastId = r.URL.Query().Get("last_event_id")
+    }
+    since, _ := strconv.ParseUint(lastId, 10, 64)
+
+    replay, events, unsubscribe := hub.events.SubscribeSince(since)
+    defer unsubscribe()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    for _, event := range replay {
+	if filter.matches(event) {
+	    writeSSE(w, event)
+	}
+    }
+    flusher.Flush()
+
+    keepAlive := time.NewTicker(sseKeepAlive)
+    defer keepAlive.Stop()
+    for {
+	select {
+	case event, ok := <-events:
+	    if !ok {
+		return
+	    }
+	    if !filter.matches(event) {
+		continue
+	    }
+	    writeSSE(w, event)
+	    flusher.Flush()
+	case <-keepAlive.C:
+	    fmt.Fprint(w, ": keep-alive\n\n")
+	    flusher.Flush()
+	case <-hub.shutdown:
+	    fmt.Fprintf(w, "event: server_shutdown\ndata: %s\n\n", mustMarshal(ClientResponse{Type: "server_shutdown", RestartIn: hub.config().Server.restartIn()}))
+	    flusher.Flush()
+	    return
+	case <-r.Context().Done():
+	    return
+	}
+    }
+}
+
+func writeSSE(w http.ResponseWriter, event Event) {
+    data, err := json.Marshal(event)
+    if err != nil {
+	return
+    }
+    fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+}
@@ -0,0 +1,229 @@
+// Dashboard for the v2 client WebSocket. The server renders the page only
+// for a signed-in session; this fills it in from the socket, which the
+// session cookie authenticates, and sends execs back over it.
+(function () {
+    "use strict";
+
+    const refreshInterval = 5000;
+    const historyLimit = 25;
+
+    const $ = (id) => document.getElementById(id);
+    let socket = null;
+    let refreshTimer = null;
+    let selected = null;
+
+    function clone(id) {
+        return $(id).content.firstElementChild.cloneNode(true);
+    }
+
+    function field(node, name) {
+        return node.querySelector('[data-field="' + name + '"]');
+    }
+
+    function setStatus(text) {
+        $("status").textContent = text;
+    }
+
+    function send(message) {
+        if (socket && socket.readyState === WebSocket.OPEN) {
+            socket.send(JSON.stringify(message));
+        }
+    }
+
+    function connect() {
+        setStatus("Connecting…");
+        const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+        const ws = new WebSocket(scheme + "//" + location.host + "/v2/client");
+        socket = ws;
+        let opened = false;
+        ws.onopen = () => {
+            opened = true;
+            setStatus("Connected");
+            send({ type: "receivers" });
+            send({ type: "history", limit: historyLimit });
+            // The v2 protocol does not push receiver changes, so poll.
+            refreshTimer = setInterval(() => send({ type: "receivers" }), refreshInterval);
+        };
+        ws.onmessage = (event) => handle(JSON.parse(event.data));
+        ws.onclose = () => {
+            clearInterval(refreshTimer);
+            socket = null;
+            if (!opened) {
+                // The upgrade is refused once the session has expired;
+                // reloading brings back the login form.
+                setStatus("Disconnected");
+                setTimeout(() => location.reload(), refreshInterval);
+                return;
+            }
+            setStatus("Disconnected, retrying…");
+            setTimeout(connect, refreshInterval);
+        };
+    }
+
+    function handle(message) {
+        switch (message.type) {
+        case "receivers":
+            renderReceivers(message.receivers || []);
+            break;
+        case "functions":
+            if (message.receiver_name === selected) {
+                renderFunctions(message.functions || []);
+            }
+            break;
+        case "exec_result":
+            renderResult(message.result);
+            send({ type: "history", limit: historyLimit });
+            break;
+        case "history":
+            renderHistory(message.history || []);
+            break;
+        case "error":
+            renderError(message.error);
+            break;
+        case "server_shutdown":
+            setStatus("Server is restarting…");
+            break;
+        }
+    }
+
+    function renderReceivers(names) {
+        names.sort();
+        const list = $("receivers");
+        list.replaceChildren();
+        for (const name of names) {
+            const item = clone("receiver-item");
+            const button = item.querySelector("button");
+            button.textContent = name;
+            if (name === selected) {
+                button.classList.add("bg-cat-surface0");
+            }
+            button.addEventListener("click", () => selectReceiver(name));
+            list.appendChild(item);
+        }
+        $("no-receivers").classList.toggle("hidden", names.length > 0);
+        if (selected && !names.includes(selected)) {
+            selected = null;
+            $("functions-title").textContent = "Functions";
+            $("functions").replaceChildren(note("The receiver disconnected."));
+        }
+    }
+
+    function selectReceiver(name) {
+        selected = name;
+        $("functions-title").textContent = "Functions on " + name;
+        $("functions").replaceChildren(note("Loading…"));
+        send({ type: "receivers" });
+        send({ type: "functions", receiver_name: name });
+    }
+
+    function renderFunctions(functions) {
+        const container = $("functions");
+        container.replaceChildren();
+        if (functions.length === 0) {
+            container.appendChild(note("This receiver has no functions."));
+        }
+        for (const fn of functions) {
+            const card = clone("function-card");
+            field(card, "name").textContent = fn.name + (fn.version ? " (" + fn.version + ")" : "");
+            field(card, "description").textContent = fn.description || "";
+            const args = field(card, "args");
+            card.querySelector('[data-action="add-arg"]').addEventListener("click", () => {
+                args.appendChild(clone("arg-row"));
+            });
+            card.addEventListener("submit", (event) => {
+                event.preventDefault();
+                runFunction(selected, fn, readArgs(args));
+            });
+            container.appendChild(card);
+        }
+    }
+
+    // readArgs collects the name/value rows. Values that parse as JSON are
+    // sent as such, so numbers and booleans keep their type.
+    function readArgs(container) {
+        const args = {};
+        for (const row of container.children) {
+            const name = field(row, "arg-name").value.trim();
+            if (!name) {
+                continue;
+            }
+            const raw = field(row, "arg-value").value;
+            try {
+                args[name] = JSON.parse(raw);
+            } catch (err) {
+                args[name] = raw;
+            }
+        }
+        return args;
+    }
+
+    function runFunction(receiver, fn, args) {
+        const message = { type: "exec", receiver_name: receiver, args: args };
+        if (fn.key) {
+            message.function_key = fn.key;
+            if (fn.version) {
+                message.function_version = fn.version;
+            }
+        } else {
+            message.function_id = fn.id;
+        }
+        $("result").replaceChildren(note("Running " + fn.name + " on " + receiver + "…"));
+        send(message);
+    }
+
+    function renderResult(result) {
+        const panel = $("result");
+        panel.replaceChildren();
+        const heading = document.createElement("p");
+        heading.className = "font-bold " + statusClass(result.status);
+        heading.textContent = result.receiver_name + ": " + result.status;
+        panel.appendChild(heading);
+        if (result.output) {
+            const output = document.createElement("pre");
+            output.className = "mt-2 whitespace-pre-wrap rounded bg-cat-mantle p-2 font-mono text-cat-text";
+            output.textContent = result.output;
+            panel.appendChild(output);
+        }
+        if (result.error) {
+            const error = document.createElement("p");
+            error.className = "mt-2 text-cat-red";
+            error.textContent = result.error;
+            panel.appendChild(error);
+        }
+    }
+
+    function renderError(text) {
+        const error = document.createElement("p");
+        error.className = "text-cat-red";
+        error.textContent = text;
+        $("result").replaceChildren(error);
+    }
+
+    function renderHistory(records) {
+        const body = $("history");
+        body.replaceChildren();
+        for (const record of records) {
+            const row = clone("history-row");
+            field(row, "finished").textContent = new Date(record.finished_at).toLocaleString();
+            field(row, "receiver").textContent = record.receiver_name;
+            field(row, "function").textContent = record.function_key || (record.function_id != null ? "#" + record.function_id : "");
+            field(row, "status").textContent = record.status;
+            field(row, "status").classList.add(statusClass(record.status));
+            field(row, "output").textContent = record.error || record.output || "";
+            body.appendChild(row);
+        }
+    }
+
+    function statusClass(status) {
+        return status === "success" ? "text-cat-green" : "text-cat-red";
+    }
+
+    function note(text) {
+        const p = document.createElement("p");
+        p.className = "text-cat-subtext0";
+        p.textContent = text;
+        return p;
+    }
+
+    connect();
+})();
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    defaultWebhookAttempts  = 5
+    defaultWebhookBackoff   = time.Second
+    webhookTimeout          = 10 * time.Second
+    webhookSignatureHeader  = "X-Macron-Signature"
+    // webhookQueueSize is the dispatcher's event queue. It is well past the
+    // event history so that falling behind, and with it losing events the
+    // history no longer holds, takes a long stall.
+    webhookQueueSize        = 4 * eventHistorySize
+)
+
+// WebhookConfig describes an outbound webhook. An empty Events list
+// subscribes to every event type.
+type WebhookConfig struct {
+    Url             string      `toml:"url"`
+    Events          []string    `toml:"events,omitempty"`
+    Secret          string      `toml:"secret,omitempty"`
+    MaxAttempts     int         `toml:"max_attempts,omitempty"`
+    Backoff         string      `toml:"backoff,omitempty"`
+}
+
+func (wh *WebhookConfig) wants(eventType string) bool {
+    if len(wh.Events) == 0 {
+	return true
+    }
+    for _, e := range wh.Events {
+	if e == eventType {
+	    return true
+	}
+    }
+    return false
+}
+
+type deadLetter struct {
+    Url         string      `json:"url"`
+    Event       Event       `json:"event"`
+    Attempts    int         `json:"attempts"`
+    Error       string      `json:"error"`
+    FailedAt    time.Time   `json:"failed_at"`
+}
+
+type WebhookDispatcher struct {
+    hub             *Hub
+    client          *http.Client
+    deadLetterPath  string
+    deadLetterMu    sync.Mutex
+    wg              sync.WaitGroup
+    // inFlight counts deliveries that have not yet succeeded or been
+    // dead-lettered.
+    inFlight        atomic.Int64
+    // done is closed by Stop and stopped by Run on return; running records
+    // whether Run got as far as subscribing, so Wait knows to wait for it.
+    done            chan struct{}
+    stopped         chan struct{}
+    stopOnce        sync.Once
+    running         bool
+    mu              sync.Mutex
+}
+
+func NewWebhookDispatcher(hub *Hub, deadLetterPath string) *WebhookDispatcher {
+    return &WebhookDispatcher{
+	hub: hub,
+	client: &http.Client{Timeout: webhookTimeout},
+	deadLetterPath: deadLetterPath,
+	done: make(chan struct{}),
+	stopped: make(chan struct{}),
+    }
+}
+
+// Run forwards hub events to the configured webhooks until Stop is called.
+// Events already queued when it stops are still delivered.
+func (d *WebhookDispatcher) Run() {
+    d.mu.Lock()
+    select {
+    case <-d.done:
+	d.mu.Unlock()
+	return
+    default:
+    }
+    d.running = true
+    _, events, unsubscribe := d.hub.events.subscribe(0, webhookQueueSize)
+    d.mu.Unlock()
+    defer close(d.stopped)
+
+    var lastId uint64
+    for {
+	select {
+	case event, ok := <-events:
+	    if !ok {
+		// The bus closed us for falling behind; pick up again from
+		// the history.
+		var replay []Event
+		replay, events, unsubscribe = d.hub.events.subscribe(lastId, webhookQueueSize)
+		if lastId > 0 && len(replay) > 0 && replay[0].Id > lastId + 1 {
+		    slog.Error("Webhook dispatcher fell behind, events were not delivered", "from_event_id", lastId + 1, "to_event_id", replay[0].Id - 1)
+		}
+		for _, event := range replay {
+		    lastId = event.Id
+		    d.dispatch(event)
+		}
+		continue
+	    }
+	    lastId = event.Id
+	    d.dispatch(event)
+	case <-d.done:
+	    unsubscribe()
+	    for event := range events {
+		d.dispatch(event)
+	    }
+	    return
+	}
+    }
+}
+
+func (d *WebhookDispatcher) dispatch(event Event) {
+    for _, wh := range d.hub.config().Webhooks {
+	if !wh.wants(event.Type) {
+	    continue
+	}
+	d.wg.Add(1)
+	d.inFlight.Add(1)
+	go func(wh WebhookConfig, event Event) {
+	    defer d.wg.Done()
+	    defer d.inFlight.Add(-1)
+	    d.deliver(wh, event)
+	}(wh, event)
+    }
+}
+
+func (d *WebhookDispatcher) Stop() {
+    d.stopOnce.Do(func() {
+	close(d.done)
+    })
+}
+
+// Wait blocks until Run has returned after Stop and in-flight deliveries
+// finish, or until ctx is done. Once stopped, failed deliveries are
+// dead-lettered instead of retried.
+func (d *WebhookDispatcher) Wait(ctx context.Context) error {
+    d.mu.Lock()
+    running := d.running
+    d.mu.Unlock()
+    finished := make(chan struct{})
+    go func() {
+	if running {
+	    <-d.stopped
+	}
+	d.wg.Wait()
+	close(finished)
+    }()
+    select {
+    case <-finished:
+	return nil
+    case <-ctx.Done():
+	return ctx.Err()
+    }
+}
+
+func (d *WebhookDispatcher) deliver(wh WebhookConfig, event Event) {
+    body, err := json.Marshal(event)
+    if err != nil {
+	slog.Error("Marshalling webhook event failed", "error", err)
+	return
+    }
+    attempts := wh.MaxAttempts
+    if attempts <= 0 {
+	attempts = defaultWebhookAttempts
+    }
+    backoff := defaultWebhookBackoff
+    if wh.Backoff != "" {
+	if parsed, err := time.ParseDuration(wh.Backoff); err == nil {
+	    backoff = parsed
+	}
+    }
+
+    attempt := 1
+    for ; attempt <= attempts; attempt++ {
+	err = d.post(wh, event, body)
+	if err == nil {
+	    return
+	}
+	slog.Warn("Webhook delivery failed", "url", wh.Url, "attempt", attempt, "max_attempts", attempts, "event_id", event.Id, "error", err)
+	if attempt == attempts {
+	    break
+	}
+	timer := time.NewTimer(backoff)
+	select {
+	case <-timer.C:
+	case <-d.done:
+	    // Shutting down: dead-letter now rather than hold it up.
+	    timer.Stop()
+	    attempts = attempt
+	}
+	backoff *= 2
+    }
+    d.writeDeadLetter(deadLetter{
+	Url: wh.Url,
+	Event: event,
+	Attempts: attempts,
+	Error: err.Error(),
+	FailedAt: time.Now(),
+    })
+}
+
+func (d *WebhookDispatcher) post(wh WebhookConfig, event Event, body []byte) error {
+    req, err := http.NewRequest(http.MethodPost, wh.Url, bytes.NewReader(body))
+    if err != nil {
+	return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Macron-Event", event.Type)
+    req.Header.Set("X-Macron-Delivery", fmt.Sprint(event.Id))
+    if wh.Secret != "" {
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(body)
+	req.Header.Set(webhookSignatureHeader, "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    resp, err := d.client.Do(req)
+    if err != nil {
+	return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+	return fmt.Errorf("unexpected status: %s", resp.Status)
+    }
+    return nil
+}
+
+// writeDeadLetter appends a delivery that exhausted its retries to the dead
+// letter log as a JSON line.
+func (d *WebhookDispatcher) writeDeadLetter(entry deadLetter) {
+    slog.Error("Webhook gave up", "url", entry.Url, "event_id", entry.Event.Id, "error", entry.Error)
+    if d.deadLetterPath == "" {
+	return
+    }
+    line, err := json.Marshal(entry)
+    if err != nil {
+	return
+    }
+
+    d.deadLetterMu.Lock()
+    defer d.deadLetterMu.Unlock()
+    err = os.MkdirAll(filepath.Dir(d.deadLetterPath), 0700)
+    if err != nil {
+	slog.Error("Writing dead letter failed", "error", err)
+	return
+    }
+    file, err := os.OpenFile(d.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+	slog.Error("Writing dead letter failed", "error", err)
+	return
+    }
+    defer file.Close()
+    file.Write(append(line, '\n'))
+}
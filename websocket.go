@@ -0,0 +1,166 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+const (
+    defaultReadBufferSize       = 4096
+    defaultWriteBufferSize      = 4096
+    defaultMaxClientMessage     = 64 << 10
+    defaultMaxReceiverMessage   = 1 << 20
+    closeWait                   = time.Second
+    // enqueueTimeout is how long a message waits for room in a full egress
+    // queue before the peer is treated as not accepting messages.
+    enqueueTimeout              = time.Second
+)
+
+var errEgressFull = errors.New("Connection is not accepting messages.")
+
+// enqueue hands message to a connection's writePump. It gives up with
+// errEgressFull after enqueueTimeout rather than block its caller on a peer
+// that has stopped reading or whose writePump has exited.
+func enqueue(egress chan<- []byte, message []byte) error {
+    select {
+    case egress <- message:
+	return nil
+    default:
+    }
+    timer := time.NewTimer(enqueueTimeout)
+    defer timer.Stop()
+    return enqueueBefore(egress, message, timer.C)
+}
+
+// enqueueBefore is enqueue with a deadline chosen by the caller.
+func enqueueBefore(egress chan<- []byte, message []byte, deadline <-chan time.Time) error {
+    select {
+    case egress <- message:
+	return nil
+    case <-deadline:
+	return errEgressFull
+    }
+}
+
+// WebSocketConfig tunes the WebSocket upgrader. Receivers get a larger
+// message limit than clients since they upload function catalogs.
+type WebSocketConfig struct {
+    Compression         bool    `toml:"compression,omitempty"`
+    CompressionLevel    int     `toml:"compression_level,omitempty"`
+    ReadBufferSize      int     `toml:"read_buffer_size,omitempty"`
+    WriteBufferSize     int     `toml:"write_buffer_size,omitempty"`
+    MaxClientMessage    int64   `toml:"max_client_message,omitempty"`
+    MaxReceiverMessage  int64   `toml:"max_receiver_message,omitempty"`
+}
+
+func (c WebSocketConfig) clientLimit() int64 {
+    if c.MaxClientMessage > 0 {
+	return c.MaxClientMessage
+    }
+    return defaultMaxClientMessage
+}
+
+func (c WebSocketConfig) receiverLimit() int64 {
+    if c.MaxReceiverMessage > 0 {
+	return c.MaxReceiverMessage
+    }
+    return defaultMaxReceiverMessage
+}
+
+func newUpgrader(c WebSocketConfig, checkOrigin func(r *http.Request) bool) *websocket.Upgrader {
+    upgrader := &websocket.Upgrader{
+	ReadBufferSize: c.ReadBufferSize,
+	WriteBufferSize: c.WriteBufferSize,
+	CheckOrigin: checkOrigin,
+	Subprotocols: subprotocols,
+	EnableCompression: c.Compression,
+    }
+    if upgrader.ReadBufferSize <= 0 {
+	upgrader.ReadBufferSize = defaultReadBufferSize
+    }
+    if upgrader.WriteBufferSize <= 0 {
+	upgrader.WriteBufferSize = defaultWriteBufferSize
+    }
+    return upgrader
+}
+
+// upgrade upgrades the request and applies the configured compression and a
+// read limit of limit bytes. It answers 503 once the hub is shutting down.
+func (hub *Hub) upgrade(w http.ResponseWriter, r *http.Request, limit int64) (*websocket.Conn, error) {
+    if hub.isShuttingDown() {
+	http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+	return nil, errShuttingDown
+    }
+    ws, err := hub.upgrader.Upgrade(w, r, nil)
+    if err != nil {
+	return nil, err
+    }
+    if hub.config().WebSocket.Compression && hub.config().WebSocket.CompressionLevel != 0 {
+	err = ws.SetCompressionLevel(hub.config().WebSocket.CompressionLevel)
+	if err != nil {
+	    ws.SetCompressionLevel(flate.DefaultCompression)
+	}
+    }
+    setReadLimit(ws, limit)
+    return ws, nil
+}
+
+// setReadLimit caps messages at twice limit on the wire; past that the
+// connection is closed with 1009 before the message is read. readWireMessage
+// enforces limit itself on the decoded message, which lets it answer with a
+// message_too_large error instead of a bare close frame, and also covers
+// compressed messages that inflate past the limit.
+func setReadLimit(ws *websocket.Conn, limit int64) {
+    ws.SetReadLimit(2 * limit)
+}
+
+// MessageTooLargeError is returned by readWire when a peer sends a message
+// over its limit. The connection must be closed afterwards.
+type MessageTooLargeError struct {
+    Limit   int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+    return fmt.Sprintf("Message exceeds the %d byte limit.", e.Limit)
+}
+
+// readLimited reads the next message, failing once it grows past limit.
+func readLimited(ws *websocket.Conn, limit int64) ([]byte, error) {
+    _, reader, err := ws.NextReader()
+    if err != nil {
+	if errors.Is(err, websocket.ErrReadLimit) {
+	    return nil, &MessageTooLargeError{Limit: limit}
+	}
+	return nil, err
+    }
+    var buf bytes.Buffer
+    n, err := io.Copy(&buf, io.LimitReader(reader, limit + 1))
+    if errors.Is(err, websocket.ErrReadLimit) || n > limit {
+	return nil, &MessageTooLargeError{Limit: limit}
+    }
+    if err != nil {
+	return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// rejectTooLarge sends a peer that has not started its pumps an error
+// message and closes the connection.
+func rejectTooLarge(ws *websocket.Conn, message interface{}) {
+    writeWire(ws, message)
+    closeTooLarge(ws)
+}
+
+// closeTooLarge closes with 1009 (message too big). Control frames may be
+// written concurrently with the pumps.
+func closeTooLarge(ws *websocket.Conn) {
+    ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message_too_large"), time.Now().Add(closeWait))
+    ws.Close()
+}
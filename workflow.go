@@ -0,0 +1,521 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/pelletier/go-toml/v2"
+)
+
+const (
+    defaultStepTimeout  = 60 * time.Second
+    defaultWaitTimeout  = 5 * time.Minute
+    waitPollInterval    = time.Second
+    // workflowRunHistorySize caps the finished runs kept for lookup, like
+    // the exec history.
+    workflowRunHistorySize = 1000
+)
+
+// Failure policies for workflows and individual steps.
+const (
+    FailureAbort    = "abort"
+    FailureContinue = "continue"
+)
+
+// A Workflow is a list of steps run one after another. A step either execs a
+// function, waits for a receiver to come online, or runs its Parallel
+// children concurrently.
+type Workflow struct {
+    Name            string          `toml:"name" json:"name"`
+    Description     string          `toml:"description" json:"description,omitempty"`
+    OnFailure       string          `toml:"on_failure" json:"on_failure,omitempty"`
+    Steps           []WorkflowStep  `toml:"steps" json:"steps"`
+}
+
+type WorkflowStep struct {
+    Id              string                  `toml:"id" json:"id"`
+    ReceiverName    string                  `toml:"receiver" json:"receiver,omitempty"`
+    FunctionKey     string                  `toml:"function" json:"function,omitempty"`
+    Args            map[string]interface{}  `toml:"args" json:"args,omitempty"`
+    WaitFor         string                  `toml:"wait_for" json:"wait_for,omitempty"`
+    Parallel        []WorkflowStep          `toml:"parallel" json:"parallel,omitempty"`
+    If              string                  `toml:"if" json:"if,omitempty"`
+    Retries         int                     `toml:"retries" json:"retries,omitempty"`
+    RetryDelay      string                  `toml:"retry_delay" json:"retry_delay,omitempty"`
+    Timeout         string                  `toml:"timeout" json:"timeout,omitempty"`
+    OnFailure       string                  `toml:"on_failure" json:"on_failure,omitempty"`
+}
+
+type StepRun struct {
+    Id              string  `json:"id"`
+    ReceiverName    string  `json:"receiver_name,omitempty"`
+    Status          string  `json:"status"`
+    Attempts        int     `json:"attempts,omitempty"`
+    Output          string  `json:"output,omitempty"`
+    Error           string  `json:"error,omitempty"`
+}
+
+type WorkflowRun struct {
+    Id              string      `json:"id"`
+    Workflow        string      `json:"workflow"`
+    Status          string      `json:"status"`
+    StartedAt       time.Time   `json:"started_at"`
+    FinishedAt      *time.Time  `json:"finished_at,omitempty"`
+    Steps           []StepRun   `json:"steps"`
+}
+
+func (w *Workflow) validate() error {
+    if w.Name == "" {
+	return errors.New("Workflow Name Empty.")
+    }
+    if err := validFailurePolicy(w.OnFailure); err != nil {
+	return fmt.Errorf("Workflow %s: %w", w.Name, err)
+    }
+    ids := make(map[string]bool)
+    // finished holds the steps that are sure to have run before the step
+    // being checked starts, which are the only ones its condition can see.
+    // Parallel children run together, so they only count once the step
+    // holding them is done.
+    finished := make(map[string]bool)
+    var markFinished func(step WorkflowStep)
+    markFinished = func(step WorkflowStep) {
+	finished[step.Id] = true
+	for _, child := range step.Parallel {
+	    markFinished(child)
+	}
+    }
+    var check func(steps []WorkflowStep, parallel bool) error
+    check = func(steps []WorkflowStep, parallel bool) error {
+	for _, step := range steps {
+	    if step.Id == "" {
+		return fmt.Errorf("Workflow %s has a step without an id", w.Name)
+	    }
+	    if ids[step.Id] {
+		return fmt.Errorf("Workflow %s has duplicate step id: %s", w.Name, step.Id)
+	    }
+	    ids[step.Id] = true
+	    kinds := 0
+	    if step.FunctionKey != "" {
+		kinds++
+		if step.ReceiverName == "" {
+		    return fmt.Errorf("Step %s execs a function without a receiver", step.Id)
+		}
+	    }
+	    if step.WaitFor != "" {
+		kinds++
+	    }
+	    if len(step.Parallel) > 0 {
+		kinds++
+		if err := check(step.Parallel, true); err != nil {
+		    return err
+		}
+	    }
+	    if kinds != 1 {
+		return fmt.Errorf("Step %s needs exactly one of function, wait_for or parallel", step.Id)
+	    }
+	    if step.If != "" {
+		cond, err := parseCondition(step.If)
+		if err != nil {
+		    return err
+		}
+		if !finished[cond.step] {
+		    return fmt.Errorf("Step %s has a condition on a step that has not run before it: %s", step.Id, cond.step)
+		}
+	    }
+	    if step.Retries < 0 {
+		return fmt.Errorf("Step %s has negative retries: %d", step.Id, step.Retries)
+	    }
+	    if err := validFailurePolicy(step.OnFailure); err != nil {
+		return fmt.Errorf("Step %s: %w", step.Id, err)
+	    }
+	    for _, d := range []string{step.RetryDelay, step.Timeout} {
+		if d == "" {
+		    continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+		    return fmt.Errorf("Step %s has an invalid duration: %s", step.Id, d)
+		}
+	    }
+	    if !parallel {
+		markFinished(step)
+	    }
+	}
+	return nil
+    }
+    return check(w.Steps, false)
+}
+
+func validFailurePolicy(policy string) error {
+    switch policy {
+    case "", FailureAbort, FailureContinue:
+	return nil
+    }
+    return fmt.Errorf("Unknown on_failure policy: %s", policy)
+}
+
+func parseWorkflow(path string) (*Workflow, error) {
+    bytes, err := os.ReadFile(path)
+    if err != nil {
+	return nil, err
+    }
+    var w Workflow
+    switch filepath.Ext(path) {
+    case ".toml":
+	err = toml.Unmarshal(bytes, &w)
+    case ".json":
+	err = json.Unmarshal(bytes, &w)
+    default:
+	return nil, fmt.Errorf("Unsupported workflow format: %s", path)
+    }
+    if err != nil {
+	return nil, err
+    }
+    if w.Name == "" {
+	w.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    }
+    return &w, w.validate()
+}
+
+type WorkflowRunner struct {
+    hub     *Hub
+    dir     string
+    runs    map[string]*WorkflowRun
+    // finished holds the ids of finished runs, oldest first, so the oldest
+    // can be dropped once there are more than workflowRunHistorySize.
+    finished []string
+    mu      sync.Mutex
+}
+
+func NewWorkflowRunner(hub *Hub, dir string) *WorkflowRunner {
+    return &WorkflowRunner{
+	hub: hub,
+	dir: dir,
+	runs: make(map[string]*WorkflowRun),
+    }
+}
+
+// Workflows reads every definition from disk so edits apply without a
+// restart. Invalid files are logged and skipped.
+func (wr *WorkflowRunner) Workflows() []Workflow {
+    workflows := make([]Workflow, 0)
+    if wr.dir == "" {
+	return workflows
+    }
+    entries, err := os.ReadDir(wr.dir)
+    if err != nil {
+	if !errors.Is(err, os.ErrNotExist) {
+	    slog.Error("Reading workflows failed", "error", err)
+	}
+	return workflows
+    }
+    for _, entry := range entries {
+	ext := filepath.Ext(entry.Name())
+	if entry.IsDir() || (ext != ".toml" && ext != ".json") {
+	    continue
+	}
+	w, err := parseWorkflow(filepath.Join(wr.dir, entry.Name()))
+	if err != nil {
+	    slog.Warn("Skipping workflow", "file", entry.Name(), "error", err)
+	    continue
+	}
+	workflows = append(workflows, *w)
+    }
+    sort.Slice(workflows, func(i, j int) bool { return workflows[i].Name < workflows[j].Name })
+    return workflows
+}
+
+func (wr *WorkflowRunner) find(name string) (*Workflow, error) {
+    for _, w := range wr.Workflows() {
+	if w.Name == name {
+	    return &w, nil
+	}
+    }
+    return nil, fmt.Errorf("Workflow not found with name: %s", name)
+}
+
+func (wr *WorkflowRunner) Run(id string) (WorkflowRun, bool) {
+    wr.mu.Lock()
+    defer wr.mu.Unlock()
+    run, ok := wr.runs[id]
+    if !ok {
+	return WorkflowRun{}, false
+    }
+    return run.snapshot(), true
+}
+
+func (run *WorkflowRun) snapshot() WorkflowRun {
+    copied := *run
+    copied.Steps = append([]StepRun(nil), run.Steps...)
+    return copied
+}
+
+// Start begins running the named workflow in the background. notify is called
+// with a snapshot of the run every time a step changes state.
+func (wr *WorkflowRunner) Start(name string, notify func(WorkflowRun)) (WorkflowRun, error) {
+    w, err := wr.find(name)
+    if err != nil {
+	return WorkflowRun{}, err
+    }
+    run := &WorkflowRun{
+	Id: uuid.New().String(),
+	Workflow: w.Name,
+	Status: "running",
+	StartedAt: time.Now(),
+    }
+    var add func(steps []WorkflowStep)
+    add = func(steps []WorkflowStep) {
+	for _, step := range steps {
+	    run.Steps = append(run.Steps, StepRun{Id: step.Id, ReceiverName: step.ReceiverName, Status: "pending"})
+	    add(step.Parallel)
+	}
+    }
+    add(w.Steps)
+
+    wr.mu.Lock()
+    wr.runs[run.Id] = run
+    snapshot := run.snapshot()
+    wr.mu.Unlock()
+
+    go wr.execute(w, run, notify)
+    return snapshot, nil
+}
+
+func (wr *WorkflowRunner) execute(w *Workflow, run *WorkflowRun, notify func(WorkflowRun)) {
+    slog.Info("Starting workflow", "workflow", w.Name, "run", run.Id)
+    policy := w.OnFailure
+    if policy == "" {
+	policy = FailureAbort
+    }
+
+    status := "success"
+    aborted := false
+    for _, step := range w.Steps {
+	if aborted {
+	    wr.skipStep(run, step, notify)
+	    continue
+	}
+	if !wr.runStep(run, step, notify) {
+	    stepPolicy := step.OnFailure
+	    if stepPolicy == "" {
+		stepPolicy = policy
+	    }
+	    if stepPolicy == FailureAbort {
+		aborted = true
+		status = "failed"
+	    } else {
+		status = "completed_with_errors"
+	    }
+	}
+    }
+
+    now := time.Now()
+    wr.mu.Lock()
+    run.Status = status
+    run.FinishedAt = &now
+    snapshot := run.snapshot()
+    wr.finished = append(wr.finished, run.Id)
+    if len(wr.finished) > workflowRunHistorySize {
+	for _, id := range wr.finished[:len(wr.finished)-workflowRunHistorySize] {
+	    delete(wr.runs, id)
+	}
+	wr.finished = append([]string(nil), wr.finished[len(wr.finished)-workflowRunHistorySize:]...)
+    }
+    wr.mu.Unlock()
+    slog.Info("Workflow finished", "workflow", w.Name, "run", run.Id, "status", status)
+    if notify != nil {
+	notify(snapshot)
+    }
+}
+
+func (wr *WorkflowRunner) setStep(run *WorkflowRun, update StepRun, notify func(WorkflowRun)) {
+    wr.mu.Lock()
+    for i := range run.Steps {
+	if run.Steps[i].Id == update.Id {
+	    if update.ReceiverName == "" {
+		update.ReceiverName = run.Steps[i].ReceiverName
+	    }
+	    run.Steps[i] = update
+	}
+    }
+    snapshot := run.snapshot()
+    wr.mu.Unlock()
+    if notify != nil {
+	notify(snapshot)
+    }
+}
+
+// skipStep marks a step and any parallel children under it as skipped, so
+// that a run never finishes with steps left pending.
+func (wr *WorkflowRunner) skipStep(run *WorkflowRun, step WorkflowStep, notify func(WorkflowRun)) {
+    wr.setStep(run, StepRun{Id: step.Id, Status: "skipped"}, notify)
+    for _, child := range step.Parallel {
+	wr.skipStep(run, child, notify)
+    }
+}
+
+func (wr *WorkflowRunner) stepResult(run *WorkflowRun, id string) (StepRun, bool) {
+    wr.mu.Lock()
+    defer wr.mu.Unlock()
+    for _, step := range run.Steps {
+	if step.Id == id {
+	    return step, true
+	}
+    }
+    return StepRun{}, false
+}
+
+// runStep runs a single step, including its retries, and reports whether it
+// succeeded. Skipped steps count as successful.
+func (wr *WorkflowRunner) runStep(run *WorkflowRun, step WorkflowStep, notify func(WorkflowRun)) bool {
+    if step.If != "" {
+	cond, _ := parseCondition(step.If)
+	if !cond.eval(func(id string) (StepRun, bool) { return wr.stepResult(run, id) }) {
+	    wr.skipStep(run, step, notify)
+	    return true
+	}
+    }
+
+    if len(step.Parallel) > 0 {
+	wr.setStep(run, StepRun{Id: step.Id, Status: "running"}, notify)
+	var wg sync.WaitGroup
+	ok := make([]bool, len(step.Parallel))
+	for i, child := range step.Parallel {
+	    wg.Add(1)
+	    go func(i int, child WorkflowStep) {
+		defer wg.Done()
+		ok[i] = wr.runStep(run, child, notify)
+	    }(i, child)
+	}
+	wg.Wait()
+	for _, childOk := range ok {
+	    if !childOk {
+		wr.setStep(run, StepRun{Id: step.Id, Status: "failed", Error: "One or more parallel steps failed."}, notify)
+		return false
+	    }
+	}
+	wr.setStep(run, StepRun{Id: step.Id, Status: "success"}, notify)
+	return true
+    }
+
+    timeout := defaultStepTimeout
+    if step.WaitFor != "" {
+	timeout = defaultWaitTimeout
+    }
+    if step.Timeout != "" {
+	timeout, _ = time.ParseDuration(step.Timeout)
+    }
+    retryDelay := time.Duration(0)
+    if step.RetryDelay != "" {
+	retryDelay, _ = time.ParseDuration(step.RetryDelay)
+    }
+
+    var result StepRun
+    for attempt := 1; attempt <= step.Retries+1; attempt++ {
+	wr.setStep(run, StepRun{Id: step.Id, Status: "running", Attempts: attempt}, notify)
+	if step.WaitFor != "" {
+	    result = wr.waitForReceiver(step, timeout)
+	} else {
+	    result = wr.execStep(step, timeout)
+	}
+	result.Attempts = attempt
+	if result.Status == "success" {
+	    break
+	}
+	if attempt <= step.Retries && retryDelay > 0 {
+	    time.Sleep(retryDelay)
+	}
+    }
+    wr.setStep(run, result, notify)
+    return result.Status == "success"
+}
+
+func (wr *WorkflowRunner) execStep(step WorkflowStep, timeout time.Duration) StepRun {
+    result, err := wr.hub.ExecAndWait(step.ReceiverName, step.FunctionKey, step.Args, timeout)
+    if err != nil {
+	return StepRun{Id: step.Id, Status: "failed", Error: err.Error()}
+    }
+    status := result.Status
+    if status != "success" {
+	status = "failed"
+    }
+    return StepRun{Id: step.Id, Status: status, Output: result.Output, Error: result.Error}
+}
+
+func (wr *WorkflowRunner) waitForReceiver(step WorkflowStep, timeout time.Duration) StepRun {
+    deadline := time.Now().Add(timeout)
+    for {
+	wr.hub.mu.Lock()
+	online := wr.hub.receivers[step.WaitFor] != nil
+	wr.hub.mu.Unlock()
+	if online {
+	    return StepRun{Id: step.Id, ReceiverName: step.WaitFor, Status: "success"}
+	}
+	if time.Now().After(deadline) {
+	    return StepRun{
+		Id: step.Id,
+		ReceiverName: step.WaitFor,
+		Status: "failed",
+		Error: fmt.Sprintf("Receiver %s did not come online within %v", step.WaitFor, timeout),
+	    }
+	}
+	time.Sleep(waitPollInterval)
+    }
+}
+
+// A condition compares a field of an earlier step, written as
+// "<step>.status == success" or "<step>.output contains mounted".
+type condition struct {
+    step    string
+    field   string
+    op      string
+    value   string
+}
+
+func parseCondition(expr string) (*condition, error) {
+    for _, op := range []string{"==", "!=", " contains "} {
+	left, right, found := strings.Cut(expr, op)
+	if !found {
+	    continue
+	}
+	step, field, found := strings.Cut(strings.TrimSpace(left), ".")
+	if !found || (field != "status" && field != "output") {
+	    return nil, fmt.Errorf("Invalid condition: %s", expr)
+	}
+	value := strings.TrimSpace(right)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+	    value = unquoted
+	}
+	return &condition{step: step, field: field, op: strings.TrimSpace(op), value: value}, nil
+    }
+    return nil, fmt.Errorf("Invalid condition: %s", expr)
+}
+
+func (c *condition) eval(lookup func(id string) (StepRun, bool)) bool {
+    step, ok := lookup(c.step)
+    if !ok {
+	return false
+    }
+    actual := step.Status
+    if c.field == "output" {
+	actual = step.Output
+    }
+    switch c.op {
+    case "==":
+	return actual == c.value
+    case "!=":
+	return actual != c.value
+    case "contains":
+	return strings.Contains(actual, c.value)
+    }
+    return false
+}